@@ -2,17 +2,31 @@ package handlers
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/labstack/echo-contrib/zipkintracing"
 	"github.com/labstack/echo/v4"
 	"github.com/openzipkin/zipkin-go"
+
+	"github.com/philips-software/logproxy/queue"
 )
 
+// HealthHandler reports the health of logproxy. When Connector is set the
+// broker connection is included, when Breaker is set the circuit breaker of
+// the Deliverer and Sinks holds the breakers of secondary delivery sinks.
+// A lost connection or an open breaker degrades the status but keeps
+// reporting 200, restarting logproxy would only lose the spill buffer
 type HealthHandler struct {
+	Connector queue.Connector
+	Breaker   queue.BreakerReporter
+	Sinks     map[string]queue.BreakerReporter
 }
 
 type healthResponse struct {
-	Status string `json:"status"`
+	Status  string                         `json:"status"`
+	Queue   *queue.ConnectionStatus        `json:"queue,omitempty"`
+	Breaker *queue.BreakerStatus           `json:"breaker,omitempty"`
+	Sinks   map[string]queue.BreakerStatus `json:"sinks,omitempty"`
 }
 
 func (h HealthHandler) Handler(tracer *zipkin.Tracer) echo.HandlerFunc {
@@ -21,11 +35,35 @@ func (h HealthHandler) Handler(tracer *zipkin.Tracer) echo.HandlerFunc {
 			span := zipkintracing.StartChildSpan(c, "dump", tracer)
 			defer span.Finish()
 			traceID := span.Context().TraceID.String()
-			fmt.Printf("handler=health traceID=%s\n", traceID)
+			fmt.Fprintf(os.Stderr, "handler=health traceID=%s\n", traceID)
 		}
 		response := &healthResponse{
 			Status: "UP",
 		}
+		if h.Connector != nil {
+			status := h.Connector.ConnectionStatus()
+			response.Queue = &status
+			if !status.Connected() {
+				response.Status = "DEGRADED"
+			}
+		}
+		if h.Breaker != nil {
+			status := h.Breaker.BreakerStatus()
+			response.Breaker = &status
+			if status.State != queue.BreakerClosed {
+				response.Status = "DEGRADED"
+			}
+		}
+		for name, sink := range h.Sinks {
+			if response.Sinks == nil {
+				response.Sinks = make(map[string]queue.BreakerStatus)
+			}
+			status := sink.BreakerStatus()
+			response.Sinks[name] = status
+			if status.State != queue.BreakerClosed {
+				response.Status = "DEGRADED"
+			}
+		}
 		return c.JSON(200, response)
 	}
 }
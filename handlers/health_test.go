@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/philips-software/logproxy/handlers"
+	"github.com/philips-software/logproxy/queue"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -28,3 +29,71 @@ func TestHealth(t *testing.T) {
 		assert.Equal(t, statusJSON, rec.Body.String())
 	}
 }
+
+type fakeConnector struct {
+	status queue.ConnectionStatus
+}
+
+func (f fakeConnector) ConnectionStatus() queue.ConnectionStatus {
+	return f.status
+}
+
+func TestHealthConnection(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/health", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	healthHandler := &handlers.HealthHandler{Connector: fakeConnector{queue.ConnectionStatus{
+		Producer: queue.StateConnected,
+		Consumer: queue.StateConnecting,
+		Spilled:  3,
+	}}}
+
+	if assert.NoError(t, healthHandler.Handler(nil)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"status\":\"DEGRADED\",\"queue\":{\"producer\":\"connected\",\"consumer\":\"connecting\",\"reconnects\":0,\"spilled\":3,\"spillDropped\":0}}\n", rec.Body.String())
+	}
+}
+
+type fakeBreaker struct {
+	status queue.BreakerStatus
+}
+
+func (f fakeBreaker) BreakerStatus() queue.BreakerStatus {
+	return f.status
+}
+
+func TestHealthBreaker(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/health", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	healthHandler := &handlers.HealthHandler{Breaker: fakeBreaker{queue.BreakerStatus{
+		State:    queue.BreakerOpen,
+		Failures: 5,
+		Opens:    1,
+	}}}
+
+	if assert.NoError(t, healthHandler.Handler(nil)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"status\":\"DEGRADED\",\"breaker\":{\"state\":\"open\",\"failures\":5,\"opens\":1}}\n", rec.Body.String())
+	}
+}
+
+func TestHealthSinks(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/health", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	healthHandler := &handlers.HealthHandler{
+		Breaker: fakeBreaker{queue.BreakerStatus{State: queue.BreakerClosed}},
+		Sinks: map[string]queue.BreakerReporter{
+			"none": fakeBreaker{queue.BreakerStatus{State: queue.BreakerHalfOpen, Failures: 3, Opens: 2}},
+		},
+	}
+
+	if assert.NoError(t, healthHandler.Handler(nil)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"status\":\"DEGRADED\",\"breaker\":{\"state\":\"closed\",\"failures\":0,\"opens\":0},\"sinks\":{\"none\":{\"state\":\"half-open\",\"failures\":3,\"opens\":2}}}\n", rec.Body.String())
+	}
+}
@@ -82,7 +82,7 @@ func (h *IronIOHandler) Handler(tracer *zipkin.Tracer) echo.HandlerFunc {
 				span := zipkintracing.StartChildSpan(c, "push", tracer)
 				defer span.Finish()
 				traceID := span.Context().TraceID.String()
-				fmt.Printf("handler=ironio traceID=%s\n", traceID)
+				fmt.Fprintf(os.Stderr, "handler=ironio traceID=%s\n", traceID)
 			}
 			_ = h.pusher.Push([]byte(IronToRFC5424(now, string(b))))
 		}()
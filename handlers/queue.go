@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+
+	"github.com/philips-software/logproxy/queue"
+)
+
+type queueResponse struct {
+	Type             string  `json:"type"`
+	Depth            int64   `json:"depth"`
+	OldestAgeSeconds float64 `json:"oldestAgeSeconds"`
+	Capacity         int64   `json:"capacity,omitempty"`
+	Bytes            int64   `json:"bytes,omitempty"`
+	MaxBytes         int64   `json:"maxBytes,omitempty"`
+	Pushes           int64   `json:"pushes"`
+	Pops             int64   `json:"pops"`
+	DeadLetters      int64   `json:"deadLetters"`
+}
+
+func QueueHandler(queueType string, q queue.Queue) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		stats := q.Stats()
+		return c.JSON(200, &queueResponse{
+			Type:             queueType,
+			Depth:            stats.Depth,
+			OldestAgeSeconds: stats.OldestAge.Seconds(),
+			Capacity:         stats.Capacity,
+			Bytes:            stats.Bytes,
+			MaxBytes:         stats.MaxBytes,
+			Pushes:           stats.Pushes,
+			Pops:             stats.Pops,
+			DeadLetters:      stats.DeadLetters,
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philips-software/logproxy/handlers"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	// Setup
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/api/queue", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	queueHandler := handlers.QueueHandler("channel", &mockProducer{t: t})
+
+	// Assertions
+	if assert.NoError(t, queueHandler(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "{\"type\":\"channel\",\"depth\":0,\"oldestAgeSeconds\":0,\"pushes\":0,\"pops\":0,\"deadLetters\":0}\n", rec.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo-contrib/zipkintracing"
+	"github.com/labstack/echo/v4"
+	"github.com/openzipkin/zipkin-go"
+
+	"github.com/philips-software/logproxy/queue"
+)
+
+// ReplayFunc replays dead letters using the given options
+type ReplayFunc func(ctx context.Context, opts queue.ReplayOptions) (queue.ReplayStats, error)
+
+type ReplayHandler struct {
+	replay ReplayFunc
+	token  string
+}
+
+type replayProgress struct {
+	queue.ReplayStats
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+func NewReplayHandler(token string, replay ReplayFunc) (*ReplayHandler, error) {
+	if token == "" {
+		return nil, fmt.Errorf("missing admin token")
+	}
+	if replay == nil {
+		return nil, fmt.Errorf("missing replay function")
+	}
+	return &ReplayHandler{
+		replay: replay,
+		token:  token,
+	}, nil
+}
+
+func (h *ReplayHandler) authorized(c echo.Context) bool {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	bearer, found := strings.CutPrefix(auth, "Bearer ")
+	if !found {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(h.token)) == 1
+}
+
+// Handler streams replay progress as newline delimited JSON. The last
+// line has done set to true and contains the final counts
+func (h *ReplayHandler) Handler(tracer *zipkin.Tracer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if tracer != nil {
+			defer zipkintracing.TraceFunc(c, "replay_handler", zipkintracing.DefaultSpanTags, tracer)()
+		}
+		if !h.authorized(c) {
+			return c.String(http.StatusUnauthorized, "")
+		}
+		dryRun, _ := strconv.ParseBool(c.QueryParam("dryRun"))
+		filter, _ := strconv.ParseBool(c.QueryParam("filter"))
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		res.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(res)
+
+		stats, err := h.replay(c.Request().Context(), queue.ReplayOptions{
+			DryRun: dryRun,
+			Filter: filter,
+			Progress: func(stats queue.ReplayStats) {
+				_ = encoder.Encode(replayProgress{ReplayStats: stats})
+				res.Flush()
+			},
+		})
+		final := replayProgress{ReplayStats: stats, Done: true}
+		if err != nil {
+			final.Error = err.Error()
+		}
+		return encoder.Encode(final)
+	}
+}
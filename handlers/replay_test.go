@@ -0,0 +1,66 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/philips-software/logproxy/handlers"
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayHandler(t *testing.T) {
+	_, err := handlers.NewReplayHandler("", nil)
+	assert.NotNil(t, err)
+
+	var received queue.ReplayOptions
+	replayHandler, err := handlers.NewReplayHandler("s3cret", func(_ context.Context, opts queue.ReplayOptions) (queue.ReplayStats, error) {
+		received = opts
+		opts.Progress(queue.ReplayStats{Total: 2, Processed: 1, Replayed: 1, DryRun: opts.DryRun})
+		return queue.ReplayStats{Total: 2, Processed: 2, Replayed: 2, DryRun: opts.DryRun}, nil
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	e := echo.New()
+	e.POST("/api/deadletters/replay", replayHandler.Handler(nil))
+
+	req := httptest.NewRequest(echo.POST, "/api/deadletters/replay", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer wrong")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(echo.POST, "/api/deadletters/replay?dryRun=true&filter=true", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer s3cret")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, received.DryRun)
+	assert.True(t, received.Filter)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, `{"total":2,"processed":1,"replayed":1,"dropped":0,"failed":0,"skipped":0,"dryRun":true,"done":false}`, lines[0])
+		assert.Equal(t, `{"total":2,"processed":2,"replayed":2,"dropped":0,"failed":0,"skipped":0,"dryRun":true,"done":true}`, lines[1])
+	}
+}
+
+func TestReplayHandlerError(t *testing.T) {
+	replayHandler, _ := handlers.NewReplayHandler("s3cret", func(_ context.Context, _ queue.ReplayOptions) (queue.ReplayStats, error) {
+		return queue.ReplayStats{}, errors.New("store unavailable")
+	})
+	e := echo.New()
+	e.POST("/api/deadletters/replay", replayHandler.Handler(nil))
+
+	req := httptest.NewRequest(echo.POST, "/api/deadletters/replay", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), `"error":"store unavailable"`)
+}
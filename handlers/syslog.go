@@ -49,7 +49,7 @@ func (h *SyslogHandler) Handler(tracer *zipkin.Tracer) echo.HandlerFunc {
 				span := zipkintracing.StartChildSpan(c, "push", tracer)
 				defer span.Finish()
 				traceID := span.Context().TraceID.String()
-				fmt.Printf("handler=syslog traceID=%s\n", traceID)
+				fmt.Fprintf(os.Stderr, "handler=syslog traceID=%s\n", traceID)
 			}
 			_ = h.pusher.Push(b)
 		}()
@@ -29,6 +29,14 @@ func (m *mockProducer) SetMetrics(_ queue.Metrics) {
 	// Noop
 }
 
+func (m *mockProducer) SetDeadLetterStore(_ queue.DeadLetterStore) {
+	// Noop
+}
+
+func (m *mockProducer) Stats() queue.Stats {
+	return queue.Stats{}
+}
+
 func (m *mockProducer) Push(_ []byte) error {
 	return nil
 }
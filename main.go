@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dip-software/go-dip-api/iam"
 	zipkinReporter "github.com/openzipkin/zipkin-go/reporter"
@@ -13,6 +21,7 @@ import (
 
 	"github.com/philips-software/logproxy/queue"
 	"github.com/philips-software/logproxy/shared"
+	"github.com/philips-software/logproxy/sinks"
 
 	"github.com/dip-software/go-dip-api/logging"
 	"github.com/philips-software/logproxy/handlers"
@@ -40,6 +49,43 @@ type metrics struct {
 	EnhancedEncodedMessage prometheus.Counter
 	PluginDropped          prometheus.Counter
 	PluginModified         prometheus.Counter
+	QueueOverflow          *prometheus.CounterVec
+	ParseFailed            prometheus.Counter
+	BatchSize              prometheus.Histogram
+	BatchAge               prometheus.Histogram
+	BatchesInFlight        prometheus.Gauge
+	PartialFailures        *prometheus.CounterVec
+	SinkDropped            *prometheus.CounterVec
+	Routed                 *prometheus.CounterVec
+}
+
+func (m metrics) IncRouted(route string) {
+	m.Routed.WithLabelValues(route).Inc()
+}
+
+func (m metrics) IncSinkDropped(sink, reason string) {
+	m.SinkDropped.WithLabelValues(sink, reason).Inc()
+}
+
+func (m metrics) IncPartialFailure(outcome string, resources int) {
+	m.PartialFailures.WithLabelValues(outcome).Add(float64(resources))
+}
+
+func (m metrics) SetBatchesInFlight(batches int) {
+	m.BatchesInFlight.Set(float64(batches))
+}
+
+func (m metrics) ObserveBatch(count int, age time.Duration) {
+	m.BatchSize.Observe(float64(count))
+	m.BatchAge.Observe(age.Seconds())
+}
+
+func (m metrics) IncParseFailed() {
+	m.ParseFailed.Inc()
+}
+
+func (m metrics) IncQueueOverflow(outcome string) {
+	m.QueueOverflow.WithLabelValues(outcome).Inc()
 }
 
 func (m metrics) IncPluginDropped() {
@@ -65,13 +111,14 @@ func (m metrics) IncEnhancedTransactionID() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
 	e := make(chan *echo.Echo, 1)
 	os.Exit(realMain(e))
 }
 
-func realMain(echoChan chan<- *echo.Echo) int {
-	logger := log.New()
-
+func setupConfig() {
 	viper.SetEnvPrefix("logproxy")
 	viper.SetDefault("syslog", true)
 	viper.SetDefault("ironio", false)
@@ -83,7 +130,137 @@ func realMain(echoChan chan<- *echo.Echo) int {
 	viper.SetDefault("env", "client-test")
 	viper.SetDefault("service_id", "")
 	viper.SetDefault("service_private_key", "")
+	viper.SetDefault("deadletter", "")
+	viper.SetDefault("deadletter_file", "logproxy-deadletters.ndjson")
+	viper.SetDefault("admin_token", "")
+	viper.SetDefault("shutdown_timeout", "10s")
+	viper.SetDefault("batch_max_count", 25)
+	viper.SetDefault("batch_max_bytes", 0)
+	viper.SetDefault("batch_max_linger", "500ms")
+	viper.SetDefault("delivery_workers", 1)
+	viper.SetDefault("delivery_max_in_flight", 0)
+	viper.SetDefault("retry_max", 5)
+	viper.SetDefault("retry_initial", "500ms")
+	viper.SetDefault("retry_max_delay", "30s")
+	viper.SetDefault("breaker_failures", 5)
+	viper.SetDefault("breaker_cooldown", "30s")
+	viper.SetDefault("sink_buffer", 1000)
+	viper.SetDefault("routes_file", "")
+	viper.SetDefault("file_path", "-")
+	viper.SetDefault("file_decode", false)
+	viper.SetDefault("file_max_size", 0)
+	viper.SetDefault("file_max_age", "0s")
+	viper.SetDefault("file_max_backups", 0)
+	viper.SetDefault("file_compress", false)
+	viper.SetDefault("webhook_url", "")
+	viper.SetDefault("webhook_headers", "")
+	viper.SetDefault("webhook_username", "")
+	viper.SetDefault("webhook_password", "")
+	viper.SetDefault("webhook_token", "")
+	viper.SetDefault("webhook_timeout", "10s")
+	viper.SetDefault("webhook_decode", false)
+	viper.SetDefault("elasticsearch_url", "")
+	viper.SetDefault("elasticsearch_index", "logproxy-{date:2006.01.02}")
+	viper.SetDefault("elasticsearch_username", "")
+	viper.SetDefault("elasticsearch_password", "")
+	viper.SetDefault("elasticsearch_api_key", "")
+	viper.SetDefault("elasticsearch_data_stream", false)
+	viper.SetDefault("elasticsearch_timeout", "10s")
+	viper.SetDefault("elasticsearch_decode", true)
+	viper.SetDefault("loki_url", "")
+	viper.SetDefault("loki_labels", "applicationName,serverName,severity")
+	viper.SetDefault("loki_static_labels", "")
+	viper.SetDefault("loki_tenant", "")
+	viper.SetDefault("loki_username", "")
+	viper.SetDefault("loki_password", "")
+	viper.SetDefault("loki_timeout", "10s")
+	viper.SetDefault("syslog_network", "tcp")
+	viper.SetDefault("syslog_address", "")
+	viper.SetDefault("syslog_framing", "octet-counting")
+	viper.SetDefault("syslog_facility", 1)
+	viper.SetDefault("syslog_enterprise_id", sinks.DocumentationEnterpriseID)
+	viper.SetDefault("syslog_timeout", "10s")
+	viper.SetDefault("syslog_tls_ca_file", "")
+	viper.SetDefault("syslog_tls_cert_file", "")
+	viper.SetDefault("syslog_tls_key_file", "")
+	viper.SetDefault("syslog_tls_server_name", "")
+	viper.SetDefault("syslog_tls_insecure_skip_verify", false)
+	viper.SetDefault("s3_endpoint", "")
+	viper.SetDefault("s3_bucket", "")
+	viper.SetDefault("s3_region", "us-east-1")
+	viper.SetDefault("s3_prefix", "")
+	viper.SetDefault("s3_access_key_id", "")
+	viper.SetDefault("s3_secret_access_key", "")
+	viper.SetDefault("s3_session_token", "")
+	viper.SetDefault("s3_virtual_hosted", false)
+	viper.SetDefault("s3_timeout", "1m")
+	viper.SetDefault("s3_batch_max_count", 10000)
+	viper.SetDefault("s3_batch_max_bytes", 16*1024*1024)
+	viper.SetDefault("s3_batch_max_linger", "1m")
+	viper.SetDefault("s3_reliable", true)
+	viper.SetDefault("otlp_protocol", "grpc")
+	viper.SetDefault("otlp_endpoint", "")
+	viper.SetDefault("otlp_headers", "")
+	viper.SetDefault("otlp_timeout", "10s")
+	viper.SetDefault("otlp_tls", false)
+	viper.SetDefault("otlp_tls_ca_file", "")
+	viper.SetDefault("otlp_tls_cert_file", "")
+	viper.SetDefault("otlp_tls_key_file", "")
+	viper.SetDefault("otlp_tls_server_name", "")
+	viper.SetDefault("otlp_tls_insecure_skip_verify", false)
+	viper.SetDefault("disk_dir", "logproxy-queue")
+	viper.SetDefault("disk_segment_bytes", 16*1024*1024)
+	viper.SetDefault("disk_max_bytes", 512*1024*1024)
+	viper.SetDefault("disk_fsync", "interval")
+	viper.SetDefault("disk_fsync_interval", "1s")
+	viper.SetDefault("channel_capacity", 50)
+	viper.SetDefault("channel_overflow", "block")
+	viper.SetDefault("channel_overflow_timeout", "0s")
+	viper.SetDefault("priority_lanes", false)
+	viper.SetDefault("rabbitmq_url", "")
+	viper.SetDefault("rabbitmq_vhost", "")
+	viper.SetDefault("rabbitmq_tls_ca_file", "")
+	viper.SetDefault("rabbitmq_tls_cert_file", "")
+	viper.SetDefault("rabbitmq_tls_key_file", "")
+	viper.SetDefault("rabbitmq_tls_server_name", "")
+	viper.SetDefault("rabbitmq_tls_insecure_skip_verify", false)
+	viper.SetDefault("rabbitmq_exchange", "logproxy")
+	viper.SetDefault("rabbitmq_routing_key", "new.rfc5424")
+	viper.SetDefault("rabbitmq_queue", "logproxy_rfc5424")
+	viper.SetDefault("rabbitmq_consumer_tag", "logproxy")
+	viper.SetDefault("rabbitmq_deadletter_queue", "logproxy_deadletter")
+	viper.SetDefault("rabbitmq_deadletter_routing_key", "deadletter.rfc5424")
+	viper.SetDefault("rabbitmq_prefetch", 0)
+	viper.SetDefault("rabbitmq_durable", false)
+	viper.SetDefault("rabbitmq_queue_type", "classic")
+	viper.SetDefault("rabbitmq_message_ttl", "0s")
+	viper.SetDefault("rabbitmq_max_length", 0)
+	viper.SetDefault("rabbitmq_max_length_bytes", 0)
+	viper.SetDefault("rabbitmq_reconnect_initial", "1s")
+	viper.SetDefault("rabbitmq_reconnect_max", "30s")
+	viper.SetDefault("rabbitmq_spill_capacity", 1000)
+	viper.SetDefault("redis_url", "")
+	viper.SetDefault("redis_stream", "logproxy")
+	viper.SetDefault("redis_group", "logproxy")
+	viper.SetDefault("redis_consumer", "")
+	viper.SetDefault("redis_maxlen", 0)
+	viper.SetDefault("redis_claim_min_idle", "1m")
+	viper.SetDefault("nats_url", "nats://127.0.0.1:4222")
+	viper.SetDefault("nats_stream", "LOGPROXY")
+	viper.SetDefault("nats_subject", "logproxy.rfc5424")
+	viper.SetDefault("nats_durable", "logproxy")
+	viper.SetDefault("nats_ack_wait", "1m")
+	viper.SetDefault("nats_max_bytes", 0)
+	viper.SetDefault("nats_max_age", "0s")
 	viper.AutomaticEnv()
+}
+
+func realMain(echoChan chan<- *echo.Echo) int {
+	logger := log.New()
+	// stdout is left to the file sink, diagnostics go to stderr
+	logger.SetOutput(os.Stderr)
+
+	setupConfig()
 
 	enableIronIO := viper.GetBool("ironio")
 	enableSyslog := viper.GetBool("syslog")
@@ -123,10 +300,45 @@ func realMain(echoChan chan<- *echo.Echo) int {
 			Name: "logproxy_plugin_modified_total",
 			Help: "Total number of messages modified by plugins",
 		}),
+		QueueOverflow: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "logproxy_queue_overflow_total",
+			Help: "Total number of pushes to a full queue by outcome",
+		}, []string{"outcome"}),
+		ParseFailed: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "logproxy_parse_failures_total",
+			Help: "Total number of payloads which could not be parsed",
+		}),
+		BatchSize: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "logproxy_batch_size",
+			Help:    "Number of resources per delivered batch",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}),
+		BatchAge: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "logproxy_batch_age_seconds",
+			Help:    "Time between the first resource of a batch and its delivery",
+			Buckets: prometheus.DefBuckets,
+		}),
+		BatchesInFlight: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "logproxy_batches_in_flight",
+			Help: "Number of batches being delivered",
+		}),
+		PartialFailures: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "logproxy_partial_failure_resources_total",
+			Help: "Total number of resources in HSDP 635 and OTLP partial failure responses by outcome",
+		}, []string{"outcome"}),
+		SinkDropped: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "logproxy_sink_dropped_total",
+			Help: "Total number of resources a secondary sink dropped by reason",
+		}, []string{"sink", "reason"}),
+		Routed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "logproxy_routed_total",
+			Help: "Total number of resources by the route they took",
+		}, []string{"route"}),
 	}
 
 	// Echo framework
 	e := echo.New()
+	e.Logger.SetOutput(os.Stderr)
 
 	// Tracing
 	endpoint, err := zipkin.NewEndpoint("echo-service", "")
@@ -149,39 +361,95 @@ func realMain(echoChan chan<- *echo.Echo) int {
 		e.Use(zipkintracing.TraceServer(tracer))
 	}
 	// Plugin Manager
-	homeDir, _ := os.UserHomeDir()
-	pluginExePath, _ := os.Executable()
-	pluginManager := &shared.PluginManager{
-		PluginDirs: []string{
-			filepath.Join(homeDir, ".logproxy/plugins"),
-			filepath.Dir(pluginExePath),
-		},
-	}
-	if pluginDir := viper.GetString("plugindir"); pluginDir != "" {
-		pluginManager.PluginDirs = append(pluginManager.PluginDirs, pluginDir)
-	}
-	if err := pluginManager.Discover(); err == nil {
-		_ = pluginManager.LoadAll()
+	pluginManager := setupPluginManager()
+
+	// Dead letters
+	deadLetterStore, err := setupDeadLetterStore(viper.GetString("deadletter"))
+	if err != nil {
+		logger.Errorf("dead letter store error: %v", err)
+		return 8
 	}
 
 	// Queue Type
 	var messageQueue queue.Queue
 	switch queueType {
 	case "rabbitmq":
-		messageQueue, err = queue.NewRabbitMQQueue(nil, queue.WithMetrics(metrics))
+		messageQueue, err = queue.NewRabbitMQQueue(nil, queue.WithMetrics(metrics), queue.WithDeadLetterStore(deadLetterStore),
+			queue.WithRabbitMQConfig(setupRabbitMQConfig()))
 		if err != nil {
 			logger.Errorf("RabbitMQ queue error: %v", err)
 			return 128
 		}
 		logger.Info("using RabbitMQ queue")
+	case "disk":
+		messageQueue, err = queue.NewDiskQueue(queue.DiskConfig{
+			Dir:           viper.GetString("disk_dir"),
+			SegmentBytes:  viper.GetInt64("disk_segment_bytes"),
+			MaxBytes:      viper.GetInt64("disk_max_bytes"),
+			Fsync:         queue.FsyncPolicy(viper.GetString("disk_fsync")),
+			FsyncInterval: viper.GetDuration("disk_fsync_interval"),
+		}, queue.WithMetrics(metrics), queue.WithDeadLetterStore(deadLetterStore))
+		if err != nil {
+			logger.Errorf("disk queue error: %v", err)
+			return 129
+		}
+		logger.Infof("using disk queue in %s", viper.GetString("disk_dir"))
+	case "redis":
+		messageQueue, err = queue.NewRedisQueue(nil, queue.RedisConfig{
+			URL:          viper.GetString("redis_url"),
+			Stream:       viper.GetString("redis_stream"),
+			Group:        viper.GetString("redis_group"),
+			Consumer:     viper.GetString("redis_consumer"),
+			MaxLen:       viper.GetInt64("redis_maxlen"),
+			ClaimMinIdle: viper.GetDuration("redis_claim_min_idle"),
+		}, queue.WithMetrics(metrics), queue.WithDeadLetterStore(deadLetterStore))
+		if err != nil {
+			logger.Errorf("redis queue error: %v", err)
+			return 131
+		}
+		logger.Infof("using Redis stream %s", viper.GetString("redis_stream"))
+	case "nats":
+		messageQueue, err = queue.NewNATSQueue(nil, queue.NATSConfig{
+			URL:      viper.GetString("nats_url"),
+			Stream:   viper.GetString("nats_stream"),
+			Subject:  viper.GetString("nats_subject"),
+			Durable:  viper.GetString("nats_durable"),
+			AckWait:  viper.GetDuration("nats_ack_wait"),
+			MaxBytes: viper.GetInt64("nats_max_bytes"),
+			MaxAge:   viper.GetDuration("nats_max_age"),
+		}, queue.WithMetrics(metrics), queue.WithDeadLetterStore(deadLetterStore))
+		if err != nil {
+			logger.Errorf("NATS queue error: %v", err)
+			return 132
+		}
+		logger.Infof("using NATS JetStream stream %s", viper.GetString("nats_stream"))
 	default:
-		messageQueue, _ = queue.NewChannelQueue(queue.WithMetrics(metrics))
+		opts := []queue.OptionFunc{queue.WithMetrics(metrics), queue.WithDeadLetterStore(deadLetterStore),
+			queue.WithCapacity(viper.GetInt("channel_capacity")),
+			queue.WithOverflowPolicy(queue.OverflowPolicy(viper.GetString("channel_overflow")), viper.GetDuration("channel_overflow_timeout"))}
+		if viper.GetBool("priority_lanes") {
+			opts = append(opts, queue.WithPriorityLanes())
+		}
+		messageQueue, err = queue.NewChannelQueue(opts...)
+		if err != nil {
+			logger.Errorf("channel queue error: %v", err)
+			return 130
+		}
 		logger.Info("using internal channel queue")
 	}
 
+	if viper.GetBool("priority_lanes") && (queueType == "disk" || queueType == "redis" || queueType == "nats") {
+		logger.Warnf("priority lanes are not supported by the %s queue", queueType)
+	}
+
+	setupQueueMetrics(messageQueue)
+
 	healthHandler := handlers.HealthHandler{}
-	e.GET("/health", healthHandler.Handler(tracer))
+	if connector, ok := messageQueue.(queue.Connector); ok {
+		healthHandler.Connector = connector
+	}
 	e.GET("/api/version", handlers.VersionHandler(buildVersion))
+	e.GET("/api/queue", handlers.QueueHandler(queueType, messageQueue))
 
 	// Syslog
 	if enableSyslog {
@@ -207,7 +475,7 @@ func realMain(echoChan chan<- *echo.Echo) int {
 
 	setupPprof(logger)
 	setupPrometheus(logger)
-	setupInterrupts(logger)
+	shutdown := setupInterrupts(logger, e, viper.GetDuration("shutdown_timeout"))
 
 	// Consumer
 	var done chan bool
@@ -217,6 +485,136 @@ func realMain(echoChan chan<- *echo.Echo) int {
 	}
 
 	// Worker
+	config, exitCode := setupLoggingConfig(logger, enableDebug)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	doneWorker := make(chan bool)
+	var sinks []queue.Sink
+	var worker resourceWorker
+	sinkNames := deliverySinks(logger, deliveryType)
+	if slices.Contains(sinkNames, "buffer") {
+		if len(sinkNames) > 1 {
+			logger.Errorf("buffer delivery can't be combined with other sinks: %s", deliveryType)
+			return 21
+		}
+		if queueType != "rabbitmq" && queueType != "disk" && queueType != "redis" && queueType != "nats" {
+			logger.Errorf("buffer delivery only works with queue type 'rabbitmq', 'disk', 'redis' or 'nats', selected: %s", queueType)
+			return 21
+		}
+		// Simply don't start any ResourceWorker
+	} else {
+		var router *queue.Router
+		sinks, router, err = setupSinks(sinkNames, config, logger, pluginManager, metrics)
+		if err != nil {
+			logger.Errorf("failed to setup delivery: %s", err)
+			return 20
+		}
+		for _, sink := range sinks {
+			setupBreakerMetrics(sink.Name, sink.Deliverer)
+		}
+		healthHandler.Breaker = sinks[0].Deliverer
+		worker = sinks[0].Deliverer
+		if len(sinks) > 1 || router != nil {
+			fanOut, err := queue.NewFanOut(sinks, metrics,
+				queue.WithSinkBuffer(viper.GetInt("sink_buffer")),
+				queue.WithRouter(router))
+			if err != nil {
+				logger.Errorf("failed to setup fan-out: %s", err)
+				return 20
+			}
+			healthHandler.Sinks = make(map[string]queue.BreakerReporter)
+			for _, sink := range sinks[1:] {
+				healthHandler.Sinks[sink.Name] = sink.Deliverer
+			}
+			logger.Infof("delivering to %d sinks, primary %s", len(sinks), sinks[0].Name)
+			worker = fanOut
+		}
+	}
+	e.GET("/health", healthHandler.Handler(tracer))
+
+	var workerStopped chan struct{}
+	if worker != nil {
+		workerStopped = make(chan struct{})
+		go func() {
+			worker.ResourceWorker(messageQueue, doneWorker, tracer)
+			close(workerStopped)
+		}()
+	}
+
+	// Admin
+	if adminToken := viper.GetString("admin_token"); adminToken != "" && len(sinks) > 0 && deadLetterStore != nil {
+		replayHandler, err := handlers.NewReplayHandler(adminToken, func(ctx context.Context, opts queue.ReplayOptions) (queue.ReplayStats, error) {
+			return queue.ReplaySinks(ctx, deadLetterStore, sinks, opts)
+		})
+		if err != nil {
+			logger.Errorf("failed to setup ReplayHandler: %s", err)
+			return 22
+		}
+		logger.Info("enabling /api/deadletters/replay")
+		e.POST("/api/deadletters/replay", replayHandler.Handler(tracer))
+	}
+
+	echoChan <- e
+	deadline := time.Now().Add(viper.GetDuration("shutdown_timeout"))
+	if err := e.Start(listenString()); errors.Is(err, http.ErrServerClosed) {
+		// Wait for the requests which were in flight
+		deadline = <-shutdown
+	} else {
+		logger.Errorf("Finished: %v", err)
+		exitCode = 6
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	drain(ctx, logger, done, doneWorker, workerStopped, pluginManager)
+	return exitCode
+}
+
+// drain delivers the messages left in the queue, then stops the queue and
+// the plugins. Messages which are not delivered when ctx expires are lost,
+// unless the queue keeps them
+func drain(ctx context.Context, logger *log.Logger, done, doneWorker chan bool, workerStopped <-chan struct{}, manager *shared.PluginManager) {
+	if workerStopped != nil {
+		select {
+		case doneWorker <- true:
+			select {
+			case <-workerStopped:
+				logger.Info("queue drained")
+			case <-ctx.Done():
+				logger.Warn("shutdown timeout while draining the queue")
+			}
+		case <-ctx.Done():
+		}
+	}
+	select {
+	case done <- true:
+	case <-ctx.Done():
+	}
+	manager.KillAll()
+}
+
+func setupPluginManager() *shared.PluginManager {
+	homeDir, _ := os.UserHomeDir()
+	pluginExePath, _ := os.Executable()
+	pluginManager := &shared.PluginManager{
+		PluginDirs: []string{
+			filepath.Join(homeDir, ".logproxy/plugins"),
+			filepath.Dir(pluginExePath),
+		},
+	}
+	if pluginDir := viper.GetString("plugindir"); pluginDir != "" {
+		pluginManager.PluginDirs = append(pluginManager.PluginDirs, pluginDir)
+	}
+	if err := pluginManager.Discover(); err == nil {
+		_ = pluginManager.LoadAll()
+	}
+	return pluginManager
+}
+
+// setupLoggingConfig returns the HSDP logging configuration. A non-zero
+// exit code is returned when IAM authentication fails
+func setupLoggingConfig(logger *log.Logger, enableDebug bool) (*logging.Config, int) {
 	sharedKey := os.Getenv("HSDP_LOGINGESTOR_KEY")
 	sharedSecret := os.Getenv("HSDP_LOGINGESTOR_SECRET")
 	baseURL := os.Getenv("HSDP_LOGINGESTOR_URL")
@@ -245,50 +643,166 @@ func realMain(echoChan chan<- *echo.Echo) int {
 		iamClient, err := iam.NewClient(nil, cfg)
 		if err != nil {
 			logger.Errorf("failed to create IAM client: %v", err)
-			return 6
+			return nil, 6
 		}
 		err = iamClient.ServiceLogin(iam.Service{
 			ServiceID:  serviceID,
 			PrivateKey: servicePrivateKey,
 		})
 		if err != nil {
-			fmt.Printf("invalid service credentials: %v\n", err)
-			return 7
+			fmt.Fprintf(os.Stderr, "invalid service credentials: %v\n", err)
+			return nil, 7
 		}
 		config.IAMClient = iamClient
 		config.SharedKey = ""
 		config.SharedSecret = ""
 	}
+	return config, 0
+}
 
-	doneWorker := make(chan bool)
-	switch deliveryType {
-	case "buffer":
-		if queueType != "rabbitmq" {
-			logger.Errorf("buffer delivery only works with queue type 'rabbitmq', selected: %s", queueType)
-			return 21
+// setupRabbitMQConfig returns the RabbitMQ connection and topology settings
+func setupRabbitMQConfig() queue.RabbitMQConfig {
+	return queue.RabbitMQConfig{
+		URL:   viper.GetString("rabbitmq_url"),
+		Vhost: viper.GetString("rabbitmq_vhost"),
+		TLS: queue.RabbitMQTLSConfig{
+			CACertFile:         viper.GetString("rabbitmq_tls_ca_file"),
+			CertFile:           viper.GetString("rabbitmq_tls_cert_file"),
+			KeyFile:            viper.GetString("rabbitmq_tls_key_file"),
+			ServerName:         viper.GetString("rabbitmq_tls_server_name"),
+			InsecureSkipVerify: viper.GetBool("rabbitmq_tls_insecure_skip_verify"),
+		},
+		Exchange:             viper.GetString("rabbitmq_exchange"),
+		RoutingKey:           viper.GetString("rabbitmq_routing_key"),
+		Queue:                viper.GetString("rabbitmq_queue"),
+		ConsumerTag:          viper.GetString("rabbitmq_consumer_tag"),
+		DeadLetterQueue:      viper.GetString("rabbitmq_deadletter_queue"),
+		DeadLetterRoutingKey: viper.GetString("rabbitmq_deadletter_routing_key"),
+		Prefetch:             viper.GetInt("rabbitmq_prefetch"),
+		Durable:              viper.GetBool("rabbitmq_durable"),
+		QueueType:            viper.GetString("rabbitmq_queue_type"),
+		MessageTTL:           viper.GetDuration("rabbitmq_message_ttl"),
+		MaxLength:            viper.GetInt64("rabbitmq_max_length"),
+		MaxLengthBytes:       viper.GetInt64("rabbitmq_max_length_bytes"),
+		ReconnectInitial:     viper.GetDuration("rabbitmq_reconnect_initial"),
+		ReconnectMax:         viper.GetDuration("rabbitmq_reconnect_max"),
+		SpillCapacity:        viper.GetInt("rabbitmq_spill_capacity"),
+		PriorityLanes:        viper.GetBool("priority_lanes"),
+	}
+}
+
+// setupDeadLetterStore returns the dead letter store for storeType, or nil
+// when dead letters should be discarded
+func setupDeadLetterStore(storeType string) (queue.DeadLetterStore, error) {
+	switch storeType {
+	case "file":
+		return queue.NewFileDeadLetterStore(viper.GetString("deadletter_file"))
+	case "rabbitmq":
+		config := setupRabbitMQConfig()
+		conn, err := config.Dial()
+		if err != nil {
+			return nil, err
 		}
-		// Simply don't start any ResourceWorker
-	case "none":
-		deliverer, _ := setupNoneDeliverer(logger, pluginManager, buildVersion, metrics)
-		go deliverer.ResourceWorker(messageQueue, doneWorker, tracer)
-	default:
-		deliverer, err := setupHSDPDeliverer(http.DefaultClient, config, logger, pluginManager, buildVersion, metrics)
+		channel, err := queue.SetupDeadLetterQueue(conn, config)
 		if err != nil {
-			logger.Errorf("failed to setup Deliverer: %s", err)
-			return 20
+			return nil, err
 		}
-		go deliverer.ResourceWorker(messageQueue, doneWorker, tracer)
+		return queue.NewRabbitMQDeadLetterStore(channel, config)
+	case "", "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown dead letter store: %s", storeType)
 	}
+}
 
-	echoChan <- e
-	exitCode := 0
-	if err := e.Start(listenString()); err != nil {
-		logger.Errorf("Finished: %v", err)
-		exitCode = 6
+// setupQueueMetrics exposes the queue statistics as Prometheus metrics
+func setupQueueMetrics(q queue.Queue) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_depth",
+		Help: "Number of messages waiting in the queue",
+	}, func() float64 { return float64(q.Stats().Depth) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_oldest_age_seconds",
+		Help: "Age of the oldest message waiting in the queue",
+	}, func() float64 { return q.Stats().OldestAge.Seconds() })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_capacity",
+		Help: "Maximum number of messages the queue can hold, zero when unbounded",
+	}, func() float64 { return float64(q.Stats().Capacity) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_bytes",
+		Help: "Storage used by messages waiting in the queue",
+	}, func() float64 { return float64(q.Stats().Bytes) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_max_bytes",
+		Help: "Maximum storage the queue can use, zero when unbounded",
+	}, func() float64 { return float64(q.Stats().MaxBytes) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "logproxy_queue_pushes_total",
+		Help: "Total number of messages pushed to the queue",
+	}, func() float64 { return float64(q.Stats().Pushes) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "logproxy_queue_pops_total",
+		Help: "Total number of messages taken from the queue",
+	}, func() float64 { return float64(q.Stats().Pops) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "logproxy_queue_dead_letters_total",
+		Help: "Total number of dead lettered messages",
+	}, func() float64 { return float64(q.Stats().DeadLetters) })
+
+	connector, ok := q.(queue.Connector)
+	if !ok {
+		return
 	}
-	done <- true
-	doneWorker <- true
-	return exitCode
+	connected := func(state queue.ConnectionState) float64 {
+		if state == queue.StateConnected {
+			return 1
+		}
+		return 0
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "logproxy_queue_connected",
+		Help:        "Whether the connection to the broker is up",
+		ConstLabels: prometheus.Labels{"role": "producer"},
+	}, func() float64 { return connected(connector.ConnectionStatus().Producer) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "logproxy_queue_connected",
+		Help:        "Whether the connection to the broker is up",
+		ConstLabels: prometheus.Labels{"role": "consumer"},
+	}, func() float64 { return connected(connector.ConnectionStatus().Consumer) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "logproxy_queue_reconnects_total",
+		Help: "Total number of reconnects to the broker",
+	}, func() float64 { return float64(connector.ConnectionStatus().Reconnects) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "logproxy_queue_spilled",
+		Help: "Number of messages buffered locally while the broker is unavailable",
+	}, func() float64 { return float64(connector.ConnectionStatus().Spilled) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "logproxy_queue_spill_dropped_total",
+		Help: "Total number of messages rejected because the spill buffer was full",
+	}, func() float64 { return float64(connector.ConnectionStatus().SpillDropped) })
+}
+
+// setupBreakerMetrics exposes the circuit breaker of the Deliverer of a sink
+func setupBreakerMetrics(sink string, breaker queue.BreakerReporter) {
+	for _, state := range []queue.BreakerState{queue.BreakerClosed, queue.BreakerOpen, queue.BreakerHalfOpen} {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "logproxy_circuit_breaker_state",
+			Help:        "Whether the circuit breaker around the Storer is in the state",
+			ConstLabels: prometheus.Labels{"sink": sink, "state": string(state)},
+		}, func() float64 {
+			if breaker.BreakerStatus().State == state {
+				return 1
+			}
+			return 0
+		})
+	}
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name:        "logproxy_circuit_breaker_opens_total",
+		Help:        "Total number of times the circuit breaker opened",
+		ConstLabels: prometheus.Labels{"sink": sink},
+	}, func() float64 { return float64(breaker.BreakerStatus().Opens) })
 }
 
 func setupPrometheus(logger *log.Logger) {
@@ -312,8 +826,394 @@ func (n *noneStorer) StoreResources(_ []logging.Resource, _ int) (*logging.Store
 	}, nil
 }
 
+// resourceWorker consumes a queue until done receives a value
+type resourceWorker interface {
+	ResourceWorker(queue queue.Queue, done <-chan bool, tracer *zipkin.Tracer)
+}
+
+// deliveryNames are the values of the delivery setting
+var deliveryNames = []string{"buffer", "none", "hsdp", "file", "webhook", "elasticsearch", "loki", "syslog", "s3", "otlp"}
+
+// deliverySinks splits the comma separated delivery setting into sink names.
+// A single unknown name falls back to hsdp
+func deliverySinks(logger *log.Logger, delivery string) []string {
+	var sinks []string
+	for _, name := range strings.Split(delivery, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sinks = append(sinks, name)
+		}
+	}
+	if len(sinks) == 1 && !slices.Contains(deliveryNames, sinks[0]) {
+		// Earlier versions delivered to HSDP for any unknown value
+		logger.Warnf("unknown delivery %q, delivering to hsdp", sinks[0])
+		sinks = nil
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, "hsdp")
+	}
+	return sinks
+}
+
+// setupSink returns the Deliverer of a delivery sink
+func setupSink(name string, config *logging.Config, logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	switch name {
+	case "none":
+		return setupNoneDeliverer(logger, manager, buildVersion, metrics)
+	case "hsdp":
+		return setupHSDPDeliverer(http.DefaultClient, config, logger, manager, buildVersion, metrics)
+	case "file":
+		return setupFileDeliverer(logger, manager, metrics)
+	case "webhook":
+		return setupWebhookDeliverer(logger, manager, metrics)
+	case "elasticsearch":
+		return setupElasticsearchDeliverer(logger, manager, metrics)
+	case "loki":
+		return setupLokiDeliverer(logger, manager, metrics)
+	case "syslog":
+		return setupSyslogDeliverer(logger, manager, metrics)
+	case "s3":
+		return setupS3Deliverer(logger, manager, metrics)
+	case "otlp":
+		return setupOTLPDeliverer(logger, manager, metrics)
+	}
+	return nil, fmt.Errorf("unknown delivery sink: %s", name)
+}
+
+// setupSinks returns the delivery sinks and, when a routes file is set, the
+// Router. The first sink is the primary one which runs the filters, the other
+// delivery sinks are best effort unless <sink>_reliable is set, which is the
+// default for the s3 archive. Tenants of the
+// routing config are reliable HSDP sinks with their own product key
+func setupSinks(names []string, config *logging.Config, logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) ([]queue.Sink, *queue.Router, error) {
+	var routing queue.RoutingConfig
+	var router *queue.Router
+	if path := viper.GetString("routes_file"); path != "" {
+		var err error
+		if routing, err = queue.LoadRoutingConfig(path); err != nil {
+			return nil, nil, err
+		}
+		if len(routing.Default) == 0 {
+			routing.Default = names
+		}
+		if router, err = queue.NewRouter(routing); err != nil {
+			return nil, nil, err
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return nil, nil, fmt.Errorf("duplicate delivery sink: %s", name)
+		}
+		seen[name] = true
+	}
+	for _, tenant := range routing.Tenants {
+		if seen[tenant.Name] {
+			return nil, nil, fmt.Errorf("duplicate delivery sink: %s", tenant.Name)
+		}
+		if tenant.ProductKey == "" {
+			return nil, nil, fmt.Errorf("tenant %s has no product key", tenant.Name)
+		}
+		seen[tenant.Name] = true
+	}
+
+	var sinks []queue.Sink
+	for i, name := range names {
+		// The filters run once, before the resources are fanned out
+		sinkManager := manager
+		if i > 0 {
+			sinkManager = nil
+		}
+		deliverer, err := setupSink(name, config, logger, sinkManager, metrics)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+		bestEffort := i > 0 && !viper.GetBool(name+"_reliable")
+		if bestEffort && name == "s3" {
+			logger.Warnf("sink s3 is best effort, messages it falls behind on or rejects are not archived")
+		}
+		sinks = append(sinks, queue.Sink{Name: name, Deliverer: deliverer, BestEffort: bestEffort})
+	}
+	for _, tenant := range routing.Tenants {
+		tenantConfig := *config
+		tenantConfig.ProductKey = tenant.ProductKey
+		storer, err := logging.NewClient(http.DefaultClient, &tenantConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %s: logging client: %w", tenant.Name, err)
+		}
+		deliverer, err := queue.NewDeliverer(storer, logger, nil, buildVersion, metrics, delivererOptions(tenant.Name)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+		sinks = append(sinks, queue.Sink{Name: tenant.Name, Deliverer: deliverer})
+	}
+	return sinks, router, nil
+}
+
+// sinkSetting returns the key of the sink specific variant of a setting,
+// e.g. hsdp_batch_max_count, when it is set and the global key otherwise
+func sinkSetting(sink, key string) string {
+	if specific := sink + "_" + key; viper.IsSet(specific) {
+		return specific
+	}
+	return key
+}
+
+// delivererOptions returns the batching, concurrency and retry settings of the
+// Deliverer of a sink
+func delivererOptions(sink string) []queue.DelivererOption {
+	setting := func(key string) string {
+		return sinkSetting(sink, key)
+	}
+	opts := []queue.DelivererOption{
+		queue.WithMaxBatchCount(viper.GetInt(setting("batch_max_count"))),
+		queue.WithMaxBatchBytes(viper.GetInt(setting("batch_max_bytes"))),
+		queue.WithMaxLinger(viper.GetDuration(setting("batch_max_linger"))),
+		queue.WithFlushWorkers(viper.GetInt(setting("delivery_workers"))),
+		queue.WithMaxRetries(viper.GetInt(setting("retry_max"))),
+		queue.WithRetryBackoff(viper.GetDuration(setting("retry_initial")), viper.GetDuration(setting("retry_max_delay"))),
+		queue.WithCircuitBreaker(viper.GetInt(setting("breaker_failures")), viper.GetDuration(setting("breaker_cooldown"))),
+	}
+	if inFlight := viper.GetInt(setting("delivery_max_in_flight")); inFlight > 0 {
+		opts = append(opts, queue.WithMaxInFlight(inFlight))
+	}
+	return opts
+}
+
+// setupFileDeliverer writes the resources as NDJSON to a file or stdout
+func setupFileDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	var opts []sinks.FileOption
+	if viper.GetBool("file_decode") {
+		opts = append(opts, sinks.WithDecodedMessages())
+	}
+	if viper.GetBool("file_compress") {
+		opts = append(opts, sinks.WithCompression())
+	}
+	opts = append(opts,
+		sinks.WithMaxSize(viper.GetInt64("file_max_size")),
+		sinks.WithMaxAge(viper.GetDuration("file_max_age")),
+		sinks.WithMaxBackups(viper.GetInt("file_max_backups")))
+	path := viper.GetString("file_path")
+	if sinks.WritesToStdout(path) {
+		opts = append(opts, sinks.WithFileWriter(os.Stdout))
+	}
+	storer, err := sinks.NewFile(path, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("file sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("file")...)
+}
+
+// setupWebhookDeliverer POSTs the resources to a webhook
+func setupWebhookDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	opts := []sinks.WebhookOption{
+		sinks.WithTimeout(viper.GetDuration("webhook_timeout")),
+	}
+	headers, err := parseHeaders(viper.GetString("webhook_headers"))
+	if err != nil {
+		return nil, fmt.Errorf("webhook headers: %w", err)
+	}
+	for key, value := range headers {
+		opts = append(opts, sinks.WithHeader(key, value))
+	}
+	if username := viper.GetString("webhook_username"); username != "" {
+		opts = append(opts, sinks.WithBasicAuth(username, viper.GetString("webhook_password")))
+	}
+	if token := viper.GetString("webhook_token"); token != "" {
+		opts = append(opts, sinks.WithBearerToken(token))
+	}
+	if viper.GetBool("webhook_decode") {
+		opts = append(opts, sinks.WithWebhookDecodedMessages())
+	}
+	storer, err := sinks.NewWebhook(viper.GetString("webhook_url"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("webhook sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("webhook")...)
+}
+
+// setupElasticsearchDeliverer indexes the resources with the _bulk API of
+// Elasticsearch or OpenSearch
+func setupElasticsearchDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	opts := []sinks.ElasticsearchOption{
+		sinks.WithElasticsearchTimeout(viper.GetDuration("elasticsearch_timeout")),
+	}
+	if username := viper.GetString("elasticsearch_username"); username != "" {
+		opts = append(opts, sinks.WithElasticsearchBasicAuth(username, viper.GetString("elasticsearch_password")))
+	}
+	if apiKey := viper.GetString("elasticsearch_api_key"); apiKey != "" {
+		opts = append(opts, sinks.WithElasticsearchAPIKey(apiKey))
+	}
+	if viper.GetBool("elasticsearch_data_stream") {
+		opts = append(opts, sinks.WithDataStreams())
+	}
+	if viper.GetBool("elasticsearch_decode") {
+		opts = append(opts, sinks.WithElasticsearchDecodedMessages())
+	}
+	storer, err := sinks.NewElasticsearch(viper.GetString("elasticsearch_url"), viper.GetString("elasticsearch_index"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("elasticsearch")...)
+}
+
+// setupLokiDeliverer pushes the resources to Grafana Loki
+func setupLokiDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	var fields []string
+	for _, field := range strings.Split(viper.GetString("loki_labels"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	opts := []sinks.LokiOption{
+		sinks.WithLokiLabels(fields...),
+		sinks.WithLokiTimeout(viper.GetDuration("loki_timeout")),
+	}
+	labels, err := parseHeaders(viper.GetString("loki_static_labels"))
+	if err != nil {
+		return nil, fmt.Errorf("loki static labels: %w", err)
+	}
+	for name, value := range labels {
+		opts = append(opts, sinks.WithLokiStaticLabel(name, value))
+	}
+	if tenant := viper.GetString("loki_tenant"); tenant != "" {
+		opts = append(opts, sinks.WithLokiTenant(tenant))
+	}
+	if username := viper.GetString("loki_username"); username != "" {
+		opts = append(opts, sinks.WithLokiBasicAuth(username, viper.GetString("loki_password")))
+	}
+	storer, err := sinks.NewLoki(viper.GetString("loki_url"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loki sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("loki")...)
+}
+
+// setupSyslogDeliverer forwards the resources as RFC 5424 syslog
+func setupSyslogDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	opts := []sinks.SyslogOption{
+		sinks.WithSyslogFacility(viper.GetInt("syslog_facility")),
+		sinks.WithSyslogEnterpriseID(viper.GetInt("syslog_enterprise_id")),
+		sinks.WithSyslogTimeout(viper.GetDuration("syslog_timeout")),
+	}
+	switch framing := viper.GetString("syslog_framing"); framing {
+	case "octet-counting":
+	case "newline":
+		opts = append(opts, sinks.WithNewlineFraming())
+	default:
+		return nil, fmt.Errorf("unknown syslog framing: %s", framing)
+	}
+	if viper.GetString("syslog_network") == "tls" {
+		tlsConfig, err := sinkTLSConfig("syslog")
+		if err != nil {
+			return nil, fmt.Errorf("syslog tls: %w", err)
+		}
+		opts = append(opts, sinks.WithSyslogTLS(tlsConfig))
+	}
+	storer, err := sinks.NewSyslog(viper.GetString("syslog_network"), viper.GetString("syslog_address"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("syslog sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("syslog")...)
+}
+
+// sinkTLSConfig returns the <sink>_tls_* settings of a sink
+func sinkTLSConfig(name string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         viper.GetString(name + "_tls_server_name"),
+		InsecureSkipVerify: viper.GetBool(name + "_tls_insecure_skip_verify"), // #nosec G402 -- explicitly configured
+	}
+	if caFile := viper.GetString(name + "_tls_ca_file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	certFile, keyFile := viper.GetString(name+"_tls_cert_file"), viper.GetString(name+"_tls_key_file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// setupS3Deliverer archives the resources in S3 compatible object storage.
+// Every batch is written as objects, so the batch settings of the sink are
+// the object thresholds
+func setupS3Deliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	opts := []sinks.S3Option{
+		sinks.WithS3Region(viper.GetString("s3_region")),
+		sinks.WithS3Prefix(viper.GetString("s3_prefix")),
+		sinks.WithS3Timeout(viper.GetDuration("s3_timeout")),
+	}
+	if accessKeyID := viper.GetString("s3_access_key_id"); accessKeyID != "" {
+		opts = append(opts, sinks.WithS3Credentials(sinks.S3Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: viper.GetString("s3_secret_access_key"),
+			SessionToken:    viper.GetString("s3_session_token"),
+		}))
+	}
+	if viper.GetBool("s3_virtual_hosted") {
+		opts = append(opts, sinks.WithVirtualHostedStyle())
+	}
+	storer, err := sinks.NewS3(viper.GetString("s3_endpoint"), viper.GetString("s3_bucket"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("s3 sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("s3")...)
+}
+
+// setupOTLPDeliverer exports the resources as OpenTelemetry logs
+func setupOTLPDeliverer(logger *log.Logger, manager *shared.PluginManager, metrics queue.Metrics) (*queue.Deliverer, error) {
+	opts := []sinks.OTLPOption{
+		sinks.WithOTLPTimeout(viper.GetDuration("otlp_timeout")),
+		sinks.WithOTLPMetrics(metrics),
+	}
+	headers, err := parseHeaders(viper.GetString("otlp_headers"))
+	if err != nil {
+		return nil, fmt.Errorf("otlp headers: %w", err)
+	}
+	for key, value := range headers {
+		opts = append(opts, sinks.WithOTLPHeader(key, value))
+	}
+	if viper.GetBool("otlp_tls") {
+		tlsConfig, err := sinkTLSConfig("otlp")
+		if err != nil {
+			return nil, fmt.Errorf("otlp tls: %w", err)
+		}
+		opts = append(opts, sinks.WithOTLPTLS(tlsConfig))
+	}
+	storer, err := sinks.NewOTLP(viper.GetString("otlp_protocol"), viper.GetString("otlp_endpoint"), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("otlp sink: %w", err)
+	}
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("otlp")...)
+}
+
+// parseHeaders parses comma separated Key=Value pairs
+func parseHeaders(headers string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, pair := range strings.Split(headers, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Key=Value", pair)
+		}
+		parsed[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
 func setupNoneDeliverer(logger *log.Logger, manager *shared.PluginManager, buildVersion string, metrics queue.Metrics) (*queue.Deliverer, error) {
-	return queue.NewDeliverer(&noneStorer{}, logger, manager, buildVersion, metrics)
+	return queue.NewDeliverer(&noneStorer{}, logger, manager, buildVersion, metrics, delivererOptions("none")...)
 }
 
 func setupHSDPDeliverer(httpClient *http.Client, config *logging.Config, logger *log.Logger, manager *shared.PluginManager, buildVersion string, metrics queue.Metrics) (*queue.Deliverer, error) {
@@ -321,23 +1221,34 @@ func setupHSDPDeliverer(httpClient *http.Client, config *logging.Config, logger
 	if err != nil {
 		return nil, fmt.Errorf("logging client: %w", err)
 	}
-	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics)
+	return queue.NewDeliverer(storer, logger, manager, buildVersion, metrics, delivererOptions("hsdp")...)
 }
 
-func setupInterrupts(_ *log.Logger) {
-	// Setup a channel to receive a signal
-	done := make(chan os.Signal, 1)
-
-	// Notify this channel when a SIGINT is received
-	signal.Notify(done, os.Interrupt)
+// setupInterrupts shuts the HTTP server down on SIGINT or SIGTERM. The
+// returned channel receives the deadline for the rest of the shutdown once
+// the requests in flight completed. A second signal exits immediately
+func setupInterrupts(logger *log.Logger, e *echo.Echo, timeout time.Duration) <-chan time.Time {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	// Fire off a goroutine to loop until that channel receives a signal.
-	// When a signal is received simply exit the program
+	stopped := make(chan time.Time, 1)
 	go func() {
-		for range done {
-			os.Exit(0)
+		sig := <-signals
+		logger.Infof("received %v, shutting down", sig)
+		deadline := time.Now().Add(timeout)
+		go func() {
+			<-signals
+			logger.Warn("received second signal, exiting")
+			os.Exit(1)
+		}()
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			logger.Errorf("HTTP server shutdown error: %v", err)
 		}
+		stopped <- deadline
 	}()
+	return stopped
 }
 
 func setupPprof(logger *log.Logger) {
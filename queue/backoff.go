@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes jittered exponential delays between attempts
+type Backoff struct {
+	// Initial is the delay before the first retry
+	Initial time.Duration
+	// Max caps the delay, it must not be smaller than Initial
+	Max time.Duration
+
+	attempt int
+}
+
+// Next returns the delay before the next attempt. The delay doubles with every
+// attempt up to Max and is spread randomly over its upper half, so instances
+// which failed at the same time don't retry in lockstep
+func (b *Backoff) Next() time.Duration {
+	delay := b.Initial
+	for i := 0; i < b.attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.attempt++
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + rand.N(half) // #nosec G404 -- jitter does not need a secure source
+}
+
+// Reset starts over at Initial after a successful attempt
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
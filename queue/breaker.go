@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// BreakerState is the state of the circuit breaker around the Storer
+type BreakerState string
+
+const (
+	// BreakerClosed lets every batch through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen holds batches back until the cooldown passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe through to test the Storer
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerStatus reports the circuit breaker of a Deliverer
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	// Failures is the number of consecutive failed deliveries
+	Failures int `json:"failures"`
+	// Opens is the number of times the breaker opened
+	Opens int64 `json:"opens"`
+}
+
+// BreakerReporter is implemented by deliverers which guard their Storer with
+// a circuit breaker
+type BreakerReporter interface {
+	BreakerStatus() BreakerStatus
+}
+
+var _ BreakerReporter = &Deliverer{}
+
+// breaker stops calls to a failing Storer. It opens after threshold
+// consecutive failures and lets a single probe through once the cooldown
+// passed. A successful probe closes it again, a failed one reopens it
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	opens    int64
+	openedAt time.Time
+	probing  bool
+	// changed is closed and replaced on every state change
+	changed chan struct{}
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		changed:   make(chan struct{}),
+	}
+}
+
+// wait blocks while the breaker is open or another probe is in flight
+func (b *breaker) wait(ctx context.Context) error {
+	if b.threshold == 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		var timeout <-chan time.Time
+		switch b.state {
+		case BreakerClosed:
+			b.mu.Unlock()
+			return nil
+		case BreakerOpen:
+			remaining := b.cooldown - time.Since(b.openedAt)
+			if remaining <= 0 {
+				b.setState(BreakerHalfOpen)
+				b.probing = true
+				b.mu.Unlock()
+				fmt.Fprintf(os.Stderr, "circuit breaker half-open, probing\n")
+				return nil
+			}
+			timeout = time.After(remaining)
+		case BreakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// success records a call which reached the Storer
+func (b *breaker) success() {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+		fmt.Fprintf(os.Stderr, "circuit breaker closed\n")
+	}
+}
+
+// failure records a call which failed transiently and reports whether the
+// breaker holds calls back
+func (b *breaker) failure() bool {
+	if b.threshold == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.probing = false
+		b.openedAt = time.Now()
+		b.opens++
+		b.setState(BreakerOpen)
+		fmt.Fprintf(os.Stderr, "circuit breaker open after %d failures, pausing delivery for %v\n", b.failures, b.cooldown)
+	}
+	return b.state != BreakerClosed
+}
+
+func (b *breaker) setState(state BreakerState) {
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+		Opens:    b.opens,
+	}
+}
@@ -0,0 +1,101 @@
+package queue_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOptions(t *testing.T) {
+	for _, opt := range []queue.DelivererOption{
+		queue.WithCircuitBreaker(-1, time.Second),
+		queue.WithCircuitBreaker(5, 0),
+	} {
+		_, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{}, opt)
+		assert.NotNil(t, err)
+	}
+	deliverer, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
+	assert.Nil(t, err)
+	assert.Equal(t, queue.BreakerStatus{State: queue.BreakerClosed}, deliverer.BreakerStatus())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(http.StatusServiceUnavailable, nil),
+		statusFailure(http.StatusServiceUnavailable, nil),
+		statusFailure(http.StatusServiceUnavailable, nil),
+	}}
+	var deliverer *queue.Deliverer
+	start := time.Now()
+	stats, letters := replayLetters(t, storer, []string{"1", "2"},
+		queue.WithMaxRetries(1),
+		queue.WithRetryBackoff(time.Millisecond, time.Millisecond),
+		queue.WithCircuitBreaker(2, 50*time.Millisecond),
+		func(pl *queue.Deliverer) error {
+			deliverer = pl
+			return nil
+		})
+	// Opened after two failures, the first probe failed and the second succeeded.
+	// While the breaker was open the batch kept its retries
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, 4, storer.calls)
+	assert.Equal(t, 2, stats.Replayed)
+	assert.Len(t, letters, 0)
+	assert.Equal(t, queue.BreakerStatus{State: queue.BreakerClosed, Opens: 2}, deliverer.BreakerStatus())
+}
+
+// blockingStorer fails until it is released
+type blockingStorer struct {
+	release chan struct{}
+	countingStorer
+}
+
+func (b *blockingStorer) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	select {
+	case <-b.release:
+		return b.countingStorer.StoreResources(msgs, count)
+	default:
+		return nil, http.ErrHandlerTimeout
+	}
+}
+
+func TestCircuitBreakerPausesConsumption(t *testing.T) {
+	storer := &blockingStorer{release: make(chan struct{})}
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{},
+		queue.WithMaxBatchCount(1),
+		queue.WithMaxRetries(0),
+		queue.WithCircuitBreaker(1, 20*time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	go deliverer.ResourceWorker(q, doneWorker, nil)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+
+	assert.Eventually(t, func() bool {
+		return deliverer.BreakerStatus().State != queue.BreakerClosed
+	}, time.Second, time.Millisecond)
+	// The messages wait in the queue while the breaker is open
+	time.Sleep(50 * time.Millisecond)
+	assert.Greater(t, q.Stats().Depth, int64(0))
+	assert.Empty(t, storer.Batches())
+
+	close(storer.release)
+	assert.Eventually(t, func() bool {
+		storer.mu.Lock()
+		defer storer.mu.Unlock()
+		return storer.stored == 10
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, queue.BreakerClosed, deliverer.BreakerStatus().State)
+	doneWorker <- true
+	done <- true
+}
@@ -1,31 +1,156 @@
 package queue
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/dip-software/go-dip-api/logging"
 )
 
-// Channel implements a Queue based on a go channel
+// OverflowPolicy decides what Channel.Push does when the queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits for room, optionally bounded by a timeout
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest rejects the message being pushed
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDropOldest discards the oldest queued message
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropLowestSeverity discards the oldest message with the lowest severity
+	OverflowDropLowestSeverity OverflowPolicy = "drop_lowest_severity"
+
+	// Overflow outcomes reported through Metrics.IncQueueOverflow
+	OverflowOutcomeBlocked       = "blocked"
+	OverflowOutcomeTimeout       = "timeout"
+	OverflowOutcomeDroppedNewest = "dropped_newest"
+	OverflowOutcomeDroppedOldest = "dropped_oldest"
+	OverflowOutcomeDroppedLowest = "dropped_lowest_severity"
+
+	defaultChannelCapacity = 50
+)
+
+var ErrQueueFull = errors.New("queue is full")
+
+// Channel implements a Queue based on go channels. Raw payloads are buffered
+// and parsed by ParseStage when Start is running. With priority lanes every
+// Priority has its own buffer and higher lanes are always parsed first
 type Channel struct {
+	lanes           []*lane
+	ready           chan struct{}
+	draining        chan struct{}
+	drainOnce       sync.Once
+	closeOnce       sync.Once
 	resourceChannel chan logging.Resource
 	metrics         Metrics
+	deadLetters     DeadLetterStore
+	capacity        int
+	prioritized     bool
+	policy          OverflowPolicy
+	timeout         time.Duration
+	mu              sync.Mutex
+
+	// statsMu guards the fields below and the lane statistics
+	statsMu      sync.Mutex
+	pushes       int64
+	dropped      int64
+	deadLettered int64
+}
+
+// lane buffers the payloads of one priority
+type lane struct {
+	buffer chan []byte
+	// queued holds the push times of the payloads in buffer plus the one
+	// held by the parser, oldest first. Payloads taken by the parser are
+	// trimmed from the front lazily
+	queued []time.Time
+	held   int
 }
 
 func (c *Channel) SetMetrics(m Metrics) {
 	c.metrics = m
 }
 
-var _ Queue = &Channel{}
+func (c *Channel) SetDeadLetterStore(s DeadLetterStore) {
+	c.deadLetters = s
+}
+
+var (
+	_ Queue   = &Channel{}
+	_ Drainer = &Channel{}
+)
+
+// WithCapacity sets the number of payloads a Channel queue can hold
+func WithCapacity(capacity int) OptionFunc {
+	return func(q Queue) error {
+		c, ok := q.(*Channel)
+		if !ok {
+			return fmt.Errorf("capacity is not supported by %T", q)
+		}
+		if capacity < 1 {
+			return fmt.Errorf("invalid capacity: %d", capacity)
+		}
+		c.capacity = capacity
+		return nil
+	}
+}
+
+// WithOverflowPolicy sets the behaviour of a full Channel queue. The timeout
+// only applies to OverflowBlock, where zero means waiting indefinitely
+func WithOverflowPolicy(policy OverflowPolicy, timeout time.Duration) OptionFunc {
+	return func(q Queue) error {
+		c, ok := q.(*Channel)
+		if !ok {
+			return fmt.Errorf("overflow policy is not supported by %T", q)
+		}
+		switch policy {
+		case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowDropLowestSeverity:
+		default:
+			return fmt.Errorf("unknown overflow policy: %s", policy)
+		}
+		c.policy = policy
+		c.timeout = timeout
+		return nil
+	}
+}
+
+// WithPriorityLanes gives every Priority its own buffer of the configured
+// capacity. Higher lanes are parsed first, so lower lanes fill up and
+// overflow first when the Deliverer can't keep up
+func WithPriorityLanes() OptionFunc {
+	return func(q Queue) error {
+		c, ok := q.(*Channel)
+		if !ok {
+			return fmt.Errorf("priority lanes are not supported by %T", q)
+		}
+		c.prioritized = true
+		return nil
+	}
+}
 
 func NewChannelQueue(opts ...OptionFunc) (*Channel, error) {
-	resourceChannel := make(chan logging.Resource, 50)
 	ch := &Channel{
-		resourceChannel: resourceChannel,
+		capacity: defaultChannelCapacity,
+		policy:   OverflowBlock,
 	}
 	for _, o := range opts {
 		if err := o(ch); err != nil {
 			return nil, err
 		}
 	}
+	lanes := 1
+	if ch.prioritized {
+		lanes = Priorities
+	}
+	for i := 0; i < lanes; i++ {
+		ch.lanes = append(ch.lanes, &lane{buffer: make(chan []byte, ch.capacity)})
+	}
+	ch.ready = make(chan struct{}, 1)
+	ch.draining = make(chan struct{})
+	ch.resourceChannel = make(chan logging.Resource)
 	return ch, nil
 }
 
@@ -33,27 +158,307 @@ func (c *Channel) Output() <-chan logging.Resource {
 	return c.resourceChannel
 }
 
+// lane returns the lane a payload is queued in
+func (c *Channel) lane(raw []byte) *lane {
+	if !c.prioritized {
+		return c.lanes[0]
+	}
+	return c.lanes[SeverityPriority(RawSeverity(raw))]
+}
+
 func (c *Channel) Push(raw []byte) error {
-	resource, err := BodyToResource(raw, c.metrics)
-	if err != nil {
-		return err
+	if c.policy != OverflowBlock {
+		// Dropping policies rearrange the queue so pushes are serialized
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	l := c.lane(raw)
+	select {
+	case l.buffer <- raw:
+	default:
+		if err := c.overflow(l, raw); err != nil {
+			return err
+		}
+	}
+	c.queuedAt(l, time.Now())
+	select {
+	case c.ready <- struct{}{}:
+	default:
 	}
 	if c.metrics != nil {
 		c.metrics.IncProcessed()
 	}
-	c.resourceChannel <- *resource
 	return nil
 }
 
+// queuedAt records the push time of a payload which was just queued
+func (c *Channel) queuedAt(l *lane, t time.Time) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.pushes++
+	l.queued = append(l.queued, t)
+	l.trim()
+}
+
+// unqueue forgets the push time of the oldest payload of a lane after it was dropped
+func (c *Channel) unqueue(l *lane) time.Time {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.dropped++
+	// The payload was already received, skip times of payloads the parser took before it
+	if excess := len(l.queued) - l.held - len(l.buffer) - 1; excess > 0 {
+		l.queued = l.queued[excess:]
+	}
+	if len(l.queued) == 0 {
+		return time.Now()
+	}
+	t := l.queued[0]
+	l.queued = l.queued[1:]
+	return t
+}
+
+// trim removes the push times of payloads taken by the consumer.
+// Must be called with Channel.statsMu held
+func (l *lane) trim() {
+	if excess := len(l.queued) - l.held - len(l.buffer); excess > 0 {
+		l.queued = l.queued[excess:]
+	}
+}
+
+// hold marks whether the parser holds a payload which was taken from the lane
+func (c *Channel) hold(l *lane, held bool) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if held {
+		l.held = 1
+		return
+	}
+	l.held = 0
+	l.trim()
+}
+
+func (c *Channel) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	var depth int64
+	var oldest time.Time
+	for _, l := range c.lanes {
+		l.trim()
+		depth += int64(l.held + len(l.buffer))
+		if len(l.queued) > 0 && (oldest.IsZero() || l.queued[0].Before(oldest)) {
+			oldest = l.queued[0]
+		}
+	}
+	stats := Stats{
+		Depth:       depth,
+		Capacity:    int64(c.capacity * len(c.lanes)),
+		Pushes:      c.pushes,
+		Pops:        c.pushes - c.dropped - depth,
+		DeadLetters: c.deadLettered,
+	}
+	if !oldest.IsZero() {
+		stats.OldestAge = time.Since(oldest)
+	}
+	if stats.Pops < 0 {
+		stats.Pops = 0
+	}
+	return stats
+}
+
+func (c *Channel) incOverflow(outcome string) {
+	if c.metrics != nil {
+		c.metrics.IncQueueOverflow(outcome)
+	}
+}
+
+// overflow handles a push to a full lane according to the overflow policy
+func (c *Channel) overflow(l *lane, raw []byte) error {
+	switch c.policy {
+	case OverflowDropNewest:
+		c.incOverflow(OverflowOutcomeDroppedNewest)
+		return ErrQueueFull
+	case OverflowDropOldest:
+		for {
+			select {
+			case l.buffer <- raw:
+				return nil
+			default:
+			}
+			select {
+			case <-l.buffer:
+				c.unqueue(l)
+				c.incOverflow(OverflowOutcomeDroppedOldest)
+			default:
+			}
+		}
+	case OverflowDropLowestSeverity:
+		return c.dropLowestSeverity(l, raw)
+	default:
+		c.incOverflow(OverflowOutcomeBlocked)
+		if c.timeout <= 0 {
+			l.buffer <- raw
+			return nil
+		}
+		select {
+		case l.buffer <- raw:
+			return nil
+		case <-time.After(c.timeout):
+			c.incOverflow(OverflowOutcomeTimeout)
+			return ErrQueueFull
+		}
+	}
+}
+
+// dropLowestSeverity drains the lane, discards the oldest payload with the
+// lowest severity and puts the rest back in order. Must be called with c.mu held
+func (c *Channel) dropLowestSeverity(l *lane, raw []byte) error {
+	pending := make([][]byte, 0, c.capacity+1)
+	ranks := make([]int, 0, c.capacity+1)
+	queued := make([]time.Time, 0, c.capacity+1)
+drain:
+	for len(pending) < c.capacity {
+		select {
+		case r := <-l.buffer:
+			pending = append(pending, r)
+			ranks = append(ranks, SeverityRank(RawSeverity(r)))
+			queued = append(queued, c.unqueue(l))
+		default:
+			break drain
+		}
+	}
+	pending = append(pending, raw)
+	ranks = append(ranks, SeverityRank(RawSeverity(raw)))
+	queued = append(queued, time.Time{})
+	lowest := 0
+	for i, rank := range ranks {
+		if rank < ranks[lowest] {
+			lowest = i
+		}
+	}
+	dropped := lowest == len(pending)-1
+	if len(pending) <= c.capacity {
+		// The consumer made room while we were draining
+		dropped = false
+	} else {
+		pending = append(pending[:lowest], pending[lowest+1:]...)
+		queued = append(queued[:lowest], queued[lowest+1:]...)
+		c.incOverflow(OverflowOutcomeDroppedLowest)
+	}
+	// Put everything back except the incoming payload, which Push accounts for
+	for i, r := range pending {
+		l.buffer <- r
+		if !queued[i].IsZero() {
+			c.requeue(l, queued[i])
+		}
+	}
+	if dropped {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// requeue records a payload put back by dropLowestSeverity
+func (c *Channel) requeue(l *lane, t time.Time) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.dropped--
+	l.queued = append(l.queued, t)
+}
+
+// Start starts parsing buffered payloads into the Output channel. Parsing
+// stops when the returned channel receives a value
 func (c *Channel) Start() (chan bool, error) {
 	d := make(chan bool)
+	stop := make(chan struct{})
 	go func(done chan bool) {
 		<-done
+		close(stop)
 	}(d)
+	go c.parse(stop)
 	return d, nil
 }
 
-func (c *Channel) DeadLetter(_ logging.Resource) error {
-	// TODO: implement
-	return nil
+// Drain makes the parser close the Output channel once all lanes are empty.
+// Payloads pushed after that are not delivered
+func (c *Channel) Drain() {
+	c.drainOnce.Do(func() {
+		close(c.draining)
+	})
+}
+
+func (c *Channel) parse(stop <-chan struct{}) {
+	for {
+		l, raw, ok := c.next(stop)
+		if !ok {
+			select {
+			case <-c.draining:
+				c.closeOnce.Do(func() {
+					close(c.resourceChannel)
+				})
+			default:
+			}
+			return
+		}
+		c.hold(l, true)
+		resource, stored, err := ParseStage(raw, c.metrics, c.deadLetters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing syslog message: %v\n", err)
+			c.parseFailed(l, stored)
+			continue
+		}
+		select {
+		case c.resourceChannel <- *resource:
+			c.hold(l, false)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// next takes a payload from the highest non-empty lane, waiting for a push
+// when all lanes are empty. It returns false when stopped or when draining
+// and all lanes are empty
+func (c *Channel) next(stop <-chan struct{}) (*lane, []byte, bool) {
+	draining := c.draining
+	for {
+		for _, l := range c.lanes {
+			select {
+			case raw := <-l.buffer:
+				return l, raw, true
+			default:
+			}
+		}
+		if draining == nil {
+			return nil, nil, false
+		}
+		select {
+		case <-c.ready:
+		case <-draining:
+			// Look at the lanes once more before giving up
+			draining = nil
+		case <-stop:
+			return nil, nil, false
+		}
+	}
+}
+
+// parseFailed accounts for a payload which ParseStage rejected
+func (c *Channel) parseFailed(l *lane, stored bool) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if stored {
+		c.deadLettered++
+	}
+	l.held = 0
+	l.trim()
+}
+
+func (c *Channel) DeadLetter(msg logging.Resource) error {
+	c.statsMu.Lock()
+	c.deadLettered++
+	c.statsMu.Unlock()
+	if c.deadLetters == nil {
+		return nil
+	}
+	return c.deadLetters.Store(NewDeadLetter(msg))
 }
@@ -2,7 +2,9 @@ package queue_test
 
 import (
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/philips-software/logproxy/queue"
 
@@ -32,6 +34,27 @@ func (n *nilMetrics) IncProcessed() {
 func (n *nilMetrics) IncEnhancedTransactionID() {
 }
 
+func (n *nilMetrics) IncQueueOverflow(_ string) {
+}
+
+func (n *nilMetrics) IncParseFailed() {
+}
+
+func (n *nilMetrics) ObserveBatch(_ int, _ time.Duration) {
+}
+
+func (n *nilMetrics) SetBatchesInFlight(_ int) {
+}
+
+func (n *nilMetrics) IncPartialFailure(_ string, _ int) {
+}
+
+func (n *nilMetrics) IncSinkDropped(_, _ string) {
+}
+
+func (n *nilMetrics) IncRouted(_ string) {
+}
+
 type nilLogger struct {
 }
 
@@ -86,3 +109,158 @@ func TestChannelQueue(t *testing.T) {
 	assert.NotNil(t, r)
 	assert.Equal(t, "2018-09-07T15:39:21.132Z", r.LogTime)
 }
+
+type overflowMetrics struct {
+	nilMetrics
+	outcomes map[string]int
+}
+
+func (o *overflowMetrics) IncQueueOverflow(outcome string) {
+	if o.outcomes == nil {
+		o.outcomes = make(map[string]int)
+	}
+	o.outcomes[outcome]++
+}
+
+func messageWithSeverity(severity string) []byte {
+	return []byte(strings.Replace(rawMessage, `"sev":"info"`, `"sev":"`+severity+`"`, 1))
+}
+
+func TestChannelQueueOptions(t *testing.T) {
+	_, err := queue.NewChannelQueue(queue.WithCapacity(0))
+	assert.NotNil(t, err)
+	_, err = queue.NewChannelQueue(queue.WithOverflowPolicy("bogus", 0))
+	assert.NotNil(t, err)
+	_, err = queue.NewRabbitMQQueue(&mockProducer{}, queue.WithCapacity(10))
+	assert.NotNil(t, err)
+}
+
+func TestChannelQueueOverflow(t *testing.T) {
+	m := &overflowMetrics{}
+	q, err := queue.NewChannelQueue(queue.WithMetrics(m), queue.WithCapacity(2), queue.WithOverflowPolicy(queue.OverflowBlock, 10*time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Equal(t, queue.ErrQueueFull, q.Push([]byte(rawMessage)))
+	assert.Equal(t, 1, m.outcomes[queue.OverflowOutcomeBlocked])
+	assert.Equal(t, 1, m.outcomes[queue.OverflowOutcomeTimeout])
+
+	q, _ = queue.NewChannelQueue(queue.WithMetrics(m), queue.WithCapacity(1), queue.WithOverflowPolicy(queue.OverflowDropNewest, 0))
+	assert.Nil(t, q.Push(messageWithSeverity("first")))
+	assert.Equal(t, queue.ErrQueueFull, q.Push(messageWithSeverity("second")))
+	assert.Equal(t, 1, m.outcomes[queue.OverflowOutcomeDroppedNewest])
+	_, _ = q.Start()
+	assert.Equal(t, "first", (<-q.Output()).Severity)
+
+	q, _ = queue.NewChannelQueue(queue.WithMetrics(m), queue.WithCapacity(1), queue.WithOverflowPolicy(queue.OverflowDropOldest, 0))
+	assert.Nil(t, q.Push(messageWithSeverity("first")))
+	assert.Nil(t, q.Push(messageWithSeverity("second")))
+	assert.Equal(t, 1, m.outcomes[queue.OverflowOutcomeDroppedOldest])
+	_, _ = q.Start()
+	assert.Equal(t, "second", (<-q.Output()).Severity)
+}
+
+func TestChannelQueueDropLowestSeverity(t *testing.T) {
+	m := &overflowMetrics{}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(m), queue.WithCapacity(3), queue.WithOverflowPolicy(queue.OverflowDropLowestSeverity, 0))
+	assert.Nil(t, q.Push(messageWithSeverity("ERROR")))
+	assert.Nil(t, q.Push(messageWithSeverity("DEBUG")))
+	assert.Nil(t, q.Push(messageWithSeverity("WARN")))
+	assert.Nil(t, q.Push(messageWithSeverity("INFO")))
+	assert.Equal(t, queue.ErrQueueFull, q.Push(messageWithSeverity("TRACE")))
+	assert.Equal(t, 2, m.outcomes[queue.OverflowOutcomeDroppedLowest])
+
+	_, _ = q.Start()
+	var severities []string
+	for i := 0; i < 3; i++ {
+		severities = append(severities, (<-q.Output()).Severity)
+	}
+	assert.Equal(t, []string{"ERROR", "WARN", "INFO"}, severities)
+}
+
+func TestSeverityRank(t *testing.T) {
+	assert.Less(t, queue.SeverityRank("DEBUG"), queue.SeverityRank("info"))
+	assert.Less(t, queue.SeverityRank("Warning"), queue.SeverityRank("ERROR"))
+	assert.Equal(t, queue.SeverityRank("fatal"), queue.SeverityRank("CRITICAL"))
+	assert.Equal(t, queue.SeverityRank("INFO"), queue.SeverityRank("unknown"))
+}
+
+func TestChannelQueueDrain(t *testing.T) {
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}), queue.WithPriorityLanes())
+	assert.Nil(t, q.Push(messageWithSeverity("INFO")))
+	assert.Nil(t, q.Push(messageWithSeverity("ERROR")))
+	done, _ := q.Start()
+	q.Drain()
+
+	var severities []string
+	for resource := range q.Output() {
+		severities = append(severities, resource.Severity)
+	}
+	assert.Equal(t, []string{"ERROR", "INFO"}, severities)
+	done <- true
+}
+
+func TestSeverityPriority(t *testing.T) {
+	assert.Equal(t, queue.PriorityHigh, queue.SeverityPriority("FATAL"))
+	assert.Equal(t, queue.PriorityHigh, queue.SeverityPriority("error"))
+	assert.Equal(t, queue.PriorityWarn, queue.SeverityPriority("Warning"))
+	assert.Equal(t, queue.PriorityLow, queue.SeverityPriority("notice"))
+	assert.Equal(t, queue.PriorityLow, queue.SeverityPriority(""))
+}
+
+func TestChannelQueuePriorityLanes(t *testing.T) {
+	m := &overflowMetrics{}
+	q, err := queue.NewChannelQueue(queue.WithMetrics(m), queue.WithCapacity(2), queue.WithPriorityLanes(),
+		queue.WithOverflowPolicy(queue.OverflowDropOldest, 0))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = queue.NewRabbitMQQueue(&mockProducer{}, queue.WithPriorityLanes())
+	assert.NotNil(t, err)
+
+	// The lowest lane overflows without affecting the others
+	assert.Nil(t, q.Push(messageWithSeverity("DEBUG")))
+	assert.Nil(t, q.Push(messageWithSeverity("INFO")))
+	assert.Nil(t, q.Push(messageWithSeverity("WARN")))
+	assert.Nil(t, q.Push(messageWithSeverity("NOTICE")))
+	assert.Nil(t, q.Push(messageWithSeverity("ERROR")))
+	assert.Nil(t, q.Push(messageWithSeverity("FATAL")))
+	assert.Equal(t, 1, m.outcomes[queue.OverflowOutcomeDroppedOldest])
+	stats := q.Stats()
+	assert.Equal(t, int64(5), stats.Depth)
+	assert.Equal(t, int64(6), stats.Capacity)
+
+	_, _ = q.Start()
+	var severities []string
+	for i := 0; i < 5; i++ {
+		severities = append(severities, (<-q.Output()).Severity)
+	}
+	assert.Equal(t, []string{"ERROR", "FATAL", "WARN", "INFO", "NOTICE"}, severities)
+}
+
+func TestChannelQueueStats(t *testing.T) {
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}), queue.WithCapacity(2), queue.WithOverflowPolicy(queue.OverflowDropOldest, 0))
+	assert.Equal(t, queue.Stats{Capacity: 2}, q.Stats())
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, _ = q.Start()
+	<-q.Output()
+	_ = q.DeadLetter(logging.Resource{})
+
+	// The parser holds the next payload until the consumer takes it
+	assert.Eventually(t, func() bool { return q.Stats().Pops == 1 }, time.Second, time.Millisecond)
+	stats := q.Stats()
+	assert.Equal(t, int64(1), stats.Depth)
+	assert.Equal(t, int64(3), stats.Pushes)
+	assert.Equal(t, int64(1), stats.DeadLetters)
+	assert.GreaterOrEqual(t, stats.OldestAge, 10*time.Millisecond)
+
+	<-q.Output()
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, time.Duration(0), q.Stats().OldestAge)
+}
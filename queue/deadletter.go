@@ -0,0 +1,426 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/streadway/amqp"
+)
+
+// deadLetterMetaSink holds the name of the sink which rejected a resource
+const deadLetterMetaSink = "deadletter.sink"
+
+var (
+	DeadLetterRoutingKey  = "deadletter.rfc5424"
+	ErrNoDeadLetterStore  = errors.New("no dead letter store configured")
+	ErrDeadLettersClaimed = errors.New("dead letters are already being replayed")
+)
+
+// DeadLetter is a rejected logging.Resource together with the reason it was
+// rejected. Payloads which could not be parsed are kept as Raw instead. Sink
+// names the sink or tenant which rejected the resource, it is empty for the
+// primary sink when there is only one
+type DeadLetter struct {
+	Resource logging.Resource `json:"resource"`
+	Raw      string           `json:"raw,omitempty"`
+	Reason   string           `json:"reason,omitempty"`
+	Sink     string           `json:"sink,omitempty"`
+	Time     time.Time        `json:"time"`
+}
+
+// NewDeadLetter wraps a rejected resource. The reason is taken from resource.Error
+func NewDeadLetter(resource logging.Resource) DeadLetter {
+	letter := DeadLetter{
+		Resource: resource,
+		Time:     time.Now().UTC(),
+	}
+	letter.Sink, _ = resource.Meta[deadLetterMetaSink].(string)
+	if resource.Error != nil {
+		letter.Reason = resource.Error.Error()
+	}
+	return letter
+}
+
+// NewRawDeadLetter wraps a raw payload which failed to parse
+func NewRawDeadLetter(raw []byte, reason error) DeadLetter {
+	letter := DeadLetter{
+		Raw:  string(raw),
+		Time: time.Now().UTC(),
+	}
+	if reason != nil {
+		letter.Reason = reason.Error()
+	}
+	return letter
+}
+
+// DeadLetterStore persists dead letters so they can be replayed later
+type DeadLetterStore interface {
+	// Store persists a single dead letter
+	Store(letter DeadLetter) error
+	// Load returns all stored dead letters without removing them
+	Load() ([]DeadLetter, error)
+	// Claim loads all stored dead letters for a replay. They stay in the
+	// store until they are removed through the claim
+	Claim() (DeadLetterClaim, error)
+}
+
+// DeadLetterClaim holds the dead letters loaded for a replay
+type DeadLetterClaim interface {
+	// Letters returns the claimed dead letters
+	Letters() []DeadLetter
+	// Remove deletes the claimed dead letters at indices from the store
+	Remove(indices ...int) error
+	// Release ends the claim, the dead letters which were not removed are kept
+	Release() error
+}
+
+// FileDeadLetterStore stores dead letters as newline delimited JSON in a local file
+type FileDeadLetterStore struct {
+	path    string
+	mu      sync.Mutex
+	claimed bool
+}
+
+var _ DeadLetterStore = &FileDeadLetterStore{}
+
+// NewFileDeadLetterStore returns a DeadLetterStore backed by the file at path
+func NewFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing dead letter file path")
+	}
+	return &FileDeadLetterStore{path: path}, nil
+}
+
+func (f *FileDeadLetterStore) Store(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *FileDeadLetterStore) Load() ([]DeadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	letters, _, _, err := f.load()
+	return letters, err
+}
+
+// load reads the dead letters together with their lines and the size of the
+// file. Must be called with f.mu held
+func (f *FileDeadLetterStore) load() ([]DeadLetter, [][]byte, int64, error) {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var letters []DeadLetter
+	var lines [][]byte
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, nil, 0, fmt.Errorf("corrupt dead letter in %s: %w", f.path, err)
+		}
+		letters = append(letters, letter)
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+	return letters, lines, info.Size(), nil
+}
+
+// Claim loads the dead letters for a replay. Only one replay can claim them
+// at a time, dead letters stored meanwhile are kept
+func (f *FileDeadLetterStore) Claim() (DeadLetterClaim, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.claimed {
+		return nil, ErrDeadLettersClaimed
+	}
+	letters, lines, size, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	f.claimed = true
+	return &fileDeadLetterClaim{
+		store:   f,
+		letters: letters,
+		lines:   lines,
+		removed: make([]bool, len(letters)),
+		size:    size,
+	}, nil
+}
+
+// fileDeadLetterClaim holds the dead letters at the start of the file, size
+// is the part of the file they take up
+type fileDeadLetterClaim struct {
+	store   *FileDeadLetterStore
+	letters []DeadLetter
+	lines   [][]byte
+	removed []bool
+	size    int64
+}
+
+func (c *fileDeadLetterClaim) Letters() []DeadLetter {
+	return c.letters
+}
+
+// Remove rewrites the file without the removed dead letters. The file is
+// replaced by renaming a temporary file, so it is never left half written
+func (c *fileDeadLetterClaim) Remove(indices ...int) error {
+	if len(indices) == 0 {
+		return nil
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	for _, i := range indices {
+		if i >= 0 && i < len(c.removed) {
+			c.removed[i] = true
+		}
+	}
+	var tail []byte
+	file, err := os.Open(c.store.path)
+	if err == nil {
+		_, err = file.Seek(c.size, io.SeekStart)
+		if err == nil {
+			tail, err = io.ReadAll(file)
+		}
+		_ = file.Close()
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.store.path), filepath.Base(c.store.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	w := bufio.NewWriter(tmp)
+	var size int64
+	for i, line := range c.lines {
+		if c.removed[i] {
+			continue
+		}
+		_, _ = w.Write(line)
+		_ = w.WriteByte('\n')
+		size += int64(len(line)) + 1
+	}
+	_, _ = w.Write(tail)
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.store.path)
+	}
+	if err != nil {
+		return fmt.Errorf("dead letter file rewrite error: %w", err)
+	}
+	c.size = size
+	return nil
+}
+
+func (c *fileDeadLetterClaim) Release() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	c.store.claimed = false
+	return nil
+}
+
+// AMQPChannel is the subset of *amqp.Channel used by RabbitMQDeadLetterStore
+type AMQPChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+}
+
+// RabbitMQDeadLetterStore stores dead letters in a durable RabbitMQ queue
+type RabbitMQDeadLetterStore struct {
+	channel AMQPChannel
+	config  RabbitMQConfig
+	mu      sync.Mutex
+}
+
+var _ DeadLetterStore = &RabbitMQDeadLetterStore{}
+
+// DeadLetterQueueName returns the dead letter queue name to use
+func DeadLetterQueueName() string {
+	return "logproxy_deadletter"
+}
+
+// NewRabbitMQDeadLetterStore returns a DeadLetterStore using channel and the
+// exchange and dead letter queue of config. The dead letter queue must already
+// be declared and bound, see SetupDeadLetterQueue
+func NewRabbitMQDeadLetterStore(channel AMQPChannel, config RabbitMQConfig) (*RabbitMQDeadLetterStore, error) {
+	if channel == nil {
+		return nil, fmt.Errorf("missing AMQP channel")
+	}
+	return &RabbitMQDeadLetterStore{channel: channel, config: config.withDefaults()}, nil
+}
+
+// SetupDeadLetterQueue declares the durable dead letter queue and binds it to the exchange
+func SetupDeadLetterQueue(conn *amqp.Connection, config RabbitMQConfig) (*amqp.Channel, error) {
+	config = config.withDefaults()
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("channel error: %w", err)
+	}
+	if err := channel.ExchangeDeclare(config.Exchange, "topic", true, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("exchange declare error: %w", err)
+	}
+	if _, err := channel.QueueDeclare(config.DeadLetterQueue, true, false, false, false, nil); err != nil {
+		return nil, fmt.Errorf("queue declare error: %w", err)
+	}
+	if err := channel.QueueBind(config.DeadLetterQueue, config.DeadLetterRoutingKey, config.Exchange, false, nil); err != nil {
+		return nil, fmt.Errorf("queue bind error: %w", err)
+	}
+	return channel, nil
+}
+
+func (r *RabbitMQDeadLetterStore) Store(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.channel.Publish(r.config.Exchange, r.config.DeadLetterRoutingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         data,
+		DeliveryMode: amqp.Persistent,
+	})
+}
+
+func (r *RabbitMQDeadLetterStore) Load() ([]DeadLetter, error) {
+	claim, err := r.Claim()
+	if err != nil {
+		return nil, err
+	}
+	return claim.Letters(), claim.Release()
+}
+
+// Claim gets every dead letter from the queue without acknowledging it.
+// Unacknowledged messages are only redelivered once they are settled, so
+// every message is seen exactly once
+func (r *RabbitMQDeadLetterStore) Claim() (DeadLetterClaim, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	claim := &rabbitMQDeadLetterClaim{store: r}
+	for {
+		d, ok, err := r.channel.Get(r.config.DeadLetterQueue, false)
+		if err != nil {
+			_ = claim.release()
+			return nil, err
+		}
+		if !ok {
+			return claim, nil
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(d.Body, &letter); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping corrupt dead letter: %v\n", err)
+			claim.skipped = append(claim.skipped, d)
+			continue
+		}
+		claim.letters = append(claim.letters, letter)
+		claim.deliveries = append(claim.deliveries, d)
+	}
+}
+
+// rabbitMQDeadLetterClaim holds the unacknowledged deliveries of the claimed
+// dead letters. Corrupt dead letters are skipped and kept in the queue
+type rabbitMQDeadLetterClaim struct {
+	store      *RabbitMQDeadLetterStore
+	letters    []DeadLetter
+	deliveries []amqp.Delivery
+	settled    []bool
+	skipped    []amqp.Delivery
+}
+
+func (c *rabbitMQDeadLetterClaim) Letters() []DeadLetter {
+	return c.letters
+}
+
+// Remove acknowledges the deliveries of the dead letters at indices
+func (c *rabbitMQDeadLetterClaim) Remove(indices ...int) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	if c.settled == nil {
+		c.settled = make([]bool, len(c.deliveries))
+	}
+	var errs []error
+	for _, i := range indices {
+		if i < 0 || i >= len(c.deliveries) || c.settled[i] {
+			continue
+		}
+		c.settled[i] = true
+		if err := c.deliveries[i].Ack(false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Release returns the dead letters which were not removed to the queue
+func (c *rabbitMQDeadLetterClaim) Release() error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	return c.release()
+}
+
+// release must be called with store.mu held
+func (c *rabbitMQDeadLetterClaim) release() error {
+	var errs []error
+	for i, d := range c.deliveries {
+		if c.settled != nil && c.settled[i] {
+			continue
+		}
+		if err := d.Nack(false, true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, d := range c.skipped {
+		if err := d.Nack(false, true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.deliveries, c.skipped = nil, nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,173 @@
+package queue_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAMQPChannel struct {
+	routes   []string
+	queued   [][]byte
+	unacked  map[uint64][]byte
+	nextTag  uint64
+	getError error
+}
+
+func (f *fakeAMQPChannel) Publish(exchange, key string, _, _ bool, msg amqp.Publishing) error {
+	f.routes = append(f.routes, exchange+"/"+key)
+	f.queued = append(f.queued, msg.Body)
+	return nil
+}
+
+func (f *fakeAMQPChannel) Get(_ string, _ bool) (amqp.Delivery, bool, error) {
+	if f.getError != nil {
+		return amqp.Delivery{}, false, f.getError
+	}
+	if len(f.queued) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	if f.unacked == nil {
+		f.unacked = make(map[uint64][]byte)
+	}
+	f.nextTag++
+	body := f.queued[0]
+	f.queued = f.queued[1:]
+	f.unacked[f.nextTag] = body
+	return amqp.Delivery{Acknowledger: f, DeliveryTag: f.nextTag, Body: body}, true, nil
+}
+
+func (f *fakeAMQPChannel) Ack(tag uint64, _ bool) error {
+	delete(f.unacked, tag)
+	return nil
+}
+
+func (f *fakeAMQPChannel) Nack(tag uint64, _ bool, requeue bool) error {
+	if requeue {
+		f.queued = append(f.queued, f.unacked[tag])
+	}
+	delete(f.unacked, tag)
+	return nil
+}
+
+func (f *fakeAMQPChannel) Reject(tag uint64, requeue bool) error {
+	return f.Nack(tag, false, requeue)
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	letter := queue.NewDeadLetter(logging.Resource{ID: "foo", Error: errors.New("rejected")})
+	assert.Equal(t, "foo", letter.Resource.ID)
+	assert.Equal(t, "rejected", letter.Reason)
+	assert.False(t, letter.Time.IsZero())
+
+	letter = queue.NewDeadLetter(logging.Resource{ID: "bar"})
+	assert.Equal(t, "", letter.Reason)
+}
+
+func TestFileDeadLetterStore(t *testing.T) {
+	_, err := queue.NewFileDeadLetterStore("")
+	assert.NotNil(t, err)
+
+	dir := t.TempDir()
+	store, err := queue.NewFileDeadLetterStore(filepath.Join(dir, "deadletters.ndjson"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	letters, err := store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, letters, 0)
+
+	assert.Nil(t, store.Store(queue.NewDeadLetter(logging.Resource{ID: "1"})))
+	assert.Nil(t, store.Store(queue.NewDeadLetter(logging.Resource{ID: "2", Error: errors.New("invalid")})))
+
+	letters, err = store.Load()
+	if !assert.Nil(t, err) || !assert.Len(t, letters, 2) {
+		return
+	}
+	assert.Equal(t, "1", letters[0].Resource.ID)
+	assert.Equal(t, "invalid", letters[1].Reason)
+
+	claim, err := store.Claim()
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = store.Claim()
+	assert.Equal(t, queue.ErrDeadLettersClaimed, err)
+	assert.Len(t, claim.Letters(), 2)
+	// Dead letters stored during a replay are kept
+	assert.Nil(t, store.Store(queue.NewDeadLetter(logging.Resource{ID: "3"})))
+	assert.Nil(t, claim.Remove(0))
+	assert.Nil(t, claim.Remove(1))
+	assert.Nil(t, claim.Release())
+	letters, err = store.Load()
+	if assert.Nil(t, err) && assert.Len(t, letters, 1) {
+		assert.Equal(t, "3", letters[0].Resource.ID)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, files, 1)
+
+	// Released dead letters stay in place
+	claim, err = store.Claim()
+	if assert.Nil(t, err) {
+		assert.Nil(t, claim.Release())
+	}
+	letters, _ = store.Load()
+	assert.Len(t, letters, 1)
+}
+
+func TestRabbitMQDeadLetterStore(t *testing.T) {
+	_, err := queue.NewRabbitMQDeadLetterStore(nil, queue.RabbitMQConfig{})
+	assert.NotNil(t, err)
+
+	channel := &fakeAMQPChannel{}
+	store, err := queue.NewRabbitMQDeadLetterStore(channel, queue.RabbitMQConfig{Exchange: "tenant"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, store.Store(queue.NewDeadLetter(logging.Resource{ID: "1"})))
+	assert.Nil(t, store.Store(queue.NewDeadLetter(logging.Resource{ID: "2"})))
+	assert.Equal(t, []string{"tenant/deadletter.rfc5424", "tenant/deadletter.rfc5424"}, channel.routes)
+
+	letters, err := store.Load()
+	assert.Nil(t, err)
+	assert.Len(t, letters, 2)
+	assert.Len(t, channel.queued, 2)
+
+	claim, err := store.Claim()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, claim.Letters(), 2)
+	assert.Len(t, channel.unacked, 2)
+	assert.Nil(t, claim.Remove(1))
+	assert.Nil(t, claim.Release())
+	if assert.Len(t, channel.queued, 1) {
+		letters, _ = store.Load()
+		assert.Equal(t, "1", letters[0].Resource.ID)
+	}
+	assert.Len(t, channel.unacked, 0)
+
+	channel.getError = errors.New("channel closed")
+	_, err = store.Claim()
+	assert.NotNil(t, err)
+}
+
+func TestChannelDeadLetter(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	q, err := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}), queue.WithDeadLetterStore(store))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, q.DeadLetter(logging.Resource{ID: "1"}))
+	letters, _ := store.Load()
+	assert.Len(t, letters, 1)
+
+	q, _ = queue.NewChannelQueue()
+	assert.Nil(t, q.DeadLetter(logging.Resource{ID: "1"}))
+}
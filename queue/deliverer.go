@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -22,6 +26,7 @@ import (
 
 var (
 	batchSize     = 25
+	batchLinger   = 500 * time.Millisecond
 	rtrTimeFormat = "2006-01-02T15:04:05.000Z0700"
 	vcapPattern   = regexp.MustCompile(`vcap_request_id:"(?P<requestID>[^"]+)"`)
 	rtrPattern    = regexp.MustCompile(`\[RTR/(?P<index>\d+)]`)
@@ -79,10 +84,126 @@ type Deliverer struct {
 	buildVersion string
 	manager      *shared.PluginManager
 	metrics      Metrics
+
+	maxBatchCount int
+	maxBatchBytes int
+	maxLinger     time.Duration
+	workers       int
+	maxInFlight   int
+	inFlight      atomic.Int64
+	maxRetries    int
+	retryInitial  time.Duration
+	retryMaxDelay time.Duration
+	breaker       *breaker
+}
+
+// DelivererOption configures a Deliverer
+type DelivererOption func(pl *Deliverer) error
+
+// WithMaxBatchCount sets the number of resources after which a batch is
+// delivered, 25 by default
+func WithMaxBatchCount(count int) DelivererOption {
+	return func(pl *Deliverer) error {
+		if count < 1 {
+			return fmt.Errorf("invalid batch count: %d", count)
+		}
+		pl.maxBatchCount = count
+		return nil
+	}
+}
+
+// WithMaxBatchBytes limits the JSON encoded size of a batch. A resource which
+// exceeds the limit on its own is delivered in a batch of one. Zero, the
+// default, means no limit
+func WithMaxBatchBytes(bytes int) DelivererOption {
+	return func(pl *Deliverer) error {
+		if bytes < 0 {
+			return fmt.Errorf("invalid batch bytes: %d", bytes)
+		}
+		pl.maxBatchBytes = bytes
+		return nil
+	}
+}
+
+// WithMaxLinger sets the time the first resource of a batch waits for the
+// batch to fill up, 500ms by default
+func WithMaxLinger(linger time.Duration) DelivererOption {
+	return func(pl *Deliverer) error {
+		if linger <= 0 {
+			return fmt.Errorf("invalid linger time: %v", linger)
+		}
+		pl.maxLinger = linger
+		return nil
+	}
+}
+
+// WithFlushWorkers sets the number of batches which are collected and
+// delivered in parallel, 1 by default. The resources of an application are
+// always delivered by the same worker so they stay in order
+func WithFlushWorkers(workers int) DelivererOption {
+	return func(pl *Deliverer) error {
+		if workers < 1 {
+			return fmt.Errorf("invalid number of flush workers: %d", workers)
+		}
+		pl.workers = workers
+		return nil
+	}
+}
+
+// WithMaxInFlight limits the number of batches which are being delivered at
+// the same time. It defaults to the number of flush workers
+func WithMaxInFlight(batches int) DelivererOption {
+	return func(pl *Deliverer) error {
+		if batches < 1 {
+			return fmt.Errorf("invalid number of in-flight batches: %d", batches)
+		}
+		pl.maxInFlight = batches
+		return nil
+	}
+}
+
+// WithMaxRetries sets how often a batch is retried after a transient failure
+// like a timeout, a 429 or a 5xx response, 5 by default
+func WithMaxRetries(retries int) DelivererOption {
+	return func(pl *Deliverer) error {
+		if retries < 0 {
+			return fmt.Errorf("invalid number of retries: %d", retries)
+		}
+		pl.maxRetries = retries
+		return nil
+	}
+}
+
+// WithRetryBackoff sets the delay before the first retry and the maximum
+// delay, 500ms and 30s by default. A Retry-After header overrides the delay
+// up to the maximum
+func WithRetryBackoff(initial, maxDelay time.Duration) DelivererOption {
+	return func(pl *Deliverer) error {
+		if initial <= 0 || maxDelay < initial {
+			return fmt.Errorf("invalid retry backoff: %v to %v", initial, maxDelay)
+		}
+		pl.retryInitial = initial
+		pl.retryMaxDelay = maxDelay
+		return nil
+	}
+}
+
+// WithCircuitBreaker opens the circuit breaker after the given number of
+// consecutive transient failures, 5 by default. While it is open delivery
+// pauses, so the queue stops being consumed. After the cooldown, 30s by
+// default, a single batch probes the Storer. Zero failures disables it
+func WithCircuitBreaker(failures int, cooldown time.Duration) DelivererOption {
+	return func(pl *Deliverer) error {
+		if failures < 0 || cooldown <= 0 {
+			return fmt.Errorf("invalid circuit breaker: %d failures, %v cooldown", failures, cooldown)
+		}
+		pl.breaker = newBreaker(failures, cooldown)
+		return nil
+	}
 }
 
 // NewDeliverer returns a new configured Deliverer instance
-func NewDeliverer(storer logging.Storer, log Logger, manager *shared.PluginManager, buildVersion string, metrics Metrics) (*Deliverer, error) {
+func NewDeliverer(storer logging.Storer, log Logger, manager *shared.PluginManager, buildVersion string, metrics Metrics, opts ...DelivererOption) (*Deliverer, error) {
 	var logger Deliverer
 
 	logger.storer = storer
@@ -90,10 +211,53 @@ func NewDeliverer(storer logging.Storer, log Logger, manager *shared.PluginManag
 	logger.buildVersion = buildVersion
 	logger.manager = manager
 	logger.metrics = metrics
+	logger.maxBatchCount = batchSize
+	logger.maxLinger = batchLinger
+	logger.workers = 1
+	logger.maxRetries = defaultMaxRetries
+	logger.retryInitial = defaultRetryInitial
+	logger.retryMaxDelay = defaultRetryMaxDelay
+	logger.breaker = newBreaker(defaultBreakerFailures, defaultBreakerCooldown)
+	for _, o := range opts {
+		if err := o(&logger); err != nil {
+			return nil, err
+		}
+	}
+	if logger.maxInFlight == 0 {
+		logger.maxInFlight = logger.workers
+	}
 
 	return &logger, nil
 }
 
+// BreakerStatus reports the circuit breaker around the Storer
+func (pl *Deliverer) BreakerStatus() BreakerStatus {
+	return pl.breaker.status()
+}
+
+// resourceSize returns the JSON encoded size of a resource when batches
+// are limited by size
+func (pl *Deliverer) resourceSize(resource logging.Resource) int {
+	if pl.maxBatchBytes == 0 {
+		return 0
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// fits reports whether a resource of size bytes can be added to a batch
+func (pl *Deliverer) fits(count, bytes, size int) bool {
+	return count == 0 || pl.maxBatchBytes == 0 || bytes+size <= pl.maxBatchBytes
+}
+
+// full reports whether a batch must be delivered
+func (pl *Deliverer) full(count, bytes int) bool {
+	return count >= pl.maxBatchCount || (pl.maxBatchBytes > 0 && bytes >= pl.maxBatchBytes)
+}
+
 // BodyToResource takes the raw body and transforms it to a
 // logging.Resource instance
 func BodyToResource(body []byte, m Metrics) (*logging.Resource, error) {
@@ -111,74 +275,193 @@ func BodyToResource(body []byte, m Metrics) (*logging.Resource, error) {
 	return resource, nil
 }
 
-func (pl *Deliverer) flushBatch(ctx context.Context, resources []logging.Resource, count int, queue Queue) (int, error) {
+// deadLetterer is the part of Queue used for rejected resources
+type deadLetterer interface {
+	DeadLetter(msg logging.Resource) error
+}
+
+// flushBatch delivers a batch of resources. handled is called with the
+// resources which were stored or dead lettered. When transient failures
+// outlast the retries the undelivered resources are returned with the error
+func (pl *Deliverer) flushBatch(ctx context.Context, resources []logging.Resource, count int, queue deadLetterer, handled func(...logging.Resource)) (int, []logging.Resource, error) {
 	tracer := opentracing.GlobalTracer()
 	span, _ := opentracing.StartSpanFromContextWithTracer(ctx, tracer, "deliverer_flush_batch")
 	defer span.Finish()
-	fmt.Printf("batch flushing %d messages\n", count)
+	fmt.Fprintf(os.Stderr, "batch flushing %d messages\n", count)
 
-	resp, err := pl.storer.StoreResources(resources, count)
-	if err != nil { // Unpack and send individually
-		if resp == nil {
-			fmt.Printf("unexpected error for StoreResource(): %v\n", err)
-			return count, err
+	stored, undelivered, err := pl.store(ctx, resources[:count], queue, handled)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to deliver %d of %d messages: %v\n", len(undelivered), count, err)
+	}
+	return stored, undelivered, err
+}
+
+// ack acknowledges handled resources when the queue supports it
+func ack(queue Queue, resources ...logging.Resource) {
+	acker, ok := queue.(Acknowledger)
+	if !ok {
+		return
+	}
+	if err := acker.Ack(resources...); err != nil {
+		fmt.Fprintf(os.Stderr, "error acknowledging %d resources: %v\n", len(resources), err)
+	}
+}
+
+// flush delivers the buffered resources and acknowledges the ones which were
+// stored or dead lettered. Resources which could not be delivered are
+// requeued so the queue delivers them again. Queues without
+// acknowledgements would lose them, so they are dead lettered instead
+func (pl *Deliverer) flush(ctx context.Context, queue Queue, buf []logging.Resource, count int) int {
+	stored, undelivered, err := pl.flushBatch(ctx, buf, count, queue, func(resources ...logging.Resource) {
+		ack(queue, resources...)
+	})
+	if len(undelivered) == 0 {
+		return stored
+	}
+	if acker, ok := queue.(Acknowledger); ok {
+		if err := acker.Requeue(undelivered...); err != nil {
+			fmt.Fprintf(os.Stderr, "error requeueing %d resources: %v\n", len(undelivered), err)
 		}
-		// Unpack and send individual messages
-		for i := 0; i < count; i++ {
-			fmt.Printf("resending %d\n", i+1)
-			_, err = pl.storer.StoreResources([]logging.Resource{resources[i]}, 1)
-			if err != nil {
-				_ = queue.DeadLetter(resources[i])
-				fmt.Printf("permanent failure sending %d resource: [%v] error: %v\n", i+1, resources[i], err)
+		return stored
+	}
+	for _, resource := range undelivered {
+		resource.Error = err
+		_ = queue.DeadLetter(resource)
+	}
+	return stored
+}
+
+// ResourceWorker implements the worker process for parsing the queues.
+// Resources are passed through the filters and handed to the flush workers.
+// When done receives a value and the queue is a Drainer, the queue is
+// drained before the flush workers deliver their last batch
+func (pl *Deliverer) ResourceWorker(queue Queue, done <-chan bool, _ *zipkin.Tracer) {
+	var totalStored atomic.Int64
+	var wg sync.WaitGroup
+	resourceChannel := queue.Output()
+	inFlight := make(chan struct{}, pl.maxInFlight)
+	partitions := make([]chan logging.Resource, pl.workers)
+	for i := range partitions {
+		partitions[i] = make(chan logging.Resource, pl.maxBatchCount)
+		wg.Add(1)
+		go func(resources <-chan logging.Resource) {
+			defer wg.Done()
+			totalStored.Add(pl.flushWorker(queue, resources, inFlight))
+		}(partitions[i])
+	}
+
+	pf, ok := queue.(prefilterer)
+	prefiltered := ok && pf.prefiltered()
+	dispatch := func(ctx context.Context, resource logging.Resource) {
+		if resource.ApplicationVersion == "" {
+			resource.ApplicationVersion = pl.buildVersion
+		}
+		if drop := !prefiltered && pl.processFilters(ctx, &resource); drop {
+			ack(queue, resource)
+			return
+		}
+		partitions[partition(resource, len(partitions))] <- resource
+	}
+
+	fmt.Fprintf(os.Stderr, "Starting ResourceWorker...\n")
+	for {
+		ctx := context.Background()
+		select {
+		case resource := <-resourceChannel:
+			dispatch(ctx, resource)
+		case <-done:
+			if drainer, ok := queue.(Drainer); ok {
+				drainer.Drain()
+				for resource := range resourceChannel {
+					dispatch(ctx, resource)
+				}
+			}
+			for _, p := range partitions {
+				close(p)
 			}
+			wg.Wait()
+			fmt.Fprintf(os.Stderr, "Worker received done message...%d stored\n", totalStored.Load())
+			return
 		}
 	}
+}
 
-	return count, nil
+// partition returns the flush worker of a resource
+func partition(resource logging.Resource, workers int) int {
+	if workers == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(resource.ApplicationName))
+	return int(h.Sum32() % uint32(workers)) // #nosec G115 -- workers is positive
 }
 
-// ResourceWorker implements the worker process for parsing the queues
-func (pl *Deliverer) ResourceWorker(queue Queue, done <-chan bool, _ *zipkin.Tracer) {
-	var count int
+// flushWorker collects resources into batches and delivers them one after the
+// other. A batch is delivered when it is full or when its first resource
+// waited for the linger time. inFlight limits the number of batches being
+// delivered by all workers. The last batch is delivered once resources is
+// closed and the number of stored resources is returned
+func (pl *Deliverer) flushWorker(queue Queue, resources <-chan logging.Resource, inFlight chan struct{}) int64 {
+	var count, bytes int
 	var totalStored int64
-	buf := make([]logging.Resource, batchSize)
-	resourceChannel := queue.Output()
+	var started time.Time
+	var linger *time.Timer
+	var lingered <-chan time.Time
+	buf := make([]logging.Resource, pl.maxBatchCount)
+
+	flush := func(ctx context.Context) {
+		if count == 0 {
+			return
+		}
+		linger.Stop()
+		lingered = nil
+		if pl.metrics != nil {
+			pl.metrics.ObserveBatch(count, time.Since(started))
+		}
+		inFlight <- struct{}{}
+		pl.setInFlight(pl.inFlight.Add(1))
+		stored := pl.flush(ctx, queue, buf, count)
+		pl.setInFlight(pl.inFlight.Add(-1))
+		<-inFlight
+		totalStored += int64(stored)
+		count, bytes = 0, 0
+	}
 
-	fmt.Printf("Starting ResourceWorker...\n")
 	for {
 		ctx := context.Background()
 		select {
-		case resource := <-resourceChannel:
-			if resource.ApplicationVersion == "" {
-				resource.ApplicationVersion = pl.buildVersion
+		case resource, ok := <-resources:
+			if !ok {
+				flush(ctx)
+				return totalStored
+			}
+			size := pl.resourceSize(resource)
+			if !pl.fits(count, bytes, size) {
+				flush(ctx)
 			}
-			if drop := pl.processFilters(ctx, &resource); drop {
-				continue
+			if count == 0 {
+				started = time.Now()
+				linger = time.NewTimer(pl.maxLinger)
+				lingered = linger.C
 			}
 			buf[count] = resource
 			count++
-			if count == batchSize {
-				stored, _ := pl.flushBatch(ctx, buf, count, queue)
-				totalStored += int64(stored)
-				count = 0
-			}
-		case <-time.After(500 * time.Millisecond):
-			if count > 0 {
-				stored, _ := pl.flushBatch(ctx, buf, count, queue)
-				totalStored += int64(stored)
-				count = 0
+			bytes += size
+			if pl.full(count, bytes) {
+				flush(ctx)
 			}
-		case <-done:
-			if count > 0 {
-				stored, _ := pl.flushBatch(ctx, buf, count, queue)
-				totalStored += int64(stored)
-			}
-			fmt.Printf("Worker received done message...%d stored\n", totalStored)
-			return
+		case <-lingered:
+			flush(ctx)
 		}
 	}
 }
 
+func (pl *Deliverer) setInFlight(batches int64) {
+	if pl.metrics != nil {
+		pl.metrics.SetBatchesInFlight(int(batches))
+	}
+}
+
 func (pl *Deliverer) processFilters(ctx context.Context, resource *logging.Resource) bool {
 	tracer := opentracing.GlobalTracer()
 	span, _ := opentracing.StartSpanFromContextWithTracer(ctx, tracer, "process_filter")
@@ -198,6 +481,7 @@ func (pl *Deliverer) processFilters(ctx context.Context, resource *logging.Resou
 			if pl.metrics != nil {
 				pl.metrics.IncPluginModified()
 			}
+			r.Meta = resource.Meta
 			*resource = r
 		}
 	}
@@ -236,7 +520,7 @@ func ProcessMessage(rfcLogMessage syslog.Message, m Metrics) (*logging.Resource,
 		return &msg, nil
 	}
 	if err != nil {
-		fmt.Printf("wrapping message: %v '%s'\n", err, *logMessage)
+		fmt.Fprintf(os.Stderr, "wrapping message: %v '%s'\n", err, *logMessage)
 	}
 
 	msg = wrapResource("logproxy-wrapped", rfcLogMessage)
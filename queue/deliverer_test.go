@@ -3,14 +3,21 @@ package queue_test
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/philips-software/logproxy/queue"
 
+	"github.com/dip-software/go-dip-api/logging"
 	"github.com/influxdata/go-syslog/v2/rfc5424"
 	"github.com/stretchr/testify/assert"
 )
@@ -169,9 +176,9 @@ func TestResourceWorker(t *testing.T) {
 	const transactionID = `eea9f72c-09b6-4d56-905b-b518fc4dc5b7`
 	const rawMessage = `<14>1 2018-09-07T15:39:21.132433+00:00 suite-phs.staging.msa-eustaging 7215cbaa-464d-4856-967c-fd839b0ff7b2 [APP/PROC/WEB/0] - - {"app":"msa-eustaging","val":{"message":"` + payload + `"},"ver":"` + appVersion + `","evt":null,"sev":"INFO","cmp":"CPH","trns":"` + transactionID + `","usr":null,"srv":"msa-eustaging.eu-west.philips-healthsuite.com","service":"msa","inst":"50676a99-dce0-418a-6b25-1e3d","cat":"Tracelog","time":"2018-09-07T15:39:21Z"}`
 
-	old := os.Stdout
+	old := os.Stderr
 	r, w, _ := os.Pipe()
-	os.Stdout = w
+	os.Stderr = w
 
 	deliverer, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
 	assert.Nilf(t, err, "Expected NewDeliverer() to succeed")
@@ -192,7 +199,7 @@ func TestResourceWorker(t *testing.T) {
 
 	done <- true
 
-	os.Stdout = old
+	os.Stderr = old
 	_ = w.Close()
 
 	var buf bytes.Buffer
@@ -225,9 +232,9 @@ func TestDroppedMessages(t *testing.T) {
 	const transactionID = `eea9f72c-09b6-4d56-905b-b518fc4dc5b7`
 	const rawMessage = `<14>1 2018-09-07T15:39:21.132433+00:00 suite-phs.staging.msa-eustaging 7215cbaa-464d-4856-967c-fd839b0ff7b2 [APP/PROC/WEB/0] - - {"app":"msa-eustaging","val":{"message":"` + payload + `"},"ver":"` + appVersion + `","evt":null,"sev":"INFO","cmp":"CPH","trns":"` + transactionID + `","usr":null,"srv":"msa-eustaging.eu-west.philips-healthsuite.com","service":"msa","inst":"50676a99-dce0-418a-6b25-1e3d","cat":"Tracelog","time":"2018-09-07T15:39:21Z"}`
 
-	old := os.Stdout
+	old := os.Stderr
 	r, w, _ := os.Pipe()
-	os.Stdout = w
+	os.Stderr = w
 
 	deliverer, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
 	assert.Nilf(t, err, "Expected NewDeliverer() to succeed")
@@ -249,14 +256,14 @@ func TestDroppedMessages(t *testing.T) {
 
 	done <- true
 
-	os.Stdout = old
+	os.Stderr = old
 	_ = w.Close()
 
 	var buf bytes.Buffer
 	_, _ = io.Copy(&buf, r)
 
 	assert.Regexp(t, regexp.MustCompile("batch flushing 23 messages"), buf.String())
-	assert.Regexp(t, regexp.MustCompile("resending 4"), buf.String())
+	assert.Regexp(t, regexp.MustCompile("splitting rejected batch of 23 messages"), buf.String())
 }
 
 func TestEncodeString(t *testing.T) {
@@ -268,9 +275,9 @@ func TestEncodeString(t *testing.T) {
 func TestUserMessage(t *testing.T) {
 	const userLog = `<14>1 2019-04-12T19:34:43.530045+00:00 suite-xxx.staging.mps 042cbd0f-1a0e-4f77-ae39-a5c6c9fe2af9 [RTR/6] - - mps.domain.com - [2019-04-12T19:34:43.528+0000] "GET /api/users/originating-user/bogus HTTP/1.1" 200 0 60 "-" "Foo Check" "10.10.66.246:48666" "10.10.17.45:61014" x_forwarded_for:"16.19.148.81, 10.10.66.246" x_forwarded_proto:"https" vcap_request_id:"77350158-4a69-47d6-731b-1bc0678db78d" response_time:0.001628089 app_id:"042cbd0f-1a0e-4f77-ae39-a5c6c9fe2af9" app_index:"0" x_b3_traceid:"6aa3915b88798203" x_b3_spanid:"6aa3915b88798203" x_b3_parentspanid:"-"`
 
-	old := os.Stdout
+	old := os.Stderr
 	r, w, _ := os.Pipe()
-	os.Stdout = w
+	os.Stderr = w
 
 	Deliverer, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
 	assert.Nilf(t, err, "Expected NewDeliverer() to succeed")
@@ -288,10 +295,213 @@ func TestUserMessage(t *testing.T) {
 	done <- true
 
 	_ = w.Close()
-	os.Stdout = old
+	os.Stderr = old
 
 	var buf bytes.Buffer
 	_, _ = io.Copy(&buf, r)
 
 	assert.Regexp(t, regexp.MustCompile("batch flushing 1 messages"), buf.String())
 }
+
+type countingStorer struct {
+	mu      sync.Mutex
+	stored  int
+	batches []int
+}
+
+func (c *countingStorer) StoreResources(_ []logging.Resource, count int) (*logging.StoreResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stored += count
+	c.batches = append(c.batches, count)
+	return &logging.StoreResponse{
+		Response: &http.Response{
+			StatusCode: http.StatusCreated,
+		},
+	}, nil
+}
+
+func TestResourceWorkerDrain(t *testing.T) {
+	storer := &countingStorer{}
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		deliverer.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+
+	// Everything queued before done is delivered
+	doneWorker <- true
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop")
+	}
+	assert.Equal(t, 30, storer.stored)
+	assert.Equal(t, int64(0), q.Stats().Depth)
+	done <- true
+}
+
+func (c *countingStorer) Batches() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.batches...)
+}
+
+type batchMetrics struct {
+	nilMetrics
+	mu     sync.Mutex
+	counts []int
+	ages   []time.Duration
+}
+
+func (b *batchMetrics) ObserveBatch(count int, age time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counts = append(b.counts, count)
+	b.ages = append(b.ages, age)
+}
+
+func TestDelivererOptions(t *testing.T) {
+	for _, invalid := range []queue.DelivererOption{
+		queue.WithMaxBatchCount(0),
+		queue.WithMaxBatchBytes(-1),
+		queue.WithMaxLinger(0),
+	} {
+		_, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{}, invalid)
+		assert.NotNil(t, err)
+	}
+}
+
+func runBatches(t *testing.T, messages int, opts ...queue.DelivererOption) (*countingStorer, *batchMetrics) {
+	storer := &countingStorer{}
+	m := &batchMetrics{}
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, m, opts...)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	go deliverer.ResourceWorker(q, doneWorker, nil)
+	for i := 0; i < messages; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	assert.Eventually(t, func() bool {
+		storer.mu.Lock()
+		defer storer.mu.Unlock()
+		return storer.stored == messages
+	}, 2*time.Second, 5*time.Millisecond)
+	doneWorker <- true
+	done <- true
+	return storer, m
+}
+
+func TestDelivererMaxBatchCount(t *testing.T) {
+	storer, m := runBatches(t, 25, queue.WithMaxBatchCount(10), queue.WithMaxLinger(50*time.Millisecond))
+	assert.Equal(t, []int{10, 10, 5}, storer.Batches())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assert.Equal(t, []int{10, 10, 5}, m.counts)
+	// The last batch was delivered once its first resource lingered
+	assert.GreaterOrEqual(t, m.ages[2], 50*time.Millisecond)
+}
+
+func TestDelivererMaxBatchBytes(t *testing.T) {
+	resource, err := queue.BodyToResource([]byte(rawMessage), &nilMetrics{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	resource.ApplicationVersion = testBuild
+	data, _ := json.Marshal(resource)
+
+	// The size of the resources varies a little because of generated IDs
+	storer, _ := runBatches(t, 6, queue.WithMaxBatchBytes(2*len(data)+len(data)/2), queue.WithMaxLinger(50*time.Millisecond))
+	assert.Equal(t, []int{2, 2, 2}, storer.Batches())
+
+	// Resources which are larger than the limit are delivered on their own
+	storer, _ = runBatches(t, 2, queue.WithMaxBatchBytes(1), queue.WithMaxLinger(50*time.Millisecond))
+	assert.Equal(t, []int{1, 1}, storer.Batches())
+}
+
+type slowStorer struct {
+	mu       sync.Mutex
+	active   int
+	peak     int
+	stored   int
+	sequence map[string][]string
+}
+
+func (s *slowStorer) StoreResources(resources []logging.Resource, count int) (*logging.StoreResponse, error) {
+	s.mu.Lock()
+	s.active++
+	s.peak = max(s.peak, s.active)
+	for _, r := range resources[:count] {
+		s.sequence[r.ApplicationName] = append(s.sequence[r.ApplicationName], r.EventID)
+	}
+	s.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.stored += count
+	return &logging.StoreResponse{
+		Response: &http.Response{
+			StatusCode: http.StatusCreated,
+		},
+	}, nil
+}
+
+func TestDelivererFlushWorkers(t *testing.T) {
+	for _, invalid := range []queue.DelivererOption{queue.WithFlushWorkers(0), queue.WithMaxInFlight(0)} {
+		_, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{}, invalid)
+		assert.NotNil(t, err)
+	}
+
+	storer := &slowStorer{sequence: make(map[string][]string)}
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{},
+		queue.WithFlushWorkers(4), queue.WithMaxInFlight(2), queue.WithMaxBatchCount(5), queue.WithMaxLinger(10*time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}), queue.WithCapacity(200))
+	apps := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"}
+	for i := 0; i < 20; i++ {
+		for _, app := range apps {
+			msg := strings.Replace(rawMessage, `"app":"appName"`, `"app":"`+app+`"`, 1)
+			msg = strings.Replace(msg, `"evt":"eventID"`, fmt.Sprintf(`"evt":"%03d"`, i), 1)
+			assert.Nil(t, q.Push([]byte(msg)))
+		}
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		deliverer.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	doneWorker <- true
+	<-stopped
+	done <- true
+
+	storer.mu.Lock()
+	defer storer.mu.Unlock()
+	assert.Equal(t, 20*len(apps), storer.stored)
+	assert.Equal(t, 2, storer.peak)
+	for _, app := range apps {
+		events := storer.sequence[app]
+		assert.Len(t, events, 20)
+		assert.True(t, sort.StringsAreSorted(events), "%s delivered out of order: %v", app, events)
+	}
+}
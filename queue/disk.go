@@ -0,0 +1,714 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+)
+
+// FsyncPolicy controls when the Disk queue flushes writes to stable storage
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs after every write, the safest and slowest option
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs periodically, see DiskConfig.FsyncInterval
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves syncing to the operating system
+	FsyncNever FsyncPolicy = "never"
+
+	segmentSuffix   = ".wal"
+	checkpointFile  = "checkpoint"
+	recordHeaderLen = 16
+
+	diskMetaPosition = "disk.position"
+)
+
+var (
+	ErrDiskFull      = errors.New("disk queue has reached its maximum size")
+	ErrRecordTooBig  = errors.New("record exceeds segment size")
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+// DiskConfig configures a Disk queue
+type DiskConfig struct {
+	// Dir holds the segment files and the checkpoint
+	Dir string
+	// SegmentBytes is the size after which a new segment file is started
+	SegmentBytes int64
+	// MaxBytes is the maximum disk usage of all segments together
+	MaxBytes int64
+	// Fsync selects the fsync policy, defaults to FsyncInterval
+	Fsync FsyncPolicy
+	// FsyncInterval is used by FsyncInterval, defaults to one second
+	FsyncInterval time.Duration
+}
+
+// Disk implements a Queue backed by a segmented write-ahead log on local disk.
+// Raw payloads are appended to the newest segment and read back in order by
+// the consumer. The checkpoint file holds the position up to which every
+// record was acknowledged, so records which were not handled yet survive a
+// restart. Fully acknowledged segments are removed
+type Disk struct {
+	config          DiskConfig
+	resourceChannel chan logging.Resource
+	metrics         Metrics
+	deadLetters     DeadLetterStore
+
+	mu          sync.Mutex
+	writer      *os.File
+	writeID     int64
+	writeOffset int64
+	readID      int64
+	readOffset  int64
+	ackID       int64
+	ackOffset   int64
+	firstID     int64
+	size        int64
+	checkpoint  *os.File
+	dirty       bool
+	closed      bool
+	notify      chan struct{}
+	inFlight    []*diskRecord
+	unacked     map[diskPosition]*diskRecord
+	requeued    []logging.Resource
+
+	depth        int64
+	head         time.Time
+	pushes       int64
+	pops         int64
+	deadLettered int64
+}
+
+var _ Queue = &Disk{}
+var _ Acknowledger = &Disk{}
+
+// diskPosition is the segment and offset of a record
+type diskPosition struct {
+	id     int64
+	offset int64
+}
+
+// diskRecord is a record handed to the Deliverer which is not acknowledged yet
+type diskRecord struct {
+	start  diskPosition
+	queued time.Time
+	acked  bool
+}
+
+func (d *Disk) SetMetrics(m Metrics) {
+	d.metrics = m
+}
+
+func (d *Disk) SetDeadLetterStore(s DeadLetterStore) {
+	d.deadLetters = s
+}
+
+// NewDiskQueue opens or creates the write-ahead log in config.Dir and
+// recovers any messages which were not acknowledged before the last shutdown
+func NewDiskQueue(config DiskConfig, opts ...OptionFunc) (*Disk, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("missing disk queue directory")
+	}
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = 16 * 1024 * 1024
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 512 * 1024 * 1024
+	}
+	if config.Fsync == "" {
+		config.Fsync = FsyncInterval
+	}
+	switch config.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy: %s", config.Fsync)
+	}
+	if config.FsyncInterval <= 0 {
+		config.FsyncInterval = time.Second
+	}
+	d := &Disk{
+		config:          config,
+		resourceChannel: make(chan logging.Resource),
+		notify:          make(chan struct{}, 1),
+		unacked:         make(map[diskPosition]*diskRecord),
+	}
+	if err := d.recover(); err != nil {
+		return nil, err
+	}
+	for _, o := range opts {
+		if err := o(d); err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Disk) segmentPath(id int64) string {
+	return filepath.Join(d.config.Dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (d *Disk) segmentIDs() ([]int64, error) {
+	entries, err := os.ReadDir(d.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// recover restores the checkpoint, removes acknowledged segments and
+// truncates a torn record at the end of the newest segment
+func (d *Disk) recover() error {
+	if err := os.MkdirAll(d.config.Dir, 0700); err != nil {
+		return err
+	}
+	checkpoint, err := os.OpenFile(filepath.Join(d.config.Dir, checkpointFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	d.checkpoint = checkpoint
+	var position [16]byte
+	if n, _ := checkpoint.ReadAt(position[:], 0); n == len(position) {
+		d.readID = int64(binary.BigEndian.Uint64(position[0:8]))
+		d.readOffset = int64(binary.BigEndian.Uint64(position[8:16]))
+	}
+
+	ids, err := d.segmentIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		ids = []int64{1}
+	}
+	if d.readID < ids[0] || d.readID > ids[len(ids)-1] {
+		// Checkpoint is missing or refers to a segment which is gone
+		d.readID = ids[0]
+		d.readOffset = 0
+	}
+	for _, id := range ids {
+		if id < d.readID {
+			if err := os.Remove(d.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, err := os.Stat(d.segmentPath(id)); err == nil {
+			d.size += info.Size()
+		}
+	}
+	d.writeID = ids[len(ids)-1]
+	writer, err := os.OpenFile(d.segmentPath(d.writeID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	d.writer = writer
+	valid, err := validLength(writer)
+	if err != nil {
+		return err
+	}
+	info, err := writer.Stat()
+	if err != nil {
+		return err
+	}
+	if valid < info.Size() {
+		fmt.Fprintf(os.Stderr, "disk queue: truncating torn segment %d from %d to %d bytes\n", d.writeID, info.Size(), valid)
+		if err := writer.Truncate(valid); err != nil {
+			return err
+		}
+		d.size -= info.Size() - valid
+	}
+	d.writeOffset = valid
+	if d.readID == d.writeID && d.readOffset > d.writeOffset {
+		d.readOffset = d.writeOffset
+	}
+	d.ackID, d.ackOffset, d.firstID = d.readID, d.readOffset, d.readID
+	if err := d.countPending(); err != nil {
+		return err
+	}
+	return d.storeCheckpoint()
+}
+
+// countPending counts the records following the checkpoint
+func (d *Disk) countPending() error {
+	for id := d.readID; id <= d.writeID; id++ {
+		f, err := os.Open(d.segmentPath(id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var offset int64
+		if id == d.readID {
+			offset = d.readOffset
+		}
+		for {
+			_, _, n, err := readRecord(f, offset)
+			if err != nil {
+				break
+			}
+			offset += n
+			d.depth++
+		}
+		_ = f.Close()
+	}
+	return nil
+}
+
+// validLength returns the length of the longest prefix of f which holds complete records
+func validLength(f *os.File) (int64, error) {
+	var offset int64
+	for {
+		_, _, n, err := readRecord(f, offset)
+		if err == io.EOF || errors.Is(err, errCorruptRecord) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += n
+	}
+}
+
+// Records are stored as a 16 byte header followed by the payload. The header
+// holds the payload length, a CRC-32 of the timestamp and payload, and the
+// push time in nanoseconds since the epoch
+func encodeRecord(raw []byte, queued time.Time) []byte {
+	record := make([]byte, recordHeaderLen+len(raw))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(raw)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(queued.UnixNano()))
+	copy(record[recordHeaderLen:], raw)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// readRecord reads the record at offset and returns its payload, push time and total length
+func readRecord(r io.ReaderAt, offset int64) ([]byte, time.Time, int64, error) {
+	var header [recordHeaderLen]byte
+	n, err := r.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return nil, time.Time{}, 0, io.EOF
+	}
+	if n < recordHeaderLen {
+		return nil, time.Time{}, 0, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	body := make([]byte, 8+length)
+	copy(body, header[8:16])
+	if n, _ := r.ReadAt(body[8:], offset+recordHeaderLen); n < int(length) {
+		return nil, time.Time{}, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, time.Time{}, 0, errCorruptRecord
+	}
+	queued := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+	return body[8:], queued, int64(recordHeaderLen) + int64(length), nil
+}
+
+func (d *Disk) storeCheckpoint() error {
+	var position [16]byte
+	binary.BigEndian.PutUint64(position[0:8], uint64(d.ackID))
+	binary.BigEndian.PutUint64(position[8:16], uint64(d.ackOffset))
+	if _, err := d.checkpoint.WriteAt(position[:], 0); err != nil {
+		return err
+	}
+	if d.config.Fsync == FsyncAlways {
+		return d.checkpoint.Sync()
+	}
+	d.dirty = true
+	return nil
+}
+
+func (d *Disk) Output() <-chan logging.Resource {
+	return d.resourceChannel
+}
+
+// Push appends the raw payload to the write-ahead log
+func (d *Disk) Push(raw []byte) error {
+	recordLen := int64(recordHeaderLen + len(raw))
+	if recordLen > d.config.SegmentBytes {
+		return ErrRecordTooBig
+	}
+	record := encodeRecord(raw, time.Now())
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return os.ErrClosed
+	}
+	if d.size+recordLen > d.config.MaxBytes {
+		d.mu.Unlock()
+		return ErrDiskFull
+	}
+	if d.writeOffset+recordLen > d.config.SegmentBytes {
+		if err := d.rotate(); err != nil {
+			d.mu.Unlock()
+			return err
+		}
+	}
+	if _, err := d.writer.WriteAt(record, d.writeOffset); err != nil {
+		// Leave the torn record for recovery to truncate
+		d.mu.Unlock()
+		return err
+	}
+	d.writeOffset += recordLen
+	d.size += recordLen
+	d.depth++
+	d.pushes++
+	var err error
+	if d.config.Fsync == FsyncAlways {
+		err = d.writer.Sync()
+	} else {
+		d.dirty = true
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+	if d.metrics != nil {
+		d.metrics.IncProcessed()
+	}
+	return nil
+}
+
+// rotate starts a new segment. Must be called with d.mu held
+func (d *Disk) rotate() error {
+	if err := d.writer.Sync(); err != nil {
+		return err
+	}
+	if err := d.writer.Close(); err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(d.segmentPath(d.writeID+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	d.writer = writer
+	d.writeID++
+	d.writeOffset = 0
+	return nil
+}
+
+// next returns the payload at the read position and moves the read position
+// past it. The record stays in flight until it is acknowledged. ok is false
+// when the consumer has caught up with the writer
+func (d *Disk) next(reader **os.File, readerID *int64) (payload []byte, record *diskRecord, ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if d.readID == d.writeID && d.readOffset >= d.writeOffset {
+			d.head = time.Time{}
+			return nil, nil, false, nil
+		}
+		if *reader == nil || *readerID != d.readID {
+			if *reader != nil {
+				_ = (*reader).Close()
+			}
+			*reader, err = os.Open(d.segmentPath(d.readID))
+			if err != nil {
+				return nil, nil, false, err
+			}
+			*readerID = d.readID
+		}
+		payload, queued, n, err := readRecord(*reader, d.readOffset)
+		if err == nil {
+			d.head = queued
+			record := &diskRecord{
+				start:  diskPosition{d.readID, d.readOffset},
+				queued: queued,
+			}
+			d.inFlight = append(d.inFlight, record)
+			d.unacked[record.start] = record
+			d.readOffset += n
+			return payload, record, true, nil
+		}
+		if d.readID == d.writeID {
+			return nil, nil, false, err
+		}
+		if err != io.EOF {
+			fmt.Fprintf(os.Stderr, "disk queue: skipping rest of segment %d: %v\n", d.readID, err)
+		}
+		// Segment is fully read
+		_ = (*reader).Close()
+		*reader = nil
+		d.readID++
+		d.readOffset = 0
+		if err := d.advance(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+}
+
+// Ack acknowledges the records of handled resources. The checkpoint moves up
+// to the first record which is still in flight
+func (d *Disk) Ack(resources ...logging.Resource) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, resource := range resources {
+		if position, ok := resource.Meta[diskMetaPosition].(diskPosition); ok {
+			if record, ok := d.unacked[position]; ok {
+				d.settle(record)
+			}
+		}
+	}
+	return d.advance()
+}
+
+// Requeue hands the resources the Deliverer gave up on out again. Their
+// records stay in flight, so they are read again after a restart as well
+func (d *Disk) Requeue(resources ...logging.Resource) error {
+	d.mu.Lock()
+	for _, resource := range resources {
+		if position, ok := resource.Meta[diskMetaPosition].(diskPosition); ok {
+			if _, ok := d.unacked[position]; ok {
+				d.requeued = append(d.requeued, resource)
+			}
+		}
+	}
+	d.mu.Unlock()
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// settle marks a record as acknowledged. Must be called with d.mu held
+func (d *Disk) settle(record *diskRecord) {
+	delete(d.unacked, record.start)
+	record.acked = true
+	d.pops++
+	if d.depth > 0 {
+		d.depth--
+	}
+}
+
+// advance moves the checkpoint past the acknowledged records at the start of
+// the in-flight records and removes the segments before it. Must be called
+// with d.mu held
+func (d *Disk) advance() error {
+	for len(d.inFlight) > 0 && d.inFlight[0].acked {
+		d.inFlight = d.inFlight[1:]
+	}
+	position := diskPosition{d.readID, d.readOffset}
+	if len(d.inFlight) > 0 {
+		position = d.inFlight[0].start
+	}
+	if position == (diskPosition{d.ackID, d.ackOffset}) {
+		return nil
+	}
+	if d.closed {
+		return os.ErrClosed
+	}
+	d.ackID, d.ackOffset = position.id, position.offset
+	for ; d.firstID < d.ackID; d.firstID++ {
+		path := d.segmentPath(d.firstID)
+		if info, err := os.Stat(path); err == nil {
+			d.size -= info.Size()
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return d.storeCheckpoint()
+}
+
+// nextRequeued returns a resource which was requeued, if any
+func (d *Disk) nextRequeued() (logging.Resource, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.requeued) == 0 {
+		return logging.Resource{}, false
+	}
+	resource := d.requeued[0]
+	d.requeued = d.requeued[1:]
+	return resource, true
+}
+
+func (d *Disk) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := Stats{
+		Depth:       d.depth,
+		Bytes:       d.size,
+		MaxBytes:    d.config.MaxBytes,
+		Pushes:      d.pushes,
+		Pops:        d.pops,
+		DeadLetters: d.deadLettered,
+	}
+	head := d.head
+	if len(d.inFlight) > 0 {
+		head = d.inFlight[0].queued
+	}
+	if d.depth > 0 && !head.IsZero() {
+		stats.OldestAge = time.Since(head)
+	}
+	return stats
+}
+
+// Sync flushes pending writes and the read checkpoint to stable storage
+func (d *Disk) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sync()
+}
+
+func (d *Disk) sync() error {
+	if !d.dirty || d.closed {
+		return nil
+	}
+	if err := d.writer.Sync(); err != nil {
+		return err
+	}
+	if err := d.checkpoint.Sync(); err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// Close syncs and closes the write-ahead log
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.dirty = true
+	err := d.sync()
+	d.closed = true
+	_ = d.writer.Close()
+	_ = d.checkpoint.Close()
+	return err
+}
+
+// Start starts the consumer which feeds the Output channel. The write-ahead
+// log is closed when the returned channel receives a value
+func (d *Disk) Start() (chan bool, error) {
+	doneChannel := make(chan bool)
+	stop := make(chan struct{})
+	go func() {
+		<-doneChannel
+		close(stop)
+	}()
+	go d.consume(stop)
+	if d.config.Fsync == FsyncInterval {
+		go func() {
+			ticker := time.NewTicker(d.config.FsyncInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := d.Sync(); err != nil {
+						fmt.Fprintf(os.Stderr, "disk queue: sync error: %v\n", err)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	return doneChannel, nil
+}
+
+func (d *Disk) consume(stop <-chan struct{}) {
+	var reader *os.File
+	var readerID int64
+	defer func() {
+		if reader != nil {
+			_ = reader.Close()
+		}
+		_ = d.Close()
+	}()
+	for {
+		if resource, ok := d.nextRequeued(); ok {
+			select {
+			case d.resourceChannel <- resource:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		payload, record, ok, err := d.next(&reader, &readerID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "disk queue: read error: %v\n", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-stop:
+				return
+			}
+		}
+		if !ok {
+			select {
+			case <-d.notify:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		resource, stored, err := ParseStage(payload, d.metrics, d.deadLetters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing syslog message: %v\n", err)
+			d.mu.Lock()
+			if stored {
+				d.deadLettered++
+			}
+			d.settle(record)
+			err = d.advance()
+			d.mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "disk queue: checkpoint error: %v\n", err)
+				return
+			}
+			continue
+		}
+		setMeta(resource, diskMetaPosition, record.start)
+		select {
+		case d.resourceChannel <- *resource:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (d *Disk) DeadLetter(msg logging.Resource) error {
+	d.mu.Lock()
+	d.deadLettered++
+	d.mu.Unlock()
+	if d.deadLetters == nil {
+		return nil
+	}
+	return d.deadLetters.Store(NewDeadLetter(msg))
+}
@@ -0,0 +1,175 @@
+package queue_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, q queue.Queue) bool {
+	select {
+	case r := <-q.Output():
+		return assert.Equal(t, "2018-09-07T15:39:21.132Z", r.LogTime)
+	case <-time.After(2 * time.Second):
+		return assert.Fail(t, "timeout waiting for resource")
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	assert.Nil(t, err)
+	return matches
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	_, err := queue.NewDiskQueue(queue.DiskConfig{})
+	assert.NotNil(t, err)
+	_, err = queue.NewDiskQueue(queue.DiskConfig{Dir: dir, Fsync: "sometimes"})
+	assert.NotNil(t, err)
+
+	q, err := queue.NewDiskQueue(queue.DiskConfig{Dir: dir, Fsync: queue.FsyncAlways}, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	done, err := q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Nil(t, q.Push([]byte("not syslog")))
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	receive(t, q)
+	receive(t, q)
+	done <- true
+}
+
+func TestDiskQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+	config := queue.DiskConfig{Dir: dir, SegmentBytes: 1024, Fsync: queue.FsyncNever}
+
+	q, err := queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	assert.Len(t, segments(t, dir), 3)
+	done, _ := q.Start()
+	assert.Nil(t, q.Ack(receiveResource(t, q), receiveResource(t, q)))
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+
+	// Simulate a crash in the middle of a write
+	newest := segments(t, dir)
+	f, err := os.OpenFile(newest[len(newest)-1], os.O_APPEND|os.O_WRONLY, 0600)
+	if assert.Nil(t, err) {
+		_, _ = f.Write([]byte{0, 0, 1, 0, 1, 2})
+		_ = f.Close()
+	}
+
+	q, err = queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	done, _ = q.Start()
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, q.Ack(receiveResource(t, q)))
+	}
+	select {
+	case <-q.Output():
+		assert.Fail(t, "unexpected resource")
+	case <-time.After(100 * time.Millisecond):
+	}
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, segments(t, dir), 1)
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	q, err := queue.NewDiskQueue(queue.DiskConfig{Dir: t.TempDir(), SegmentBytes: 1024, MaxBytes: 600})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = q.Close()
+	}()
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Equal(t, queue.ErrDiskFull, q.Push([]byte(rawMessage)))
+	assert.Equal(t, queue.ErrRecordTooBig, q.Push(make([]byte, 2048)))
+}
+
+func TestDiskQueueStats(t *testing.T) {
+	dir := t.TempDir()
+	config := queue.DiskConfig{Dir: dir, MaxBytes: 4096}
+	q, err := queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	stats := q.Stats()
+	assert.Equal(t, int64(2), stats.Depth)
+	assert.Equal(t, int64(2), stats.Pushes)
+	assert.Equal(t, int64(4096), stats.MaxBytes)
+	assert.Equal(t, int64(2*(len(rawMessage)+16)), stats.Bytes)
+	assert.Nil(t, q.Close())
+
+	// Pending messages are counted again after a restart
+	q, err = queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(2), q.Stats().Depth)
+	done, _ := q.Start()
+	assert.Nil(t, q.Ack(receiveResource(t, q)))
+	stats = q.Stats()
+	assert.Equal(t, int64(1), stats.Pops)
+	assert.Greater(t, stats.OldestAge, time.Duration(0))
+	done <- true
+}
+
+func TestDiskQueueUnacknowledged(t *testing.T) {
+	dir := t.TempDir()
+	config := queue.DiskConfig{Dir: dir, SegmentBytes: 1024, Fsync: queue.FsyncAlways}
+	q, err := queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, q.Push([]byte(strings.Replace(rawMessage, `"evt":"eventID"`, `"evt":"`+strconv.Itoa(i)+`"`, 1))))
+	}
+	done, _ := q.Start()
+	first := receiveResource(t, q)
+	second := receiveResource(t, q)
+	third := receiveResource(t, q)
+	// The checkpoint only moves past acknowledged records without gaps
+	assert.Nil(t, q.Ack(first, third))
+	assert.Equal(t, int64(3), q.Stats().Depth)
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+
+	q, err = queue.NewDiskQueue(config, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(4), q.Stats().Depth)
+	done, _ = q.Start()
+	redelivered := receiveResource(t, q)
+	assert.Equal(t, second.EventID, redelivered.EventID)
+	assert.Equal(t, third.EventID, receiveResource(t, q).EventID)
+
+	// Requeued resources are handed out again before the next record
+	assert.Nil(t, q.Requeue(redelivered))
+	assert.Equal(t, redelivered.EventID, receiveResource(t, q).EventID)
+	done <- true
+}
@@ -0,0 +1,9 @@
+package queue
+
+import "github.com/streadway/amqp"
+
+// ConsumeDeliveries runs the consumer of a connected RabbitMQ queue on
+// deliveries, tests have no broker to connect to
+func (r *RabbitMQ) ConsumeDeliveries(deliveries <-chan amqp.Delivery, done <-chan bool) {
+	rfc5424Worker(r.resourceChannel, done, r.parse, r.delivered, r.ack)(deliveries, nil)
+}
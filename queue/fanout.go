@@ -0,0 +1,347 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/openzipkin/zipkin-go"
+)
+
+const (
+	defaultSinkBuffer = 1000
+
+	// fanOutMetaPending counts the reliable sinks which still have to handle
+	// a resource before it is acknowledged
+	fanOutMetaPending = "fanout.pending"
+)
+
+var errSinkQueue = errors.New("sink queues are fed by the fan-out")
+
+// Sink is a named Deliverer which receives a copy of every resource routed
+// to it. Resources are handed to reliable sinks without loss, a best effort
+// sink drops resources when it falls behind or rejects them
+type Sink struct {
+	Name       string
+	Deliverer  *Deliverer
+	BestEffort bool
+}
+
+// FanOut delivers the resources of a queue to several sinks. The first sink
+// is the primary, it runs the filters and must be reliable. A resource is
+// acknowledged once every reliable sink it was handed to stored or dead
+// lettered it, and consumption pauses when a reliable sink falls behind.
+// Best effort sinks have a buffer and resources which don't fit or which are
+// rejected are dropped, so they never hold up the reliable sinks. Every sink
+// batches, retries and breaks its circuit on its own. Without a Router every
+// resource goes to every sink
+type FanOut struct {
+	sinks   []Sink
+	metrics Metrics
+	buffer  int
+	router  *Router
+}
+
+// FanOutOption configures a FanOut
+type FanOutOption func(f *FanOut) error
+
+// WithSinkBuffer sets the number of resources a secondary sink can fall
+// behind before resources are dropped for it, 1000 by default
+func WithSinkBuffer(resources int) FanOutOption {
+	return func(f *FanOut) error {
+		if resources < 1 {
+			return fmt.Errorf("invalid sink buffer: %d", resources)
+		}
+		f.buffer = resources
+		return nil
+	}
+}
+
+// WithRouter routes resources to the sinks picked by router
+func WithRouter(router *Router) FanOutOption {
+	return func(f *FanOut) error {
+		f.router = router
+		return nil
+	}
+}
+
+// NewFanOut returns a FanOut to the given sinks, the first one is the primary
+func NewFanOut(sinks []Sink, metrics Metrics, opts ...FanOutOption) (*FanOut, error) {
+	if len(sinks) == 0 {
+		return nil, errors.New("fan-out needs at least one sink")
+	}
+	if sinks[0].BestEffort {
+		return nil, fmt.Errorf("primary sink %s must be reliable", sinks[0].Name)
+	}
+	names := make(map[string]bool, len(sinks))
+	for _, sink := range sinks {
+		if sink.Deliverer == nil {
+			return nil, fmt.Errorf("sink %q has no deliverer", sink.Name)
+		}
+		if names[sink.Name] {
+			return nil, fmt.Errorf("duplicate sink: %s", sink.Name)
+		}
+		names[sink.Name] = true
+	}
+	f := &FanOut{
+		sinks:   sinks,
+		metrics: metrics,
+		buffer:  defaultSinkBuffer,
+	}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.router != nil {
+		for _, name := range f.router.Sinks() {
+			if !names[name] {
+				return nil, fmt.Errorf("route to unknown sink: %s", name)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Primary returns the Deliverer of the primary sink
+func (f *FanOut) Primary() *Deliverer {
+	return f.sinks[0].Deliverer
+}
+
+// ResourceWorker consumes the queue, runs the filters of the primary sink
+// once and hands the resources to the ResourceWorker of their sinks. When
+// done receives a value the queue is drained, when it is a Drainer, and the
+// sinks deliver their last batches
+func (f *FanOut) ResourceWorker(queue Queue, done <-chan bool, tracer *zipkin.Tracer) {
+	var wg sync.WaitGroup
+	primary := f.Primary()
+	queues := make([]*sinkQueue, len(f.sinks))
+	stops := make([]chan bool, len(f.sinks))
+	index := make(map[string]int, len(f.sinks))
+	for i, sink := range f.sinks {
+		buffer := 0
+		if sink.BestEffort {
+			buffer = f.buffer
+		}
+		index[sink.Name] = i
+		queues[i] = &sinkQueue{
+			name:       sink.Name,
+			source:     queue,
+			bestEffort: sink.BestEffort,
+			metrics:    f.metrics,
+			output:     make(chan logging.Resource, buffer),
+		}
+		var q Queue = queues[i]
+		if _, ok := queue.(Acknowledger); ok && !sink.BestEffort {
+			q = &ackingSinkQueue{queues[i]}
+		}
+		stops[i] = make(chan bool)
+		wg.Add(1)
+		go func(deliverer *Deliverer, q Queue, stop <-chan bool) {
+			defer wg.Done()
+			deliverer.ResourceWorker(q, stop, tracer)
+		}(sink.Deliverer, q, stops[i])
+	}
+
+	targets := func(resource logging.Resource) []*sinkQueue {
+		if f.router == nil {
+			return queues
+		}
+		route, sinks := f.router.Route(resource)
+		if f.metrics != nil {
+			f.metrics.IncRouted(route)
+		}
+		selected := make([]*sinkQueue, 0, len(sinks))
+		for _, name := range sinks {
+			selected = append(selected, queues[index[name]])
+		}
+		return selected
+	}
+
+	dispatch := func(ctx context.Context, resource logging.Resource) {
+		if resource.ApplicationVersion == "" {
+			resource.ApplicationVersion = primary.buildVersion
+		}
+		if drop := primary.processFilters(ctx, &resource); drop {
+			ack(queue, resource)
+			return
+		}
+		selected := targets(resource)
+		var reliable int32
+		for _, q := range selected {
+			if !q.bestEffort {
+				reliable++
+			}
+		}
+		if reliable == 0 {
+			ack(queue, resource)
+		} else if reliable > 1 {
+			meta := make(map[string]interface{}, len(resource.Meta)+1)
+			for k, v := range resource.Meta {
+				meta[k] = v
+			}
+			pending := &atomic.Int32{}
+			pending.Store(reliable)
+			meta[fanOutMetaPending] = pending
+			resource.Meta = meta
+		}
+		for _, q := range selected {
+			if !q.bestEffort {
+				q.output <- resource
+				continue
+			}
+			select {
+			case q.output <- resource:
+			default:
+				q.drop(resource, "overflow")
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Starting fan-out to %d sinks...\n", len(f.sinks))
+	resourceChannel := queue.Output()
+	for {
+		ctx := context.Background()
+		select {
+		case resource := <-resourceChannel:
+			dispatch(ctx, resource)
+		case <-done:
+			if drainer, ok := queue.(Drainer); ok {
+				drainer.Drain()
+				for resource := range resourceChannel {
+					dispatch(ctx, resource)
+				}
+			}
+			// The sinks drain their output until it is closed
+			for i := range queues {
+				stops[i] <- true
+				close(queues[i].output)
+			}
+			wg.Wait()
+			fmt.Fprintf(os.Stderr, "Fan-out received done message...\n")
+			return
+		}
+	}
+}
+
+// prefilterer is implemented by queues which hand out filtered resources
+type prefilterer interface {
+	prefiltered() bool
+}
+
+// sinkQueue is the Queue a sink Deliverer consumes. It is fed by the FanOut
+// and hands out resources which were already filtered
+type sinkQueue struct {
+	name       string
+	source     Queue
+	bestEffort bool
+	metrics    Metrics
+	output     chan logging.Resource
+}
+
+var _ Drainer = &sinkQueue{}
+
+func (s *sinkQueue) Start() (chan bool, error) {
+	return nil, errSinkQueue
+}
+
+func (s *sinkQueue) Output() <-chan logging.Resource {
+	return s.output
+}
+
+func (s *sinkQueue) Push(_ []byte) error {
+	return errSinkQueue
+}
+
+// DeadLetter stores rejected resources of reliable sinks together with the
+// name of the sink, so they are replayed to it. Resources rejected by a best
+// effort sink are dropped
+func (s *sinkQueue) DeadLetter(msg logging.Resource) error {
+	if !s.bestEffort {
+		if msg.Error != nil {
+			msg.Error = fmt.Errorf("sink %s: %w", s.name, msg.Error)
+		}
+		// The sinks share the Meta of a resource
+		msg.Meta = maps.Clone(msg.Meta)
+		setMeta(&msg, deadLetterMetaSink, s.name)
+		return s.source.DeadLetter(msg)
+	}
+	s.drop(msg, "rejected")
+	return nil
+}
+
+func (s *sinkQueue) SetMetrics(_ Metrics) {
+}
+
+func (s *sinkQueue) SetDeadLetterStore(_ DeadLetterStore) {
+}
+
+func (s *sinkQueue) Stats() Stats {
+	return s.source.Stats()
+}
+
+// Drain is a no-op, the FanOut closes the output once the queue is drained
+func (s *sinkQueue) Drain() {
+}
+
+func (s *sinkQueue) drop(msg logging.Resource, reason string) {
+	if s.metrics != nil {
+		s.metrics.IncSinkDropped(s.name, reason)
+	}
+	if msg.Error != nil {
+		fmt.Fprintf(os.Stderr, "sink %s dropped resource %s: %v\n", s.name, msg.ID, msg.Error)
+	}
+}
+
+// prefiltered tells the Deliverer the FanOut already ran the filters
+func (s *sinkQueue) prefiltered() bool {
+	return true
+}
+
+// ackingSinkQueue passes the acknowledgements of a reliable sink on to the
+// queue. Resources handed to several reliable sinks are acknowledged by the
+// last one which handles them. A resource any of them gave up on is requeued
+// once and never acknowledged
+type ackingSinkQueue struct {
+	*sinkQueue
+}
+
+var _ Acknowledger = &ackingSinkQueue{}
+
+// requeuedPending marks the pending counter of a requeued resource, later
+// acknowledgements leave it negative
+const requeuedPending = math.MinInt32 / 2
+
+func (a *ackingSinkQueue) Ack(resources ...logging.Resource) error {
+	handled := make([]logging.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if pending, ok := resource.Meta[fanOutMetaPending].(*atomic.Int32); ok && pending.Add(-1) != 0 {
+			continue
+		}
+		handled = append(handled, resource)
+	}
+	if len(handled) == 0 {
+		return nil
+	}
+	return a.source.(Acknowledger).Ack(handled...)
+}
+
+func (a *ackingSinkQueue) Requeue(resources ...logging.Resource) error {
+	requeued := make([]logging.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if pending, ok := resource.Meta[fanOutMetaPending].(*atomic.Int32); ok && pending.Swap(requeuedPending) <= 0 {
+			continue
+		}
+		requeued = append(requeued, resource)
+	}
+	if len(requeued) == 0 {
+		return nil
+	}
+	return a.source.(Acknowledger).Requeue(requeued...)
+}
@@ -0,0 +1,304 @@
+package queue_test
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+type sinkMetrics struct {
+	nilMetrics
+	mu      sync.Mutex
+	dropped map[string]int
+}
+
+func (s *sinkMetrics) IncSinkDropped(sink, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped == nil {
+		s.dropped = make(map[string]int)
+	}
+	s.dropped[sink+"/"+reason]++
+}
+
+func (s *sinkMetrics) Dropped() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := make(map[string]int, len(s.dropped))
+	for k, v := range s.dropped {
+		dropped[k] = v
+	}
+	return dropped
+}
+
+// stalledStorer blocks until it is released
+type stalledStorer struct {
+	release chan struct{}
+	countingStorer
+}
+
+func (s *stalledStorer) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	<-s.release
+	return s.countingStorer.StoreResources(msgs, count)
+}
+
+func (c *countingStorer) Stored() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stored
+}
+
+// rejectAllStorer rejects every resource
+type rejectAllStorer struct{}
+
+func (rejectAllStorer) StoreResources(_ []logging.Resource, _ int) (*logging.StoreResponse, error) {
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusBadRequest}}, logging.ErrBatchErrors
+}
+
+func newSink(t *testing.T, name string, storer logging.Storer, opts ...queue.DelivererOption) queue.Sink {
+	return queue.Sink{Name: name, Deliverer: newDeliverer(t, storer, opts...)}
+}
+
+func bestEffortSink(t *testing.T, name string, storer logging.Storer, opts ...queue.DelivererOption) queue.Sink {
+	return queue.Sink{Name: name, Deliverer: newDeliverer(t, storer, opts...), BestEffort: true}
+}
+
+func newDeliverer(t *testing.T, storer logging.Storer, opts ...queue.DelivererOption) *queue.Deliverer {
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{}, opts...)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return deliverer
+}
+
+func TestNewFanOut(t *testing.T) {
+	_, err := queue.NewFanOut(nil, &nilMetrics{})
+	assert.NotNil(t, err)
+	_, err = queue.NewFanOut([]queue.Sink{{Name: "hsdp"}}, &nilMetrics{})
+	assert.NotNil(t, err)
+	sink := newSink(t, "hsdp", &countingStorer{})
+	_, err = queue.NewFanOut([]queue.Sink{sink, sink}, &nilMetrics{})
+	assert.NotNil(t, err)
+	_, err = queue.NewFanOut([]queue.Sink{sink}, &nilMetrics{}, queue.WithSinkBuffer(0))
+	assert.NotNil(t, err)
+
+	fanOut, err := queue.NewFanOut([]queue.Sink{sink}, &nilMetrics{})
+	assert.Nil(t, err)
+	assert.Equal(t, sink.Deliverer, fanOut.Primary())
+}
+
+func TestFanOut(t *testing.T) {
+	primary := &countingStorer{}
+	secondary := &countingStorer{}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary, queue.WithMaxBatchCount(10)),
+		bestEffortSink(t, "file", secondary, queue.WithMaxBatchCount(3)),
+	}, &nilMetrics{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+
+	// Both sinks receive everything, each with its own batching
+	doneWorker <- true
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fan-out did not stop")
+	}
+	assert.Equal(t, 30, primary.Stored())
+	assert.Equal(t, 30, secondary.Stored())
+	assert.Equal(t, []int{10, 10, 10}, primary.Batches())
+	for _, batch := range secondary.Batches() {
+		assert.LessOrEqual(t, batch, 3)
+	}
+	done <- true
+}
+
+func TestFanOutSlowSecondary(t *testing.T) {
+	primary := &countingStorer{}
+	secondary := &stalledStorer{release: make(chan struct{})}
+	m := &sinkMetrics{}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary, queue.WithMaxBatchCount(5), queue.WithMaxLinger(10*time.Millisecond)),
+		bestEffortSink(t, "webhook", secondary, queue.WithMaxBatchCount(1)),
+	}, m, queue.WithSinkBuffer(2))
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+
+	// The stalled secondary doesn't hold up the primary
+	assert.Eventually(t, func() bool {
+		return primary.Stored() == 20
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Greater(t, m.Dropped()["webhook/overflow"], 0)
+	assert.Zero(t, m.Dropped()["hsdp/overflow"])
+
+	close(secondary.release)
+	doneWorker <- true
+	<-stopped
+	assert.Equal(t, 20, secondary.Stored()+m.Dropped()["webhook/overflow"])
+	done <- true
+}
+
+func TestFanOutSecondaryRejects(t *testing.T) {
+	primary := &countingStorer{}
+	m := &sinkMetrics{}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary),
+		bestEffortSink(t, "elasticsearch", rejectAllStorer{}),
+	}, m)
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	q.SetDeadLetterStore(store)
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	doneWorker <- true
+	<-stopped
+
+	// Rejections of a secondary sink are not dead lettered
+	assert.Equal(t, 4, primary.Stored())
+	assert.Equal(t, 4, m.Dropped()["elasticsearch/rejected"])
+	letters, _ := store.Load()
+	assert.Empty(t, letters)
+	done <- true
+}
+
+func TestFanOutNilMetrics(t *testing.T) {
+	primary := &countingStorer{}
+	router, _ := queue.NewRouter(queue.RoutingConfig{Default: []string{"hsdp", "elasticsearch"}})
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary),
+		bestEffortSink(t, "elasticsearch", rejectAllStorer{}),
+	}, nil, queue.WithRouter(router))
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	doneWorker <- true
+	<-stopped
+
+	// Routing and drops are not counted without metrics
+	assert.Equal(t, 2, primary.Stored())
+	done <- true
+}
+
+func TestFanOutRequeue(t *testing.T) {
+	primary := &countingStorer{}
+	opts := []queue.DelivererOption{queue.WithMaxRetries(0), queue.WithCircuitBreaker(0, time.Second)}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary, opts...),
+		newSink(t, "elasticsearch", &failingStorer{failures: 100}, opts...),
+	}, &nilMetrics{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	channel, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	q := &ackingQueue{Queue: channel, acked: map[string]int{}, requeued: map[string]int{}}
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(q.Requeued()) == 4 && primary.Stored() == 4
+	}, 2*time.Second, 5*time.Millisecond)
+	doneWorker <- true
+	<-stopped
+
+	// The resources were requeued once and never acknowledged, although
+	// the primary sink stored them
+	assert.Empty(t, q.Acked())
+	for _, count := range q.Requeued() {
+		assert.Equal(t, 1, count)
+	}
+	done <- true
+}
+
+func TestFanOutReliableSecondaryRejects(t *testing.T) {
+	primary := &countingStorer{}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary),
+		newSink(t, "elasticsearch", rejectAllStorer{}),
+	}, &nilMetrics{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	q, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	q.SetDeadLetterStore(store)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	stopped := make(chan struct{})
+	go func() {
+		fanOut.ResourceWorker(q, doneWorker, nil)
+		close(stopped)
+	}()
+	doneWorker <- true
+	<-stopped
+
+	// Dead letters of a reliable sink name it, so they are replayed to it
+	assert.Equal(t, 2, primary.Stored())
+	letters, _ := store.Load()
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "elasticsearch", letters[0].Sink)
+	}
+	done <- true
+}
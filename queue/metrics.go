@@ -1,9 +1,18 @@
 package queue
 
+import "time"
+
 type Metrics interface {
 	IncProcessed()
 	IncEnhancedTransactionID()
 	IncEnhancedEncodedMessage()
 	IncPluginDropped()
 	IncPluginModified()
+	IncQueueOverflow(outcome string)
+	IncParseFailed()
+	ObserveBatch(count int, age time.Duration)
+	SetBatchesInFlight(batches int)
+	IncPartialFailure(outcome string, resources int)
+	IncSinkDropped(sink, reason string)
+	IncRouted(route string)
 }
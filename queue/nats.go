@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	natsMetaMsg = "nats.msg"
+
+	defaultNATSStream  = "LOGPROXY"
+	defaultNATSSubject = "logproxy.rfc5424"
+	defaultNATSDurable = "logproxy"
+	defaultNATSAckWait = time.Minute
+)
+
+// NATSConfig configures a NATS JetStream queue
+type NATSConfig struct {
+	// URL of the NATS server, defaults to nats://127.0.0.1:4222
+	URL string
+	// Stream is the JetStream stream name, defaults to LOGPROXY
+	Stream string
+	// Subject messages are published on, defaults to logproxy.rfc5424
+	Subject string
+	// Durable is the name of the pull consumer shared by all instances, defaults to logproxy
+	Durable string
+	// AckWait is how long a delivered message may stay unacknowledged
+	// before it is delivered again, defaults to 1m
+	AckWait time.Duration
+	// MaxBytes limits the size of the stream, new messages are rejected beyond
+	// this. Zero means unlimited
+	MaxBytes int64
+	// MaxAge discards messages older than this. Zero means no limit
+	MaxAge time.Duration
+	// Memory keeps the stream in memory instead of on disk
+	Memory bool
+}
+
+// NATS implements a Queue backed by a NATS JetStream work queue stream and a
+// durable pull consumer. Messages are acknowledged once the Deliverer has
+// handled them. While the Deliverer holds a message its AckWait is extended,
+// messages of a crashed consumer are delivered again after AckWait
+type NATS struct {
+	conn            *nats.Conn
+	js              jetstream.JetStream
+	stream          jetstream.Stream
+	config          NATSConfig
+	resourceChannel chan logging.Resource
+	metrics         Metrics
+	deadLetters     DeadLetterStore
+
+	mu           sync.Mutex
+	pushes       int64
+	pops         int64
+	deadLettered int64
+	inFlight     map[jetstream.Msg]struct{}
+}
+
+var _ Queue = &NATS{}
+var _ Acknowledger = &NATS{}
+
+func (n *NATS) SetMetrics(m Metrics) {
+	n.metrics = m
+}
+
+func (n *NATS) SetDeadLetterStore(s DeadLetterStore) {
+	n.deadLetters = s
+}
+
+// NewNATSQueue returns a NATS JetStream queue and creates or updates its
+// stream. When conn is nil a connection to config.URL is made
+func NewNATSQueue(conn *nats.Conn, config NATSConfig, opts ...OptionFunc) (*NATS, error) {
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+	if config.Stream == "" {
+		config.Stream = defaultNATSStream
+	}
+	if config.Subject == "" {
+		config.Subject = defaultNATSSubject
+	}
+	if config.Durable == "" {
+		config.Durable = defaultNATSDurable
+	}
+	if config.AckWait <= 0 {
+		config.AckWait = defaultNATSAckWait
+	}
+	if config.MaxBytes < 0 {
+		return nil, fmt.Errorf("invalid NATS max bytes: %d", config.MaxBytes)
+	}
+	n := &NATS{
+		config:          config,
+		resourceChannel: make(chan logging.Resource),
+		inFlight:        make(map[jetstream.Msg]struct{}),
+	}
+	for _, o := range opts {
+		if err := o(n); err != nil {
+			return nil, err
+		}
+	}
+	if conn == nil {
+		var err error
+		conn, err = nats.Connect(config.URL, nats.Name("logproxy"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, fmt.Errorf("NATS connect error: %w", err)
+		}
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("JetStream error: %w", err)
+	}
+	streamConfig := jetstream.StreamConfig{
+		Name:      config.Stream,
+		Subjects:  []string{config.Subject},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+		MaxBytes:  -1,
+		MaxAge:    config.MaxAge,
+		Discard:   jetstream.DiscardNew,
+	}
+	if config.MaxBytes > 0 {
+		streamConfig.MaxBytes = config.MaxBytes
+	}
+	if config.Memory {
+		streamConfig.Storage = jetstream.MemoryStorage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.CreateOrUpdateStream(ctx, streamConfig)
+	if err != nil {
+		return nil, fmt.Errorf("JetStream stream error: %w", err)
+	}
+	n.conn = conn
+	n.js = js
+	n.stream = stream
+	return n, nil
+}
+
+func (n *NATS) Output() <-chan logging.Resource {
+	return n.resourceChannel
+}
+
+func (n *NATS) Push(raw []byte) error {
+	if _, err := n.js.Publish(context.Background(), n.config.Subject, raw); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.pushes++
+	n.mu.Unlock()
+	if n.metrics != nil {
+		n.metrics.IncProcessed()
+	}
+	return nil
+}
+
+// Start creates or updates the durable consumer and starts consuming. The
+// consumer stops when the returned channel receives a value
+func (n *NATS) Start() (chan bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	consumer, err := n.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       n.config.Durable,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       n.config.AckWait,
+		FilterSubject: n.config.Subject,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("JetStream consumer error: %w", err)
+	}
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(batchSize))
+	if err != nil {
+		return nil, fmt.Errorf("JetStream consume error: %w", err)
+	}
+	doneChannel := make(chan bool)
+	stop := make(chan struct{})
+	go func() {
+		<-doneChannel
+		close(stop)
+		messages.Stop()
+	}()
+	go n.consume(messages, stop)
+	go n.extend(stop)
+	return doneChannel, nil
+}
+
+// extend keeps the server from delivering the messages held by the Deliverer
+// again while it is still retrying them
+func (n *NATS) extend(stop <-chan struct{}) {
+	ticker := time.NewTicker(n.config.AckWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		n.mu.Lock()
+		held := make([]jetstream.Msg, 0, len(n.inFlight))
+		for msg := range n.inFlight {
+			held = append(held, msg)
+		}
+		n.mu.Unlock()
+		for _, msg := range held {
+			if err := msg.InProgress(); err != nil {
+				fmt.Fprintf(os.Stderr, "NATS in progress error: %v\n", err)
+			}
+		}
+	}
+}
+
+// track keeps a message in flight until it is acknowledged or requeued
+func (n *NATS) track(msg jetstream.Msg, inFlight bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if inFlight {
+		n.inFlight[msg] = struct{}{}
+		return
+	}
+	delete(n.inFlight, msg)
+}
+
+func (n *NATS) consume(messages jetstream.MessagesContext, stop <-chan struct{}) {
+	for {
+		msg, err := messages.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NATS queue: read error: %v\n", err)
+			continue
+		}
+		resource, stored, err := ParseStage(msg.Data(), n.metrics, n.deadLetters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing syslog message: %v\n", err)
+			if stored {
+				n.mu.Lock()
+				n.deadLettered++
+				n.mu.Unlock()
+			}
+			_ = n.ack(msg)
+			continue
+		}
+		setMeta(resource, natsMetaMsg, msg)
+		n.track(msg, true)
+		select {
+		case n.resourceChannel <- *resource:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Ack acknowledges the messages of handled resources
+func (n *NATS) Ack(resources ...logging.Resource) error {
+	var errs []error
+	for _, resource := range resources {
+		if msg, ok := resource.Meta[natsMetaMsg].(jetstream.Msg); ok {
+			if err := n.ack(msg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Requeue asks the server to deliver the messages of resources the Deliverer
+// gave up on again right away
+func (n *NATS) Requeue(resources ...logging.Resource) error {
+	var errs []error
+	for _, resource := range resources {
+		if msg, ok := resource.Meta[natsMetaMsg].(jetstream.Msg); ok {
+			n.track(msg, false)
+			if err := msg.Nak(); err != nil {
+				errs = append(errs, fmt.Errorf("NATS nak error: %w", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ack waits for the server to confirm the acknowledgement, so a message
+// counted as popped is no longer in the stream
+func (n *NATS) ack(msg jetstream.Msg) error {
+	n.track(msg, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := msg.DoubleAck(ctx); err != nil {
+		return fmt.Errorf("NATS ack error: %w", err)
+	}
+	n.mu.Lock()
+	n.pops++
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *NATS) Stats() Stats {
+	n.mu.Lock()
+	stats := Stats{
+		Pushes:      n.pushes,
+		Pops:        n.pops,
+		DeadLetters: n.deadLettered,
+	}
+	n.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	info, err := n.stream.Info(ctx)
+	if err != nil {
+		return stats
+	}
+	stats.Depth = int64(info.State.Msgs)
+	stats.Bytes = int64(info.State.Bytes)
+	if info.Config.MaxBytes > 0 {
+		stats.MaxBytes = info.Config.MaxBytes
+	}
+	if info.State.Msgs > 0 && !info.State.FirstTime.IsZero() {
+		stats.OldestAge = time.Since(info.State.FirstTime)
+	}
+	return stats
+}
+
+func (n *NATS) DeadLetter(msg logging.Resource) error {
+	n.mu.Lock()
+	n.deadLettered++
+	n.mu.Unlock()
+	if n.deadLetters == nil {
+		return nil
+	}
+	return n.deadLetters.Store(NewDeadLetter(msg))
+}
@@ -0,0 +1,129 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func runJetStream(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newNATSQueue(t *testing.T, s *server.Server) *queue.NATS {
+	q, err := queue.NewNATSQueue(nil, queue.NATSConfig{
+		URL:     s.ClientURL(),
+		AckWait: 100 * time.Millisecond,
+	}, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return q
+}
+
+func TestNATSQueue(t *testing.T) {
+	s := runJetStream(t)
+	q := newNATSQueue(t, s)
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Nil(t, q.Push([]byte("not syslog")))
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+
+	done, err := q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	first := receiveResource(t, q)
+	second := receiveResource(t, q)
+	assert.Equal(t, "2018-09-07T15:39:21.132Z", first.LogTime)
+
+	stats := q.Stats()
+	assert.Equal(t, int64(3), stats.Pushes)
+	assert.Equal(t, int64(2), stats.Depth)
+	assert.Greater(t, stats.OldestAge, time.Duration(0))
+
+	assert.Nil(t, q.Ack(first, second))
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 0 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(3), q.Stats().Pops)
+	done <- true
+}
+
+func TestNATSQueueRedelivery(t *testing.T) {
+	s := runJetStream(t)
+	crashed := newNATSQueue(t, s)
+	done, err := crashed.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, crashed.Push([]byte(rawMessage)))
+	lost := receiveResource(t, crashed)
+	done <- true
+
+	// The message was never acknowledged so the durable consumer delivers it again
+	q := newNATSQueue(t, s)
+	done, err = q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	redelivered := receiveResource(t, q)
+	assert.Equal(t, lost.LogTime, redelivered.LogTime)
+	if msg, ok := redelivered.Meta["nats.msg"].(jetstream.Msg); assert.True(t, ok) {
+		metadata, err := msg.Metadata()
+		if assert.Nil(t, err) {
+			assert.Equal(t, uint64(2), metadata.NumDelivered)
+		}
+	}
+	assert.Nil(t, q.Ack(redelivered))
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 0 }, 2*time.Second, 10*time.Millisecond)
+	done <- true
+}
+
+func TestNATSQueueRequeue(t *testing.T) {
+	s := runJetStream(t)
+	q := newNATSQueue(t, s)
+	done, err := q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	held := receiveResource(t, q)
+
+	// A message held by the Deliverer isn't delivered again after AckWait
+	select {
+	case resource := <-q.Output():
+		t.Fatalf("unexpected redelivery of %s", resource.ID)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	assert.Nil(t, q.Requeue(held))
+	requeued := receiveResource(t, q)
+	if msg, ok := requeued.Meta["nats.msg"].(jetstream.Msg); assert.True(t, ok) {
+		metadata, err := msg.Metadata()
+		if assert.Nil(t, err) {
+			assert.Equal(t, uint64(2), metadata.NumDelivered)
+		}
+	}
+	assert.Nil(t, q.Ack(requeued))
+	assert.Eventually(t, func() bool { return q.Stats().Depth == 0 }, 2*time.Second, 10*time.Millisecond)
+	done <- true
+}
@@ -8,3 +8,10 @@ func WithMetrics(m Metrics) OptionFunc {
 		return nil
 	}
 }
+
+func WithDeadLetterStore(s DeadLetterStore) OptionFunc {
+	return func(t Queue) error {
+		t.SetDeadLetterStore(s)
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package queue
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+)
+
+var (
+	rawSeverityPattern = regexp.MustCompile(`"(?:sev|severity)"\s*:\s*"([^"]*)"`)
+	rawPriorityPattern = regexp.MustCompile(`^<(\d{1,3})>`)
+
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+type nopMetrics struct{}
+
+func (n nopMetrics) IncProcessed()                       {}
+func (n nopMetrics) IncEnhancedTransactionID()           {}
+func (n nopMetrics) IncEnhancedEncodedMessage()          {}
+func (n nopMetrics) IncPluginDropped()                   {}
+func (n nopMetrics) IncPluginModified()                  {}
+func (n nopMetrics) IncQueueOverflow(_ string)           {}
+func (n nopMetrics) IncParseFailed()                     {}
+func (n nopMetrics) ObserveBatch(_ int, _ time.Duration) {}
+func (n nopMetrics) SetBatchesInFlight(_ int)            {}
+func (n nopMetrics) IncPartialFailure(_ string, _ int)   {}
+func (n nopMetrics) IncSinkDropped(_, _ string)          {}
+func (n nopMetrics) IncRouted(_ string)                  {}
+
+// ParseStage is the pipeline step which turns a raw payload into a
+// logging.Resource. Queues only transport raw payloads and run this stage
+// when a message is taken from the queue, so every backend accounts for
+// parse failures the same way: they are counted and the original raw
+// payload is stored in the dead letter store, when one is configured.
+// The returned bool reports whether a dead letter was stored
+func ParseStage(raw []byte, m Metrics, store DeadLetterStore) (*logging.Resource, bool, error) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	resource, err := BodyToResource(raw, m)
+	if err == nil {
+		return resource, false, nil
+	}
+	m.IncParseFailed()
+	if store == nil {
+		return nil, false, err
+	}
+	if storeErr := store.Store(NewRawDeadLetter(raw, err)); storeErr != nil {
+		return nil, false, err
+	}
+	return nil, true, err
+}
+
+// RawSeverity extracts the severity of a raw payload without parsing it
+// completely. The severity field of a structured message is preferred,
+// otherwise the severity is derived from the syslog priority
+func RawSeverity(raw []byte) string {
+	if match := rawSeverityPattern.FindSubmatch(raw); match != nil {
+		return string(match[1])
+	}
+	if match := rawPriorityPattern.FindSubmatch(raw); match != nil {
+		if priority, err := strconv.Atoi(string(match[1])); err == nil {
+			return syslogSeverities[priority%8]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package queue_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parseMetrics struct {
+	nilMetrics
+	failed int
+}
+
+func (p *parseMetrics) IncParseFailed() {
+	p.failed++
+}
+
+func TestParseStage(t *testing.T) {
+	m := &parseMetrics{}
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+
+	resource, stored, err := queue.ParseStage([]byte(rawMessage), m, store)
+	assert.Nil(t, err)
+	assert.False(t, stored)
+	if assert.NotNil(t, resource) {
+		assert.Equal(t, "2018-09-07T15:39:21.132Z", resource.LogTime)
+	}
+
+	resource, stored, err = queue.ParseStage([]byte("not syslog"), m, store)
+	assert.NotNil(t, err)
+	assert.True(t, stored)
+	assert.Nil(t, resource)
+	assert.Equal(t, 1, m.failed)
+
+	_, stored, err = queue.ParseStage([]byte("not syslog"), nil, nil)
+	assert.NotNil(t, err)
+	assert.False(t, stored)
+
+	letters, err := store.Load()
+	assert.Nil(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "not syslog", letters[0].Raw)
+		assert.NotEmpty(t, letters[0].Reason)
+	}
+}
+
+func TestParseFailuresAreDeadLettered(t *testing.T) {
+	m := &parseMetrics{}
+	channelStore, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "channel.ndjson"))
+	diskStore, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "disk.ndjson"))
+
+	channel, err := queue.NewChannelQueue(queue.WithMetrics(m), queue.WithDeadLetterStore(channelStore))
+	if !assert.Nil(t, err) {
+		return
+	}
+	disk, err := queue.NewDiskQueue(queue.DiskConfig{Dir: t.TempDir()}, queue.WithMetrics(m), queue.WithDeadLetterStore(diskStore))
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, q := range []queue.Queue{channel, disk} {
+		done, _ := q.Start()
+		assert.Nil(t, q.Push([]byte("not syslog")))
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+		receive(t, q)
+		assert.Eventually(t, func() bool { return q.Stats().DeadLetters == 1 }, time.Second, time.Millisecond)
+		done <- true
+	}
+	assert.Equal(t, 2, m.failed)
+	for _, store := range []queue.DeadLetterStore{channelStore, diskStore} {
+		letters, _ := store.Load()
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, "not syslog", letters[0].Raw)
+		}
+	}
+}
+
+func TestRawSeverity(t *testing.T) {
+	assert.Equal(t, "info", queue.RawSeverity([]byte(rawMessage)))
+	assert.Equal(t, "ERROR", queue.RawSeverity(messageWithSeverity("ERROR")))
+	assert.Equal(t, "err", queue.RawSeverity([]byte("<11>1 - - - - - - plain text")))
+	assert.Equal(t, "", queue.RawSeverity([]byte("not syslog")))
+}
@@ -1,9 +1,31 @@
 package queue
 
 import (
+	"time"
+
 	"github.com/dip-software/go-dip-api/logging"
 )
 
+// Stats describes the state of a Queue
+type Stats struct {
+	// Depth is the number of messages waiting to be delivered
+	Depth int64
+	// OldestAge is the time the oldest waiting message has been queued
+	OldestAge time.Duration
+	// Capacity is the maximum Depth, zero when the queue is not bounded by message count
+	Capacity int64
+	// Bytes is the storage used by waiting messages, when known
+	Bytes int64
+	// MaxBytes is the maximum of Bytes, zero when the queue is not bounded by size
+	MaxBytes int64
+	// Pushes is the number of messages accepted by Push
+	Pushes int64
+	// Pops is the number of messages handed to the Deliverer
+	Pops int64
+	// DeadLetters is the number of resources passed to DeadLetter
+	DeadLetters int64
+}
+
 // Queue implements a queue mechanism. The queue can be
 // backed by e.g. RabbitMQ or a simple Go channel. Both
 // of these are provided as part of logproxy.
@@ -21,4 +43,64 @@ type Queue interface {
 	DeadLetter(msg logging.Resource) error
 	// Set metrics
 	SetMetrics(m Metrics)
+	// Set the store used by DeadLetter
+	SetDeadLetterStore(s DeadLetterStore)
+	// Stats returns the current queue statistics
+	Stats() Stats
+}
+
+// Acknowledger is implemented by queues which keep a message until the
+// Deliverer has handled it. Resources are handled once they are stored,
+// dead lettered or dropped by a filter. Resources the Deliverer gave up on
+// are passed to Requeue so the queue delivers them again
+type Acknowledger interface {
+	Ack(resources ...logging.Resource) error
+	Requeue(resources ...logging.Resource) error
+}
+
+// setMeta adds a key to the Meta of resource, keeping the keys set by the
+// parse stage and plugins
+func setMeta(resource *logging.Resource, key string, value interface{}) {
+	if resource.Meta == nil {
+		resource.Meta = make(map[string]interface{})
+	}
+	resource.Meta[key] = value
+}
+
+// ConnectionState is the state of the connection to a broker
+type ConnectionState string
+
+const (
+	StateConnected    ConnectionState = "connected"
+	StateConnecting   ConnectionState = "connecting"
+	StateDisconnected ConnectionState = "disconnected"
+)
+
+// ConnectionStatus reports the connections of a broker backed queue
+type ConnectionStatus struct {
+	Producer ConnectionState `json:"producer"`
+	Consumer ConnectionState `json:"consumer"`
+	// Reconnects is the number of successful reconnects
+	Reconnects int64 `json:"reconnects"`
+	// Spilled is the number of messages buffered locally while the broker is unavailable
+	Spilled int64 `json:"spilled"`
+	// SpillDropped is the number of messages rejected because the spill buffer was full
+	SpillDropped int64 `json:"spillDropped"`
+}
+
+// Connected reports whether both producer and consumer are connected
+func (s ConnectionStatus) Connected() bool {
+	return s.Producer == StateConnected && s.Consumer == StateConnected
+}
+
+// Connector is implemented by queues which depend on a connection to a broker
+type Connector interface {
+	ConnectionStatus() ConnectionStatus
+}
+
+// Drainer is implemented by queues which hold messages that would be lost
+// when the queue stops. Drain stops taking in new messages and closes the
+// Output channel once every held message was handed out
+type Drainer interface {
+	Drain()
 }
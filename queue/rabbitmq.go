@@ -3,6 +3,9 @@ package queue
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/dip-software/go-dip-api/logging"
 	"github.com/loafoe/go-rabbitmq"
@@ -13,20 +16,81 @@ var (
 	Exchange           = "logproxy"
 	RoutingKey         = "new.rfc5424"
 	ErrInvalidProducer = errors.New("RabbitMQ producer is nil or invalid")
+	ErrNotConnected    = errors.New("not connected to RabbitMQ")
 )
 
+const rabbitMQMetaDelivery = "amqp.delivery"
+
 // RabbitMQ implements Queue backed by RabbitMQ
 type RabbitMQ struct {
 	producer        rabbitmq.Producer
+	config          RabbitMQConfig
 	resourceChannel chan logging.Resource
 	metrics         Metrics
+	deadLetters     DeadLetterStore
+
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	mu            sync.Mutex
+	inspector     AMQPInspector
+	consumer      *amqp.Channel
+	unacked       map[deliveryKey]amqp.Delivery
+	pushes        int64
+	pops          int64
+	deadLettered  int64
+	head          time.Time
+	consumerState ConnectionState
+	reconnects    int64
+
+	// publishMu serializes publishing so spilled messages keep their order
+	publishMu    sync.Mutex
+	spill        [][]byte
+	spillDropped int64
+}
+
+// deliveryKey identifies a delivery. Delivery tags are only unique per channel
+type deliveryKey struct {
+	channel amqp.Acknowledger
+	tag     uint64
+}
+
+func keyOf(d amqp.Delivery) deliveryKey {
+	return deliveryKey{channel: d.Acknowledger, tag: d.DeliveryTag}
+}
+
+// AMQPInspector is the subset of *amqp.Channel used to look up the queue depth
+type AMQPInspector interface {
+	QueueInspect(name string) (amqp.Queue, error)
 }
 
 func (r *RabbitMQ) SetMetrics(m Metrics) {
 	r.metrics = m
 }
 
+func (r *RabbitMQ) SetDeadLetterStore(s DeadLetterStore) {
+	r.deadLetters = s
+}
+
 var _ Queue = &RabbitMQ{}
+var _ Connector = &RabbitMQ{}
+var _ Acknowledger = &RabbitMQ{}
+var _ Drainer = &RabbitMQ{}
+
+// WithRabbitMQConfig sets the connection and topology of a RabbitMQ queue
+func WithRabbitMQConfig(config RabbitMQConfig) OptionFunc {
+	return func(q Queue) error {
+		r, ok := q.(*RabbitMQ)
+		if !ok {
+			return fmt.Errorf("RabbitMQ config is not supported by %T", q)
+		}
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		r.config = config
+		return nil
+	}
+}
 
 func consumerTag() string {
 	return "logproxy"
@@ -37,39 +101,133 @@ func RFC5424QueueName() string {
 	return "logproxy_rfc5424"
 }
 
-func setupProducer() (rabbitmq.Producer, error) {
-	producer, err := rabbitmq.NewProducer(rabbitmq.Config{
-		Exchange:     Exchange,
-		ExchangeType: "topic",
-		Durable:      false,
-	})
-	if err != nil {
-		return nil, err
+// amqpProducer publishes on a channel of its own connection and reconnects
+// with backoff when the broker closes the connection
+type amqpProducer struct {
+	config    RabbitMQConfig
+	connected func()
+
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	channel    *amqp.Channel
+	state      ConnectionState
+	reconnects int64
+	closed     bool
+}
+
+func (p *amqpProducer) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != StateConnected {
+		return ErrNotConnected
+	}
+	if err := p.channel.Publish(exchange, routingKey, false, false, msg); err != nil {
+		return fmt.Errorf("exchange publish error: %w", err)
 	}
-	return producer, nil
+	return nil
 }
 
-func NewRabbitMQQueue(p rabbitmq.Producer, opts ...OptionFunc) (*RabbitMQ, error) {
-	var producer rabbitmq.Producer
-	var err error
-	resourceChannel := make(chan logging.Resource)
-	if p != nil {
-		producer = p
-	} else {
-		producer, err = setupProducer()
+func (p *amqpProducer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		_ = p.conn.Close()
 	}
+}
+
+// connect dials the broker and declares the exchange
+func (p *amqpProducer) connect() error {
+	conn, err := p.config.Dial()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("channel error: %w", err)
+	}
+	if err := channel.ExchangeDeclare(p.config.Exchange, "topic", true, false, false, false, nil); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("exchange declare error: %w", err)
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	p.mu.Lock()
+	p.conn, p.channel, p.state = conn, channel, StateConnected
+	p.mu.Unlock()
+	go p.watch(conn, connClosed, channelClosed)
+	return nil
+}
+
+// watch reconnects once the connection or the channel is closed by the broker
+func (p *amqpProducer) watch(conn *amqp.Connection, connClosed, channelClosed <-chan *amqp.Error) {
+	var err *amqp.Error
+	select {
+	case err = <-connClosed:
+	case err = <-channelClosed:
+		_ = conn.Close()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.state = StateConnecting
+	p.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "RabbitMQ producer connection closed: %v\n", err)
+
+	backoff := p.config.backoff()
+	for {
+		time.Sleep(backoff.Next())
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+		if err := p.connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "RabbitMQ producer reconnect error: %v\n", err)
+			continue
+		}
+		p.mu.Lock()
+		p.reconnects++
+		p.mu.Unlock()
+		if p.connected != nil {
+			p.connected()
+		}
+		return
 	}
+}
+
+func (p *amqpProducer) status() (ConnectionState, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state, p.reconnects
+}
+
+func NewRabbitMQQueue(p rabbitmq.Producer, opts ...OptionFunc) (*RabbitMQ, error) {
 	ch := &RabbitMQ{
-		producer:        producer,
-		resourceChannel: resourceChannel,
+		resourceChannel: make(chan logging.Resource),
+		draining:        make(chan struct{}),
+		unacked:         make(map[deliveryKey]amqp.Delivery),
 	}
 	for _, o := range opts {
 		if err := o(ch); err != nil {
 			return nil, err
 		}
 	}
+	ch.config = ch.config.withDefaults()
+	ch.consumerState = StateDisconnected
+	if p != nil {
+		ch.producer = p
+		return ch, nil
+	}
+	producer := &amqpProducer{config: ch.config, connected: ch.drainSpill}
+	if err := producer.connect(); err != nil {
+		return nil, err
+	}
+	ch.producer = producer
 	return ch, nil
 }
 
@@ -77,80 +235,436 @@ func (r *RabbitMQ) Output() <-chan logging.Resource {
 	return r.resourceChannel
 }
 
+// Push publishes raw to the broker. While the broker is unavailable messages
+// are kept in the spill buffer, which is published first once it is back
 func (r *RabbitMQ) Push(raw []byte) error {
 	if r.producer == nil {
 		return ErrInvalidProducer
 	}
-	err := r.producer.Publish(Exchange, RoutingKey, amqp.Publishing{
-		Headers:         amqp.Table{},
-		ContentType:     "application/octet-stream",
-		ContentEncoding: "",
-		Body:            raw,
-		DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-		Priority:        0,              // 0-9
-		// a bunch of application/implementation-specific fields
-	})
+	r.publishMu.Lock()
+	err := r.publishSpill()
+	if err == nil {
+		err = r.publish(raw)
+	}
+	if err != nil {
+		err = r.spillMessage(raw, err)
+	}
+	r.publishMu.Unlock()
 	if err != nil {
 		return err
 	}
+	r.mu.Lock()
+	r.pushes++
+	r.mu.Unlock()
 	if r.metrics != nil {
 		r.metrics.IncProcessed()
 	}
 	return nil
 }
 
-func (r *RabbitMQ) Start() (chan bool, error) {
-	doneChannel := make(chan bool)
-	// Consumer
-	consumer, err := rabbitmq.NewConsumer(rabbitmq.Config{
-		RoutingKey:   RoutingKey,
-		Exchange:     Exchange,
-		ExchangeType: "topic",
-		Durable:      false,
-		AutoDelete:   true,
-		QueueName:    RFC5424QueueName(),
-		CTag:         consumerTag(),
-		HandlerFunc:  RabbitMQRFC5424Worker(r.resourceChannel, doneChannel, r.metrics),
+// spillMessage keeps raw in the spill buffer after publishing failed with
+// err. Must be called with r.publishMu held
+func (r *RabbitMQ) spillMessage(raw []byte, err error) error {
+	if len(r.spill) >= r.config.SpillCapacity {
+		r.mu.Lock()
+		r.spillDropped++
+		r.mu.Unlock()
+		return err
+	}
+	r.spill = append(r.spill, raw)
+	return nil
+}
+
+// publishSpill publishes the spill buffer in order. Must be called with r.publishMu held
+func (r *RabbitMQ) publishSpill() error {
+	for len(r.spill) > 0 {
+		if err := r.publish(r.spill[0]); err != nil {
+			return err
+		}
+		r.spill[0] = nil
+		r.spill = r.spill[1:]
+	}
+	r.spill = nil
+	return nil
+}
+
+// drainSpill publishes the spill buffer after the producer reconnected
+func (r *RabbitMQ) drainSpill() {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	if err := r.publishSpill(); err != nil {
+		fmt.Fprintf(os.Stderr, "RabbitMQ spill buffer error: %v\n", err)
+	}
+}
+
+func (r *RabbitMQ) publish(raw []byte) error {
+	deliveryMode := amqp.Transient
+	if r.config.Durable {
+		deliveryMode = amqp.Persistent
+	}
+	return r.producer.Publish(r.config.Exchange, r.config.RoutingKey, amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentType:     "application/octet-stream",
+		ContentEncoding: "",
+		Body:            raw,
+		DeliveryMode:    deliveryMode, // 1=non-persistent, 2=persistent
+		Priority:        r.config.priority(raw),
+		Timestamp:       time.Now(),
+		// a bunch of application/implementation-specific fields
 	})
+}
+
+func (r *RabbitMQ) Start() (chan bool, error) {
+	r.setConsumerState(StateConnecting)
+	conn, deliveries, err := r.connect()
 	if err != nil {
+		r.setConsumerState(StateDisconnected)
 		return nil, err
 	}
-	if err := consumer.Start(); err != nil {
-		return nil, err
-	}
+	r.setConsumerState(StateConnected)
+	doneChannel := make(chan bool)
+	go r.handle(conn, deliveries, doneChannel)
 	return doneChannel, nil
 }
 
-func ackDelivery(d amqp.Delivery) {
-	err := d.Ack(true)
+// connect declares the topology and starts consuming on a new connection
+func (r *RabbitMQ) connect() (*amqp.Connection, <-chan amqp.Delivery, error) {
+	conn, err := r.config.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := conn.Channel()
 	if err != nil {
-		fmt.Printf("Error Acking delivery: %v\n", err)
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("channel error: %w", err)
+	}
+	if err := r.config.declare(channel); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if r.config.Prefetch > 0 {
+		if err := channel.Qos(r.config.Prefetch, 0, false); err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("error setting qos: %w", err)
+		}
+	}
+	deliveries, err := channel.Consume(r.config.Queue, r.config.ConsumerTag, false, false, false, false, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("queue consume error: %w", err)
+	}
+	r.mu.Lock()
+	r.consumer = channel
+	r.mu.Unlock()
+	// QueueInspect closes the channel on errors so it gets a channel of its own
+	if inspector, err := conn.Channel(); err == nil {
+		r.mu.Lock()
+		r.inspector = inspector
+		r.mu.Unlock()
+	}
+	return conn, deliveries, nil
+}
+
+func (r *RabbitMQ) setConsumerState(state ConnectionState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consumerState = state
+}
+
+// handle runs the worker and reconnects with backoff when the broker closes
+// the connection. Deliveries which were not acknowledged when done receives a
+// value are returned to the queue
+func (r *RabbitMQ) handle(conn *amqp.Connection, deliveries <-chan amqp.Delivery, done <-chan bool) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		stop := make(chan bool)
+		finished := make(chan struct{})
+		go func(deliveries <-chan amqp.Delivery) {
+			rfc5424Worker(r.resourceChannel, stop, r.parse, r.delivered, r.ack)(deliveries, nil)
+			close(finished)
+		}(deliveries)
+		draining := r.draining
+	wait:
+		for {
+			select {
+			case <-done:
+				close(stop)
+				r.close(conn)
+				return
+			case <-draining:
+				// The broker closes deliveries once the consumer is cancelled
+				// and the deliveries it already sent were handed out
+				draining = nil
+				r.cancel()
+			case <-finished:
+				if r.isDraining() {
+					close(r.resourceChannel)
+					<-done
+					r.close(conn)
+					return
+				}
+				fmt.Fprintf(os.Stderr, "RabbitMQ consumer closed\n")
+				break wait
+			case err := <-closed:
+				fmt.Fprintf(os.Stderr, "RabbitMQ consumer connection closed: %v\n", err)
+				break wait
+			}
+		}
+		close(stop)
+		<-finished
+		_ = conn.Close()
+		// The broker returns unacknowledged deliveries to the queue
+		r.forget()
+		r.setConsumerState(StateConnecting)
+		backoff := r.config.backoff()
+		for {
+			select {
+			case <-done:
+				r.setConsumerState(StateDisconnected)
+				return
+			case <-r.draining:
+				close(r.resourceChannel)
+				<-done
+				r.setConsumerState(StateDisconnected)
+				return
+			case <-time.After(backoff.Next()):
+			}
+			var err error
+			if conn, deliveries, err = r.connect(); err == nil {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "RabbitMQ consumer reconnect error: %v\n", err)
+		}
+		r.mu.Lock()
+		r.consumerState = StateConnected
+		r.reconnects++
+		r.mu.Unlock()
+	}
+}
+
+// Drain cancels the consumer. The Output channel is closed once the
+// deliveries received before were handed out
+func (r *RabbitMQ) Drain() {
+	r.drainOnce.Do(func() {
+		close(r.draining)
+	})
+}
+
+func (r *RabbitMQ) isDraining() bool {
+	select {
+	case <-r.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *RabbitMQ) cancel() {
+	r.mu.Lock()
+	consumer := r.consumer
+	r.mu.Unlock()
+	if consumer == nil {
+		return
+	}
+	if err := consumer.Cancel(r.config.ConsumerTag, false); err != nil {
+		fmt.Fprintf(os.Stderr, "RabbitMQ cancel error: %v\n", err)
+	}
+}
+
+// close returns the unacknowledged deliveries to the queue and closes the connection
+func (r *RabbitMQ) close(conn *amqp.Connection) {
+	for _, d := range r.forget() {
+		if err := d.Nack(false, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Error Nacking delivery: %v\n", err)
+		}
 	}
+	_ = conn.Close()
+	r.setConsumerState(StateDisconnected)
+}
+
+// forget drops and returns the deliveries which are not acknowledged yet
+func (r *RabbitMQ) forget() []amqp.Delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unacked := make([]amqp.Delivery, 0, len(r.unacked))
+	for _, d := range r.unacked {
+		unacked = append(unacked, d)
+	}
+	r.unacked = make(map[deliveryKey]amqp.Delivery)
+	return unacked
+}
+
+// Ack acknowledges the deliveries of handled resources. Deliveries received
+// before a reconnect were already returned to the queue by the broker and
+// are skipped
+func (r *RabbitMQ) Ack(resources ...logging.Resource) error {
+	var errs []error
+	for _, resource := range resources {
+		if d, ok := resource.Meta[rabbitMQMetaDelivery].(amqp.Delivery); ok {
+			if err := r.ack(d); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Requeue returns the deliveries of resources the Deliverer gave up on to
+// the queue, so they are delivered again without waiting for a reconnect and
+// don't hold up the prefetch window
+func (r *RabbitMQ) Requeue(resources ...logging.Resource) error {
+	var errs []error
+	for _, resource := range resources {
+		if d, ok := resource.Meta[rabbitMQMetaDelivery].(amqp.Delivery); ok && r.untrack(d) {
+			if err := d.Nack(false, true); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// untrack stops tracking a delivery and reports whether it was tracked
+func (r *RabbitMQ) untrack(d amqp.Delivery) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.unacked[keyOf(d)]
+	delete(r.unacked, keyOf(d))
+	return ok
+}
+
+func (r *RabbitMQ) ack(d amqp.Delivery) error {
+	if !r.untrack(d) {
+		return nil
+	}
+	return d.Ack(false)
+}
+
+// ConnectionStatus reports the producer and consumer connections. A producer
+// passed to NewRabbitMQQueue is assumed to be connected
+func (r *RabbitMQ) ConnectionStatus() ConnectionStatus {
+	r.publishMu.Lock()
+	spilled := int64(len(r.spill))
+	r.publishMu.Unlock()
+	r.mu.Lock()
+	status := ConnectionStatus{
+		Producer:     StateConnected,
+		Consumer:     r.consumerState,
+		Reconnects:   r.reconnects,
+		Spilled:      spilled,
+		SpillDropped: r.spillDropped,
+	}
+	r.mu.Unlock()
+	if p, ok := r.producer.(*amqpProducer); ok {
+		state, reconnects := p.status()
+		status.Producer = state
+		status.Reconnects += reconnects
+	}
+	return status
+}
+
+// delivered keeps track of deliveries taken from the broker
+func (r *RabbitMQ) delivered(d amqp.Delivery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pops++
+	r.head = d.Timestamp
+	r.unacked[keyOf(d)] = d
+}
+
+// Stats returns the queue depth as reported by the broker. When the
+// broker can't be inspected the depth is estimated from this instance
+// only. OldestAge is the age of the message most recently taken from
+// the head of the queue
+func (r *RabbitMQ) Stats() Stats {
+	r.mu.Lock()
+	stats := Stats{
+		Depth:       r.pushes - r.pops,
+		Pushes:      r.pushes,
+		Pops:        r.pops,
+		DeadLetters: r.deadLettered,
+	}
+	inspector, head := r.inspector, r.head
+	r.mu.Unlock()
+	if inspector != nil {
+		if q, err := inspector.QueueInspect(r.config.Queue); err == nil {
+			stats.Depth = int64(q.Messages)
+		}
+	}
+	if stats.Depth < 0 {
+		stats.Depth = 0
+	}
+	if stats.Depth > 0 && !head.IsZero() {
+		stats.OldestAge = time.Since(head)
+	}
+	return stats
 }
 
 func RabbitMQRFC5424Worker(resourceChannel chan<- logging.Resource, done <-chan bool, m Metrics) rabbitmq.ConsumerHandlerFunc {
+	parse := func(raw []byte) (*logging.Resource, error) {
+		resource, _, err := ParseStage(raw, m, nil)
+		return resource, err
+	}
+	ack := func(d amqp.Delivery) error {
+		return d.Ack(false)
+	}
+	return rfc5424Worker(resourceChannel, done, parse, nil, ack)
+}
+
+// parse runs ParseStage on a delivery and accounts for stored dead letters
+func (r *RabbitMQ) parse(raw []byte) (*logging.Resource, error) {
+	resource, stored, err := ParseStage(raw, r.metrics, r.deadLetters)
+	if stored {
+		r.mu.Lock()
+		r.deadLettered++
+		r.mu.Unlock()
+	}
+	return resource, err
+}
+
+// rfc5424Worker hands parsed deliveries to resourceChannel. Deliveries are
+// acknowledged with ack by the Deliverer, or right away when parsing fails
+func rfc5424Worker(resourceChannel chan<- logging.Resource, done <-chan bool, parse func([]byte) (*logging.Resource, error), delivered func(amqp.Delivery), ack func(amqp.Delivery) error) rabbitmq.ConsumerHandlerFunc {
 	return func(deliveries <-chan amqp.Delivery, doneChannel <-chan bool) {
 		for {
 			select {
-			case d := <-deliveries:
-				resource, err := BodyToResource(d.Body, m)
-				ackDelivery(d)
+			case d, ok := <-deliveries:
+				if !ok {
+					return
+				}
+				if delivered != nil {
+					delivered(d)
+				}
+				resource, err := parse(d.Body)
 				if err != nil {
-					fmt.Printf("Error processing syslog message: %v\n", err)
+					fmt.Fprintf(os.Stderr, "Error processing syslog message: %v\n", err)
+					if err := ack(d); err != nil {
+						fmt.Fprintf(os.Stderr, "Error Acking delivery: %v\n", err)
+					}
 					continue
 				}
-				resourceChannel <- *resource
+				setMeta(resource, rabbitMQMetaDelivery, d)
+				select {
+				case resourceChannel <- *resource:
+				case <-done:
+					return
+				}
 			case <-doneChannel:
-				fmt.Printf("Worker received done message (worker)...\n")
+				fmt.Fprintf(os.Stderr, "Worker received done message (worker)...\n")
 			case <-done:
-				fmt.Printf("Worker received done message (master)...\n")
+				fmt.Fprintf(os.Stderr, "Worker received done message (master)...\n")
 				return
 			}
 		}
 	}
 }
 
-func (r *RabbitMQ) DeadLetter(_ logging.Resource) error {
-	// TODO: implement
-	return nil
+func (r *RabbitMQ) DeadLetter(msg logging.Resource) error {
+	r.mu.Lock()
+	r.deadLettered++
+	r.mu.Unlock()
+	if r.deadLetters == nil {
+		return nil
+	}
+	return r.deadLetters.Store(NewDeadLetter(msg))
 }
@@ -0,0 +1,344 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisBodyField = "body"
+	redisMetaID    = "redis.id"
+
+	defaultRedisStream        = "logproxy"
+	defaultRedisGroup         = "logproxy"
+	defaultRedisClaimMinIdle  = time.Minute
+	defaultRedisClaimInterval = 30 * time.Second
+	defaultRedisBlock         = 2 * time.Second
+)
+
+// RedisConfig configures a Redis Streams queue
+type RedisConfig struct {
+	// URL of the Redis server, e.g. redis://:password@host:6379/0
+	URL string
+	// Stream is the key of the stream, defaults to logproxy
+	Stream string
+	// Group is the consumer group shared by all logproxy instances, defaults to logproxy
+	Group string
+	// Consumer identifies this instance within the group, defaults to the hostname
+	Consumer string
+	// MaxLen caps the stream length using approximate trimming. Zero means unbounded
+	MaxLen int64
+	// ClaimMinIdle is how long an entry must be pending before another
+	// consumer reclaims it, defaults to 1m
+	ClaimMinIdle time.Duration
+	// ClaimInterval is how often pending entries are checked, defaults to 30s
+	ClaimInterval time.Duration
+	// Block is the maximum time a read waits for new entries, defaults to 2s
+	Block time.Duration
+}
+
+// Redis implements a Queue backed by a Redis Stream. Instances sharing a
+// consumer group share the work. Entries are acknowledged once the Deliverer
+// has handled them, entries of crashed consumers are reclaimed after ClaimMinIdle
+type Redis struct {
+	client          redis.UniversalClient
+	config          RedisConfig
+	resourceChannel chan logging.Resource
+	metrics         Metrics
+	deadLetters     DeadLetterStore
+
+	mu           sync.Mutex
+	pushes       int64
+	pops         int64
+	deadLettered int64
+}
+
+var _ Queue = &Redis{}
+var _ Acknowledger = &Redis{}
+
+func (r *Redis) SetMetrics(m Metrics) {
+	r.metrics = m
+}
+
+func (r *Redis) SetDeadLetterStore(s DeadLetterStore) {
+	r.deadLetters = s
+}
+
+// NewRedisQueue returns a Redis Streams queue. When client is nil a client
+// is created from config.URL
+func NewRedisQueue(client redis.UniversalClient, config RedisConfig, opts ...OptionFunc) (*Redis, error) {
+	if client == nil {
+		if config.URL == "" {
+			return nil, fmt.Errorf("missing Redis URL")
+		}
+		options, err := redis.ParseURL(config.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis URL: %w", err)
+		}
+		client = redis.NewClient(options)
+	}
+	if config.Stream == "" {
+		config.Stream = defaultRedisStream
+	}
+	if config.Group == "" {
+		config.Group = defaultRedisGroup
+	}
+	if config.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("missing Redis consumer name: %w", err)
+		}
+		config.Consumer = hostname
+	}
+	if config.MaxLen < 0 {
+		return nil, fmt.Errorf("invalid Redis max length: %d", config.MaxLen)
+	}
+	if config.ClaimMinIdle <= 0 {
+		config.ClaimMinIdle = defaultRedisClaimMinIdle
+	}
+	if config.ClaimInterval <= 0 {
+		config.ClaimInterval = defaultRedisClaimInterval
+	}
+	if config.Block <= 0 {
+		config.Block = defaultRedisBlock
+	}
+	r := &Redis{
+		client:          client,
+		config:          config,
+		resourceChannel: make(chan logging.Resource),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Redis) Output() <-chan logging.Resource {
+	return r.resourceChannel
+}
+
+func (r *Redis) Push(raw []byte) error {
+	err := r.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: r.config.Stream,
+		MaxLen: r.config.MaxLen,
+		Approx: r.config.MaxLen > 0,
+		Values: map[string]interface{}{redisBodyField: raw},
+	}).Err()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pushes++
+	r.mu.Unlock()
+	if r.metrics != nil {
+		r.metrics.IncProcessed()
+	}
+	return nil
+}
+
+// Start creates the consumer group when needed and starts consuming. The
+// consumer stops when the returned channel receives a value
+func (r *Redis) Start() (chan bool, error) {
+	err := r.client.XGroupCreateMkStream(context.Background(), r.config.Stream, r.config.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("redis group create error: %w", err)
+	}
+	doneChannel := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-doneChannel
+		cancel()
+	}()
+	go r.consume(ctx)
+	return doneChannel, nil
+}
+
+func (r *Redis) consume(ctx context.Context) {
+	// Our own pending entries are read first, they were delivered
+	// to us before a restart but never acknowledged
+	start := "0"
+	var lastClaim time.Time
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= r.config.ClaimInterval {
+			lastClaim = time.Now()
+			if !r.reclaim(ctx) {
+				return
+			}
+		}
+		streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.config.Group,
+			Consumer: r.config.Consumer,
+			Streams:  []string{r.config.Stream, start},
+			Count:    int64(batchSize),
+			Block:    r.config.Block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "redis queue: read error: %v\n", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		var count int
+		for _, stream := range streams {
+			count += len(stream.Messages)
+			if !r.deliver(ctx, stream.Messages) {
+				return
+			}
+			if start != ">" && len(stream.Messages) > 0 {
+				// Read on past the pending entries which were just delivered
+				start = stream.Messages[len(stream.Messages)-1].ID
+			}
+		}
+		if start != ">" && count == 0 {
+			start = ">"
+		}
+	}
+}
+
+// reclaim takes over entries which have been pending for longer than
+// ClaimMinIdle, e.g. because their consumer crashed
+func (r *Redis) reclaim(ctx context.Context) bool {
+	cursor := "0-0"
+	for {
+		messages, next, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   r.config.Stream,
+			Group:    r.config.Group,
+			Consumer: r.config.Consumer,
+			MinIdle:  r.config.ClaimMinIdle,
+			Start:    cursor,
+			Count:    int64(batchSize),
+		}).Result()
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			fmt.Fprintf(os.Stderr, "redis queue: reclaim error: %v\n", err)
+			return true
+		}
+		if !r.deliver(ctx, messages) {
+			return false
+		}
+		if next == "0-0" || next == "" {
+			return true
+		}
+		cursor = next
+	}
+}
+
+func (r *Redis) deliver(ctx context.Context, messages []redis.XMessage) bool {
+	for _, message := range messages {
+		body, _ := message.Values[redisBodyField].(string)
+		resource, stored, err := ParseStage([]byte(body), r.metrics, r.deadLetters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error processing syslog message: %v\n", err)
+			if stored {
+				r.mu.Lock()
+				r.deadLettered++
+				r.mu.Unlock()
+			}
+			_ = r.ack(message.ID)
+			continue
+		}
+		setMeta(resource, redisMetaID, message.ID)
+		select {
+		case r.resourceChannel <- *resource:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Ack acknowledges and removes the stream entries of handled resources
+func (r *Redis) Ack(resources ...logging.Resource) error {
+	ids := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		if id, ok := resource.Meta[redisMetaID].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return r.ack(ids...)
+}
+
+// Requeue leaves the entries of resources the Deliverer gave up on pending,
+// they are reclaimed once they were idle for ClaimMinIdle
+func (r *Redis) Requeue(_ ...logging.Resource) error {
+	return nil
+}
+
+func (r *Redis) ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	pipe := r.client.TxPipeline()
+	acked := pipe.XAck(ctx, r.config.Stream, r.config.Group, ids...)
+	pipe.XDel(ctx, r.config.Stream, ids...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis ack error: %w", err)
+	}
+	r.mu.Lock()
+	r.pops += acked.Val()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Redis) Stats() Stats {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r.mu.Lock()
+	stats := Stats{
+		Pushes:      r.pushes,
+		Pops:        r.pops,
+		DeadLetters: r.deadLettered,
+	}
+	r.mu.Unlock()
+	if depth, err := r.client.XLen(ctx, r.config.Stream).Result(); err == nil {
+		stats.Depth = depth
+	}
+	if oldest, err := r.client.XRangeN(ctx, r.config.Stream, "-", "+", 1).Result(); err == nil && len(oldest) > 0 {
+		if queued, ok := streamIDTime(oldest[0].ID); ok {
+			stats.OldestAge = time.Since(queued)
+		}
+	}
+	return stats
+}
+
+// streamIDTime returns the time encoded in the millisecond part of a stream ID
+func streamIDTime(id string) (time.Time, bool) {
+	ms, _, _ := strings.Cut(id, "-")
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(millis), true
+}
+
+func (r *Redis) DeadLetter(msg logging.Resource) error {
+	r.mu.Lock()
+	r.deadLettered++
+	r.mu.Unlock()
+	if r.deadLetters == nil {
+		return nil
+	}
+	return r.deadLetters.Store(NewDeadLetter(msg))
+}
@@ -0,0 +1,161 @@
+package queue_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRedisQueue(t *testing.T, server *miniredis.Miniredis, consumer string) *queue.Redis {
+	q, err := queue.NewRedisQueue(nil, queue.RedisConfig{
+		URL:           "redis://" + server.Addr(),
+		Consumer:      consumer,
+		ClaimMinIdle:  50 * time.Millisecond,
+		ClaimInterval: 10 * time.Millisecond,
+		Block:         10 * time.Millisecond,
+	}, queue.WithMetrics(&nilMetrics{}))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return q
+}
+
+func receiveResource(t *testing.T, q queue.Queue) logging.Resource {
+	select {
+	case r := <-q.Output():
+		return r
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "timeout waiting for resource")
+		return logging.Resource{}
+	}
+}
+
+func TestRedisQueue(t *testing.T) {
+	server := miniredis.RunT(t)
+	_, err := queue.NewRedisQueue(nil, queue.RedisConfig{})
+	assert.NotNil(t, err)
+	_, err = queue.NewRedisQueue(nil, queue.RedisConfig{URL: "bogus://"})
+	assert.NotNil(t, err)
+
+	q := newRedisQueue(t, server, "a")
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Nil(t, q.Push([]byte("not syslog")))
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+
+	done, err := q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	first := receiveResource(t, q)
+	second := receiveResource(t, q)
+	assert.Equal(t, "2018-09-07T15:39:21.132Z", first.LogTime)
+
+	stats := q.Stats()
+	assert.Equal(t, int64(3), stats.Pushes)
+	assert.Equal(t, int64(2), stats.Depth)
+	assert.Greater(t, stats.OldestAge, time.Duration(0))
+
+	assert.Nil(t, q.Ack(first, second))
+	stats = q.Stats()
+	assert.Equal(t, int64(0), stats.Depth)
+	assert.Equal(t, int64(3), stats.Pops)
+	done <- true
+
+	// A second start finds the existing group
+	done, err = q.Start()
+	assert.Nil(t, err)
+	done <- true
+}
+
+func TestRedisQueueReclaim(t *testing.T) {
+	server := miniredis.RunT(t)
+	crashed := newRedisQueue(t, server, "crashed")
+	done, err := crashed.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, crashed.Push([]byte(rawMessage)))
+	lost := receiveResource(t, crashed)
+	done <- true
+
+	// The entry was never acknowledged so another consumer takes it over
+	server.FastForward(time.Second)
+	q := newRedisQueue(t, server, "survivor")
+	done, err = q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	reclaimed := receiveResource(t, q)
+	assert.Equal(t, lost.Meta, reclaimed.Meta)
+	assert.Nil(t, q.Ack(reclaimed))
+	assert.Equal(t, int64(0), q.Stats().Depth)
+	done <- true
+}
+
+func TestRedisQueueRestart(t *testing.T) {
+	server := miniredis.RunT(t)
+	newQueue := func() *queue.Redis {
+		q, err := queue.NewRedisQueue(nil, queue.RedisConfig{
+			URL:          "redis://" + server.Addr(),
+			Consumer:     "a",
+			ClaimMinIdle: time.Hour,
+			Block:        10 * time.Millisecond,
+		}, queue.WithMetrics(&nilMetrics{}))
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		return q
+	}
+	q := newQueue()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Push([]byte(rawMessage)))
+	}
+	done, err := q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		receiveResource(t, q)
+	}
+	done <- true
+
+	// The same consumer restarts and replays its pending entries exactly once
+	q = newQueue()
+	done, err = q.Start()
+	if !assert.Nil(t, err) {
+		return
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		r := receiveResource(t, q)
+		seen[fmt.Sprint(r.Meta["redis.id"])]++
+	}
+	assert.Len(t, seen, 3)
+	select {
+	case r := <-q.Output():
+		assert.Fail(t, "pending entry delivered again", r.Meta["redis.id"])
+	case <-time.After(200 * time.Millisecond):
+	}
+	done <- true
+}
+
+func TestRedisQueueDeliverer(t *testing.T) {
+	server := miniredis.RunT(t)
+	q := newRedisQueue(t, server, "a")
+	done, _ := q.Start()
+	deliverer, _ := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
+	workerDone := make(chan bool)
+	go deliverer.ResourceWorker(q, workerDone, nil)
+
+	assert.Nil(t, q.Push([]byte(rawMessage)))
+	assert.Eventually(t, func() bool { return q.Stats().Pops == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), q.Stats().Depth)
+	workerDone <- true
+	done <- true
+}
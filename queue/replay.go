@@ -0,0 +1,212 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dip-software/go-dip-api/logging"
+)
+
+// ReplayOptions controls a dead letter replay
+type ReplayOptions struct {
+	// DryRun reads and filters the dead letters but does not deliver or remove them
+	DryRun bool
+	// Filter runs the loaded plugin filters again before redelivery
+	Filter bool
+	// Progress is called after every processed batch, when set
+	Progress func(stats ReplayStats)
+}
+
+// ReplayStats reports the progress of a dead letter replay
+type ReplayStats struct {
+	Total     int  `json:"total"`
+	Processed int  `json:"processed"`
+	Replayed  int  `json:"replayed"`
+	Dropped   int  `json:"dropped"`
+	Failed    int  `json:"failed"`
+	Skipped   int  `json:"skipped"`
+	DryRun    bool `json:"dryRun"`
+}
+
+var errNoSinks = errors.New("replay needs at least one sink")
+
+// replayMetaLetter holds the index of the dead letter a resource was replayed from
+const replayMetaLetter = "replay.letter"
+
+// replayDeadLetterer puts resources which fail again back into the store
+type replayDeadLetterer struct {
+	store    DeadLetterStore
+	failed   int
+	unstored map[int]bool
+}
+
+func (r *replayDeadLetterer) DeadLetter(msg logging.Resource) error {
+	r.failed++
+	err := r.store.Store(NewDeadLetter(msg))
+	if index, ok := msg.Meta[replayMetaLetter].(int); ok && err != nil {
+		r.unstored[index] = true
+	}
+	return err
+}
+
+// Replay reads the dead letters from store and delivers them again, see
+// ReplaySinks. pl is the only sink
+func (pl *Deliverer) Replay(ctx context.Context, store DeadLetterStore, opts ReplayOptions) (ReplayStats, error) {
+	return ReplaySinks(ctx, store, []Sink{{Deliverer: pl}}, opts)
+}
+
+// ReplaySinks reads the dead letters from store and delivers them again to
+// the sink which rejected them. The first sink is the primary one, it also
+// receives the dead letters without a sink and runs the filters. Dead letters
+// of sinks which are not configured are skipped and kept. Resources that are
+// rejected again are stored back into the dead letter store. A dead letter is
+// only removed once it was delivered, stored again or dropped by a filter,
+// the ones which could not be delivered are kept
+func ReplaySinks(ctx context.Context, store DeadLetterStore, sinks []Sink, opts ReplayOptions) (ReplayStats, error) {
+	stats := ReplayStats{DryRun: opts.DryRun}
+	if store == nil {
+		return stats, ErrNoDeadLetterStore
+	}
+	if len(sinks) == 0 {
+		return stats, errNoSinks
+	}
+	claim, err := store.Claim()
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		if err := claim.Release(); err != nil {
+			fmt.Fprintf(os.Stderr, "error releasing dead letters: %v\n", err)
+		}
+	}()
+	letters := claim.Letters()
+	stats.Total = len(letters)
+
+	r := &replay{
+		claim:   claim,
+		store:   store,
+		letters: letters,
+		filter:  sinks[0].Deliverer,
+		opts:    opts,
+		stats:   &stats,
+	}
+	bySink := map[string]int{"": 0}
+	for i, sink := range sinks {
+		bySink[sink.Name] = i
+	}
+	indices := make([][]int, len(sinks))
+	skipped := make(map[string]int)
+	for i, letter := range letters {
+		sink, ok := bySink[letter.Sink]
+		if !ok {
+			skipped[letter.Sink]++
+			continue
+		}
+		indices[sink] = append(indices[sink], i)
+	}
+	for sink, count := range skipped {
+		fmt.Fprintf(os.Stderr, "keeping %d dead letters of sink %s, it isn't configured\n", count, sink)
+		stats.Processed += count
+		stats.Skipped += count
+	}
+	for i, sink := range sinks {
+		r.deliver(ctx, sink.Deliverer, indices[i])
+	}
+	r.remove()
+	return stats, ctx.Err()
+}
+
+// replay delivers claimed dead letters
+type replay struct {
+	claim   DeadLetterClaim
+	store   DeadLetterStore
+	letters []DeadLetter
+	filter  *Deliverer
+	opts    ReplayOptions
+	stats   *ReplayStats
+	settled []int
+}
+
+// remove deletes the dead letters which were handled from the store
+func (r *replay) remove() {
+	if r.opts.DryRun || len(r.settled) == 0 {
+		return
+	}
+	if err := r.claim.Remove(r.settled...); err != nil {
+		fmt.Fprintf(os.Stderr, "error removing %d replayed dead letters: %v\n", len(r.settled), err)
+	}
+	r.settled = r.settled[:0]
+}
+
+// deliver replays the dead letters at indices using pl
+func (r *replay) deliver(ctx context.Context, pl *Deliverer, indices []int) {
+	stats := r.stats
+	var count, bytes int
+	buf := make([]logging.Resource, pl.maxBatchCount)
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		if r.opts.DryRun {
+			stats.Replayed += count
+		} else {
+			dl := &replayDeadLetterer{store: r.store, unstored: make(map[int]bool)}
+			_, undelivered, _ := pl.flushBatch(ctx, buf, count, dl, func(resources ...logging.Resource) {
+				for _, resource := range resources {
+					if index, ok := resource.Meta[replayMetaLetter].(int); ok && !dl.unstored[index] {
+						r.settled = append(r.settled, index)
+					}
+				}
+			})
+			stats.Failed += dl.failed + len(undelivered)
+			stats.Replayed += count - dl.failed - len(undelivered)
+			r.remove()
+		}
+		count, bytes = 0, 0
+		if r.opts.Progress != nil {
+			r.opts.Progress(*stats)
+		}
+	}
+	for _, i := range indices {
+		if ctx.Err() != nil {
+			break
+		}
+		letter := r.letters[i]
+		stats.Processed++
+		resource := letter.Resource
+		if letter.Raw != "" {
+			parsed, _, err := ParseStage([]byte(letter.Raw), pl.metrics, nil)
+			if err != nil {
+				stats.Failed++
+				continue
+			}
+			resource = *parsed
+		}
+		resource.Error = nil
+		if r.opts.Filter {
+			if drop := r.filter.processFilters(ctx, &resource); drop {
+				stats.Dropped++
+				r.settled = append(r.settled, i)
+				continue
+			}
+		}
+		setMeta(&resource, replayMetaLetter, i)
+		if letter.Sink != "" {
+			// Resources rejected again keep their sink
+			setMeta(&resource, deadLetterMetaSink, letter.Sink)
+		}
+		size := pl.resourceSize(resource)
+		if !pl.fits(count, bytes, size) {
+			flush()
+		}
+		buf[count] = resource
+		count++
+		bytes += size
+		if pl.full(count, bytes) {
+			flush()
+		}
+	}
+	flush()
+}
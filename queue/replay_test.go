@@ -0,0 +1,165 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+type rejectingStorer struct {
+	reject map[string]bool
+	stored []logging.Resource
+}
+
+func (r *rejectingStorer) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	resp := &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}
+	for i := 0; i < count; i++ {
+		if r.reject[msgs[i].ID] {
+			resp.Response.StatusCode = http.StatusBadRequest
+			return resp, logging.ErrBatchErrors
+		}
+	}
+	r.stored = append(r.stored, msgs[:count]...)
+	return resp, nil
+}
+
+func TestReplay(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, id := range []string{"1", "2", "3"} {
+		_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: id, Error: errors.New("failed")}))
+	}
+	storer := &rejectingStorer{reject: map[string]bool{"2": true}}
+	deliverer, _ := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{})
+
+	// Dry run leaves everything in place
+	var progress int
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{
+		DryRun:   true,
+		Progress: func(_ queue.ReplayStats) { progress++ },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, progress)
+	assert.Equal(t, queue.ReplayStats{Total: 3, Processed: 3, Replayed: 3, DryRun: true}, stats)
+	assert.Len(t, storer.stored, 0)
+	letters, _ := store.Load()
+	assert.Len(t, letters, 3)
+
+	stats, err = deliverer.Replay(context.Background(), store, queue.ReplayOptions{Filter: true})
+	assert.Nil(t, err)
+	assert.Equal(t, queue.ReplayStats{Total: 3, Processed: 3, Replayed: 2, Failed: 1}, stats)
+	assert.Len(t, storer.stored, 2)
+
+	letters, _ = store.Load()
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "2", letters[0].Resource.ID)
+		assert.Equal(t, logging.ErrBatchErrors.Error(), letters[0].Reason)
+	}
+
+	_, err = deliverer.Replay(context.Background(), nil, queue.ReplayOptions{})
+	assert.Equal(t, queue.ErrNoDeadLetterStore, err)
+}
+
+func TestReplayCancelled(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: "1"}))
+	deliverer, _ := queue.NewDeliverer(&rejectingStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats, err := deliverer.Replay(ctx, store, queue.ReplayOptions{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, stats.Processed)
+	letters, _ := store.Load()
+	assert.Len(t, letters, 1)
+}
+
+func TestReplayRawDeadLetters(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	_ = store.Store(queue.NewRawDeadLetter([]byte(rawMessage), errors.New("failed")))
+	_ = store.Store(queue.NewRawDeadLetter([]byte("not syslog"), errors.New("failed")))
+	storer := &rejectingStorer{}
+	deliverer, _ := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{})
+
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, queue.ReplayStats{Total: 2, Processed: 2, Replayed: 1, Failed: 1}, stats)
+	if assert.Len(t, storer.stored, 1) {
+		assert.Equal(t, "2018-09-07T15:39:21.132Z", storer.stored[0].LogTime)
+	}
+	letters, _ := store.Load()
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "not syslog", letters[0].Raw)
+	}
+}
+
+// inspectingStorer records how many dead letters are left in the store
+// whenever a batch is delivered
+type inspectingStorer struct {
+	store queue.DeadLetterStore
+	left  []int
+}
+
+func (i *inspectingStorer) StoreResources(_ []logging.Resource, _ int) (*logging.StoreResponse, error) {
+	letters, _ := i.store.Load()
+	i.left = append(i.left, len(letters))
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func TestReplayRemovesDeliveredLetters(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, id := range []string{"1", "2", "3"} {
+		_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: id}))
+	}
+	storer := &inspectingStorer{store: store}
+	deliverer, _ := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{}, queue.WithMaxBatchCount(1))
+
+	// Every dead letter is still stored while its batch is delivered
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Replayed)
+	assert.Equal(t, []int{3, 2, 1}, storer.left)
+	letters, _ := store.Load()
+	assert.Empty(t, letters)
+}
+
+func TestReplaySinks(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, letter := range []queue.DeadLetter{
+		{Resource: logging.Resource{ID: "1"}},
+		{Resource: logging.Resource{ID: "2"}, Sink: "hsdp"},
+		{Resource: logging.Resource{ID: "3"}, Sink: "audit"},
+		{Resource: logging.Resource{ID: "4"}, Sink: "audit"},
+		{Resource: logging.Resource{ID: "5"}, Sink: "removed"},
+	} {
+		_ = store.Store(letter)
+	}
+	primary := &rejectingStorer{}
+	audit := &rejectingStorer{reject: map[string]bool{"4": true}}
+	stats, err := queue.ReplaySinks(context.Background(), store, []queue.Sink{
+		newSink(t, "hsdp", primary),
+		newSink(t, "audit", audit),
+	}, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, queue.ReplayStats{Total: 5, Processed: 5, Replayed: 3, Failed: 1, Skipped: 1}, stats)
+	assert.Len(t, primary.stored, 2)
+	if assert.Len(t, audit.stored, 1) {
+		assert.Equal(t, "3", audit.stored[0].ID)
+	}
+
+	// Dead letters of sinks which aren't configured are kept, the ones
+	// rejected again keep their sink
+	letters, _ := store.Load()
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "5", letters[0].Resource.ID)
+		assert.Equal(t, "removed", letters[0].Sink)
+		assert.Equal(t, "4", letters[1].Resource.ID)
+		assert.Equal(t, "audit", letters[1].Sink)
+	}
+}
@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+)
+
+const (
+	defaultMaxRetries    = 5
+	defaultRetryInitial  = 500 * time.Millisecond
+	defaultRetryMaxDelay = 30 * time.Second
+
+	// StatusPartialFailure is returned by the HSDP log ingestor when some
+	// entries of a bundle were rejected
+	StatusPartialFailure = 635
+)
+
+// storeOutcome classifies the result of a StoreResources call
+type storeOutcome int
+
+const (
+	outcomeStored storeOutcome = iota
+	// outcomeTransient failures are retried with backoff
+	outcomeTransient
+	// outcomeRejected batches contain invalid resources
+	outcomeRejected
+)
+
+// classify decides how a StoreResources result is handled. Network errors,
+// 429 and 5xx responses are transient, validation failures and other 4xx
+// responses reject the batch. 401, 403 and 408 fail the request as a whole,
+// e.g. after credentials were rotated, so they are transient as well
+func classify(resp *logging.StoreResponse, err error) storeOutcome {
+	if resp == nil {
+		return outcomeTransient
+	}
+	if resp.Response == nil {
+		// The client validates resources before posting them
+		if errors.Is(err, logging.ErrBatchErrors) {
+			return outcomeRejected
+		}
+		return outcomeTransient
+	}
+	status := resp.Response.StatusCode
+	switch {
+	case status == StatusPartialFailure:
+		return outcomeRejected
+	case status == http.StatusTooManyRequests, status >= 500,
+		status == http.StatusUnauthorized, status == http.StatusForbidden, status == http.StatusRequestTimeout:
+		return outcomeTransient
+	case status >= 400:
+		return outcomeRejected
+	case status >= 200 && status < 300 && err == nil:
+		return outcomeStored
+	case status >= 200 && status < 300 && errors.Is(err, logging.ErrBatchErrors) && len(resp.Failed) > 0:
+		// Sinks which accept a batch but reject some of its entries
+		return outcomeRejected
+	}
+	return outcomeTransient
+}
+
+// retryAfter returns the delay requested by a Retry-After header, or zero
+func retryAfter(resp *logging.StoreResponse) time.Duration {
+	if resp == nil || resp.Response == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// splitFailed separates the entries the logging service reported as failed
+// from the rest of the batch. The failed entries carry the reason they were
+// rejected for. Nothing is returned when the response doesn't identify them
+func splitFailed(resources []logging.Resource, resp *logging.StoreResponse) ([]logging.Resource, []logging.Resource) {
+	if resp == nil || len(resp.Failed) == 0 {
+		return nil, nil
+	}
+	reasons := make(map[string]error, len(resp.Failed))
+	for _, failed := range resp.Failed {
+		if failed.ID != "" {
+			reasons[failed.ID] = failureReason(failed, resp)
+		}
+	}
+	var invalid, valid []logging.Resource
+	for _, resource := range resources {
+		reason, ok := reasons[resource.ID]
+		if !ok {
+			valid = append(valid, resource)
+			continue
+		}
+		resource.Error = reason
+		invalid = append(invalid, resource)
+	}
+	if len(invalid) == 0 {
+		return nil, nil
+	}
+	return invalid, valid
+}
+
+// failureReason returns the reason the logging service gave for a failed entry
+func failureReason(failed logging.Resource, resp *logging.StoreResponse) error {
+	reason := failed.Error
+	if reason == nil {
+		reason = logging.ErrBatchErrors
+	}
+	if resp.Response == nil {
+		return fmt.Errorf("invalid resource: %w", reason)
+	}
+	if status := resp.Response.StatusCode; status < 200 || status > 299 {
+		return fmt.Errorf("rejected with status %d: %w", status, reason)
+	}
+	return reason
+}
+
+// rejectResource dead letters a resource which can never be delivered
+func rejectResource(queue deadLetterer, resource logging.Resource) {
+	_ = queue.DeadLetter(resource)
+	fmt.Fprintf(os.Stderr, "permanent failure sending resource: [%v] error: %v\n", resource, resource.Error)
+}
+
+// countPartialFailure records how the entries of a partial failure response
+// were handled. Responses which don't identify the failed entries are bisected
+func (pl *Deliverer) countPartialFailure(invalid, valid int) {
+	if pl.metrics == nil {
+		return
+	}
+	if invalid == 0 {
+		pl.metrics.IncPartialFailure("bisected", valid)
+		return
+	}
+	pl.metrics.IncPartialFailure("invalid", invalid)
+	pl.metrics.IncPartialFailure("resent", valid)
+}
+
+// rejection describes why a single resource was rejected
+func rejection(resp *logging.StoreResponse, err error) error {
+	if resp != nil {
+		for _, failed := range resp.Failed {
+			if failed.Error != nil {
+				return failed.Error
+			}
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("rejected with status %d", resp.StatusCode())
+	}
+	return err
+}
+
+// store delivers resources. Transient failures are retried with backoff and
+// rejected batches are split in halves until the invalid resources are
+// isolated and dead lettered. While the circuit breaker is open the batch is
+// held back without using up its retries. handled is called with resources
+// which were stored or dead lettered. Resources which were still failing when
+// the retries ran out are returned together with the last error
+func (pl *Deliverer) store(ctx context.Context, resources []logging.Resource, queue deadLetterer, handled func(...logging.Resource)) (int, []logging.Resource, error) {
+	backoff := &Backoff{Initial: pl.retryInitial, Max: pl.retryMaxDelay}
+	attempt := 0
+	for {
+		if err := pl.breaker.wait(ctx); err != nil {
+			return 0, resources, err
+		}
+		resp, err := pl.storer.StoreResources(resources, len(resources))
+		outcome := classify(resp, err)
+		if outcome != outcomeTransient {
+			pl.breaker.success()
+		}
+		switch outcome {
+		case outcomeStored:
+			handled(resources...)
+			return len(resources), nil, nil
+		case outcomeRejected:
+			invalid, valid := splitFailed(resources, resp)
+			if resp.StatusCode() == StatusPartialFailure {
+				pl.countPartialFailure(len(invalid), len(resources)-len(invalid))
+			}
+			if len(invalid) > 0 {
+				for _, resource := range invalid {
+					rejectResource(queue, resource)
+				}
+				handled(invalid...)
+				if len(valid) == 0 {
+					return 0, nil, nil
+				}
+				fmt.Fprintf(os.Stderr, "resending %d of %d messages\n", len(valid), len(resources))
+				return pl.store(ctx, valid, queue, handled)
+			}
+			if len(resources) == 1 {
+				resources[0].Error = rejection(resp, err)
+				rejectResource(queue, resources[0])
+				handled(resources...)
+				return 0, nil, nil
+			}
+			half := len(resources) / 2
+			fmt.Fprintf(os.Stderr, "splitting rejected batch of %d messages\n", len(resources))
+			first, firstUndelivered, firstErr := pl.store(ctx, resources[:half], queue, handled)
+			second, secondUndelivered, secondErr := pl.store(ctx, resources[half:], queue, handled)
+			return first + second, append(firstUndelivered, secondUndelivered...), errors.Join(firstErr, secondErr)
+		}
+		if err == nil {
+			err = fmt.Errorf("unexpected status %d", resp.StatusCode())
+		}
+		if pl.breaker.failure() {
+			attempt = 0
+			backoff.Reset()
+			continue
+		}
+		if attempt >= pl.maxRetries {
+			return 0, resources, fmt.Errorf("giving up after %d retries: %w", attempt, err)
+		}
+		attempt++
+		delay := backoff.Next()
+		if after := retryAfter(resp); after > 0 {
+			delay = min(after, pl.retryMaxDelay)
+		}
+		fmt.Fprintf(os.Stderr, "retrying batch of %d messages in %v: %v\n", len(resources), delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, resources, ctx.Err()
+		}
+	}
+}
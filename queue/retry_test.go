@@ -0,0 +1,244 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// scriptedStorer returns the scripted failures before storing resources
+type scriptedStorer struct {
+	failures []func() (*logging.StoreResponse, error)
+	calls    int
+	stored   int
+}
+
+func (s *scriptedStorer) StoreResources(_ []logging.Resource, count int) (*logging.StoreResponse, error) {
+	s.calls++
+	if len(s.failures) > 0 {
+		failure := s.failures[0]
+		s.failures = s.failures[1:]
+		return failure()
+	}
+	s.stored += count
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func statusFailure(status int, header http.Header) func() (*logging.StoreResponse, error) {
+	return func() (*logging.StoreResponse, error) {
+		return &logging.StoreResponse{Response: &http.Response{StatusCode: status, Header: header}}, logging.ErrResponseError
+	}
+}
+
+func replayLetters(t *testing.T, storer logging.Storer, ids []string, opts ...queue.DelivererOption) (queue.ReplayStats, []queue.DeadLetter) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, id := range ids {
+		_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: id}))
+	}
+	deliverer, err := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, &nilMetrics{}, opts...)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	letters, _ := store.Load()
+	return stats, letters
+}
+
+func TestRetryOptions(t *testing.T) {
+	for _, opt := range []queue.DelivererOption{
+		queue.WithMaxRetries(-1),
+		queue.WithRetryBackoff(0, time.Second),
+		queue.WithRetryBackoff(time.Second, time.Millisecond),
+	} {
+		_, err := queue.NewDeliverer(&nilStorer{}, &nilLogger{}, nil, testBuild, &nilMetrics{}, opt)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	timeout := func() (*logging.StoreResponse, error) {
+		return nil, context.DeadlineExceeded
+	}
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		timeout,
+		statusFailure(http.StatusServiceUnavailable, nil),
+		statusFailure(http.StatusBadGateway, nil),
+	}}
+	stats, letters := replayLetters(t, storer, []string{"1", "2", "3"},
+		queue.WithMaxRetries(3), queue.WithRetryBackoff(time.Millisecond, 5*time.Millisecond))
+	assert.Equal(t, 4, storer.calls)
+	assert.Equal(t, 3, storer.stored)
+	assert.Equal(t, 3, stats.Replayed)
+	assert.Len(t, letters, 0)
+}
+
+func TestRetryRetryAfter(t *testing.T) {
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(http.StatusTooManyRequests, http.Header{"Retry-After": []string{strconv.Itoa(1)}}),
+	}}
+	start := time.Now()
+	stats, _ := replayLetters(t, storer, []string{"1"},
+		queue.WithRetryBackoff(time.Millisecond, 5*time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, stats.Replayed)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(http.StatusInternalServerError, nil),
+		statusFailure(http.StatusInternalServerError, nil),
+	}}
+	stats, letters := replayLetters(t, storer, []string{"1", "2"},
+		queue.WithMaxRetries(1), queue.WithRetryBackoff(time.Millisecond, time.Millisecond))
+	assert.Equal(t, 2, storer.calls)
+	assert.Equal(t, 2, stats.Failed)
+	// Undelivered dead letters stay in the store as they were
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "1", letters[0].Resource.ID)
+		assert.Equal(t, "2", letters[1].Resource.ID)
+	}
+}
+
+func TestRetryRequestFailures(t *testing.T) {
+	// Authentication failures aren't caused by the resources, they are
+	// retried instead of splitting the batch
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(http.StatusUnauthorized, nil),
+		statusFailure(http.StatusForbidden, nil),
+		statusFailure(http.StatusRequestTimeout, nil),
+	}}
+	stats, letters := replayLetters(t, storer, []string{"1", "2", "3", "4"},
+		queue.WithMaxRetries(3), queue.WithRetryBackoff(time.Millisecond, time.Millisecond))
+	assert.Equal(t, 4, storer.calls)
+	assert.Equal(t, 4, stats.Replayed)
+	assert.Len(t, letters, 0)
+
+	storer = &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(http.StatusUnauthorized, nil),
+		statusFailure(http.StatusUnauthorized, nil),
+	}}
+	stats, letters = replayLetters(t, storer, []string{"1", "2", "3", "4"},
+		queue.WithMaxRetries(1), queue.WithRetryBackoff(time.Millisecond, time.Millisecond))
+	assert.Equal(t, 2, storer.calls)
+	assert.Equal(t, 4, stats.Failed)
+	assert.Len(t, letters, 4)
+}
+
+func TestRetryBisectsRejectedBatches(t *testing.T) {
+	storer := &rejectingStorer{reject: map[string]bool{"2": true, "7": true}}
+	stats, letters := replayLetters(t, storer, []string{"1", "2", "3", "4", "5", "6", "7", "8"})
+	assert.Equal(t, 6, stats.Replayed)
+	assert.Equal(t, 2, stats.Failed)
+	assert.Len(t, storer.stored, 6)
+	var rejected []string
+	for _, letter := range letters {
+		rejected = append(rejected, letter.Resource.ID)
+		assert.Equal(t, logging.ErrBatchErrors.Error(), letter.Reason)
+	}
+	assert.ElementsMatch(t, []string{"2", "7"}, rejected)
+}
+
+// partialStorer answers like the log ingestor when some entries are invalid
+type partialStorer struct {
+	invalid map[string]bool
+	status  int
+	batches [][]string
+}
+
+func (p *partialStorer) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	var ids []string
+	resp := &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}
+	for i, msg := range msgs[:count] {
+		ids = append(ids, msg.ID)
+		if p.invalid[msg.ID] {
+			msg.Error = fmt.Errorf("issue location entry[%d]", i)
+			resp.Failed = append(resp.Failed, msg)
+		}
+	}
+	p.batches = append(p.batches, ids)
+	if len(resp.Failed) > 0 {
+		resp.Response.StatusCode = queue.StatusPartialFailure
+		if p.status != 0 {
+			resp.Response.StatusCode = p.status
+		}
+		return resp, logging.ErrBatchErrors
+	}
+	return resp, nil
+}
+
+type partialMetrics struct {
+	nilMetrics
+	outcomes map[string]int
+}
+
+func (p *partialMetrics) IncPartialFailure(outcome string, resources int) {
+	p.outcomes[outcome] += resources
+}
+
+func TestPartialFailure(t *testing.T) {
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: id}))
+	}
+	storer := &partialStorer{invalid: map[string]bool{"2": true, "5": true}}
+	m := &partialMetrics{outcomes: map[string]int{}}
+	deliverer, _ := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, m)
+
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Replayed)
+	assert.Equal(t, 2, stats.Failed)
+	// Only the valid entries are sent again
+	assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}, {"1", "3", "4"}}, storer.batches)
+	assert.Equal(t, map[string]int{"invalid": 2, "resent": 3}, m.outcomes)
+
+	letters, _ := store.Load()
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "2", letters[0].Resource.ID)
+		assert.Equal(t, "rejected with status 635: issue location entry[1]", letters[0].Reason)
+		assert.Equal(t, "5", letters[1].Resource.ID)
+		assert.Equal(t, "rejected with status 635: issue location entry[4]", letters[1].Reason)
+	}
+}
+
+func TestPartialFailureAccepted(t *testing.T) {
+	// Sinks like Elasticsearch accept the batch and report failed entries
+	storer := &partialStorer{invalid: map[string]bool{"3": true}, status: http.StatusOK}
+	stats, letters := replayLetters(t, storer, []string{"1", "2", "3"})
+	assert.Equal(t, 2, stats.Replayed)
+	assert.Equal(t, 1, stats.Failed)
+	assert.Equal(t, [][]string{{"1", "2", "3"}, {"1", "2"}}, storer.batches)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "3", letters[0].Resource.ID)
+		assert.Equal(t, "issue location entry[2]", letters[0].Reason)
+	}
+}
+
+func TestPartialFailureWithoutDetails(t *testing.T) {
+	storer := &scriptedStorer{failures: []func() (*logging.StoreResponse, error){
+		statusFailure(queue.StatusPartialFailure, nil),
+		statusFailure(queue.StatusPartialFailure, nil),
+	}}
+	m := &partialMetrics{outcomes: map[string]int{}}
+	deliverer, _ := queue.NewDeliverer(storer, &nilLogger{}, nil, testBuild, m)
+	store, _ := queue.NewFileDeadLetterStore(filepath.Join(t.TempDir(), "deadletters.ndjson"))
+	for _, id := range []string{"1", "2", "3", "4"} {
+		_ = store.Store(queue.NewDeadLetter(logging.Resource{ID: id}))
+	}
+
+	stats, err := deliverer.Replay(context.Background(), store, queue.ReplayOptions{})
+	assert.Nil(t, err)
+	// The batch and its first half were bisected before the halves were stored
+	assert.Equal(t, 4, stats.Replayed)
+	assert.Equal(t, map[string]int{"bisected": 6}, m.outcomes)
+}
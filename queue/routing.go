@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/dip-software/go-dip-api/logging"
+)
+
+// DefaultRoute is the name of the route taken by resources which match no rule
+const DefaultRoute = "default"
+
+// RouteMatch selects resources. Every field which is set must match.
+// ApplicationName, Category, Message and the Custom values are regular
+// expressions, Severity lists severities which match regardless of case
+type RouteMatch struct {
+	ApplicationName string   `json:"applicationName,omitempty"`
+	Severity        []string `json:"severity,omitempty"`
+	Category        string   `json:"category,omitempty"`
+	// Custom matches top level fields of the custom JSON object by key
+	Custom map[string]string `json:"custom,omitempty"`
+	// Message matches the decoded log message
+	Message string `json:"message,omitempty"`
+}
+
+// Route sends matching resources to its sinks. A route without sinks drops
+// the resources it matches
+type Route struct {
+	Name  string     `json:"name"`
+	Match RouteMatch `json:"match"`
+	Sinks []string   `json:"sinks"`
+}
+
+// Tenant is an HSDP sink which delivers with its own product key
+type Tenant struct {
+	Name       string `json:"name"`
+	ProductKey string `json:"productKey"`
+}
+
+// RoutingConfig lists the routes in the order they are tried. Resources
+// which match no route go to the Default sinks
+type RoutingConfig struct {
+	Routes  []Route  `json:"routes"`
+	Default []string `json:"default,omitempty"`
+	Tenants []Tenant `json:"tenants,omitempty"`
+}
+
+// LoadRoutingConfig reads a JSON routing config
+func LoadRoutingConfig(path string) (RoutingConfig, error) {
+	var config RoutingConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("routing config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+type matcher struct {
+	applicationName *regexp.Regexp
+	severity        map[string]bool
+	category        *regexp.Regexp
+	custom          map[string]*regexp.Regexp
+	message         *regexp.Regexp
+}
+
+type compiledRoute struct {
+	name  string
+	match matcher
+	sinks []string
+}
+
+// Router picks the sinks of a resource by the first route it matches
+type Router struct {
+	routes       []compiledRoute
+	defaultSinks []string
+}
+
+// NewRouter compiles the routes of config
+func NewRouter(config RoutingConfig) (*Router, error) {
+	r := &Router{defaultSinks: config.Default}
+	names := map[string]bool{DefaultRoute: true}
+	for _, route := range config.Routes {
+		if route.Name == "" {
+			return nil, errors.New("route without a name")
+		}
+		if names[route.Name] {
+			return nil, fmt.Errorf("duplicate route: %s", route.Name)
+		}
+		names[route.Name] = true
+		m, err := compileMatch(route.Match)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.Name, err)
+		}
+		r.routes = append(r.routes, compiledRoute{name: route.Name, match: m, sinks: route.Sinks})
+	}
+	return r, nil
+}
+
+func compileMatch(match RouteMatch) (matcher, error) {
+	var m matcher
+	var err error
+	compile := func(expr string) *regexp.Regexp {
+		if expr == "" || err != nil {
+			return nil
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(expr); err != nil {
+			err = fmt.Errorf("invalid expression %q: %w", expr, err)
+		}
+		return re
+	}
+	m.applicationName = compile(match.ApplicationName)
+	m.category = compile(match.Category)
+	m.message = compile(match.Message)
+	if len(match.Severity) > 0 {
+		m.severity = make(map[string]bool, len(match.Severity))
+		for _, severity := range match.Severity {
+			m.severity[strings.ToLower(severity)] = true
+		}
+	}
+	if len(match.Custom) > 0 {
+		m.custom = make(map[string]*regexp.Regexp, len(match.Custom))
+		for key, expr := range match.Custom {
+			if expr == "" {
+				expr = ".*"
+			}
+			m.custom[key] = compile(expr)
+		}
+	}
+	return m, err
+}
+
+// Sinks returns the names of all sinks the routes refer to
+func (r *Router) Sinks() []string {
+	var sinks []string
+	seen := make(map[string]bool)
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				sinks = append(sinks, name)
+			}
+		}
+	}
+	for _, route := range r.routes {
+		add(route.sinks)
+	}
+	add(r.defaultSinks)
+	return sinks
+}
+
+// Route returns the name of the route resource takes and its sinks
+func (r *Router) Route(resource logging.Resource) (string, []string) {
+	var custom map[string]interface{}
+	for _, route := range r.routes {
+		if route.match.custom != nil && custom == nil {
+			custom = make(map[string]interface{})
+			_ = json.Unmarshal(resource.Custom, &custom)
+		}
+		if route.match.matches(resource, custom) {
+			return route.name, route.sinks
+		}
+	}
+	return DefaultRoute, r.defaultSinks
+}
+
+func (m matcher) matches(resource logging.Resource, custom map[string]interface{}) bool {
+	if m.applicationName != nil && !m.applicationName.MatchString(resource.ApplicationName) {
+		return false
+	}
+	if m.severity != nil && !m.severity[strings.ToLower(resource.Severity)] {
+		return false
+	}
+	if m.category != nil && !m.category.MatchString(resource.Category) {
+		return false
+	}
+	for key, re := range m.custom {
+		value, ok := custom[key]
+		if !ok {
+			return false
+		}
+		if s, isString := value.(string); isString {
+			if !re.MatchString(s) {
+				return false
+			}
+			continue
+		}
+		data, _ := json.Marshal(value)
+		if !re.Match(data) {
+			return false
+		}
+	}
+	if m.message != nil && !m.message.MatchString(DecodeMessage(resource.LogData.Message)) {
+		return false
+	}
+	return true
+}
+
+// DecodeMessage returns the log message of a resource as text. Messages are
+// base64 encoded for delivery, messages which aren't are returned as is
+func DecodeMessage(message string) string {
+	if !Base64Pattern.MatchString(message) {
+		return message
+	}
+	decoded, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return message
+	}
+	return string(decoded)
+}
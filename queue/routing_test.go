@@ -0,0 +1,199 @@
+package queue_test
+
+import (
+	"encoding/base64"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRoutingConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	_ = os.WriteFile(path, []byte(`{
+  "routes": [{"name": "audit", "match": {"category": "^AuditLog$"}, "sinks": ["audit"]}],
+  "default": ["hsdp"],
+  "tenants": [{"name": "audit", "productKey": "key"}]
+}`), 0600)
+	config, err := queue.LoadRoutingConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, queue.RoutingConfig{
+		Routes:  []queue.Route{{Name: "audit", Match: queue.RouteMatch{Category: "^AuditLog$"}, Sinks: []string{"audit"}}},
+		Default: []string{"hsdp"},
+		Tenants: []queue.Tenant{{Name: "audit", ProductKey: "key"}},
+	}, config)
+
+	_ = os.WriteFile(path, []byte(`{"routes": [`), 0600)
+	_, err = queue.LoadRoutingConfig(path)
+	assert.NotNil(t, err)
+	_, err = queue.LoadRoutingConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestNewRouter(t *testing.T) {
+	for _, config := range []queue.RoutingConfig{
+		{Routes: []queue.Route{{Match: queue.RouteMatch{Category: "x"}}}},
+		{Routes: []queue.Route{{Name: "a"}, {Name: "a"}}},
+		{Routes: []queue.Route{{Name: queue.DefaultRoute}}},
+		{Routes: []queue.Route{{Name: "a", Match: queue.RouteMatch{Message: "("}}}},
+		{Routes: []queue.Route{{Name: "a", Match: queue.RouteMatch{Custom: map[string]string{"tenant": "["}}}}},
+	} {
+		_, err := queue.NewRouter(config)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestRouterRoute(t *testing.T) {
+	router, err := queue.NewRouter(queue.RoutingConfig{
+		Routes: []queue.Route{
+			{Name: "audit", Match: queue.RouteMatch{Category: "^AuditLog$"}, Sinks: []string{"audit"}},
+			{Name: "payments-errors", Match: queue.RouteMatch{
+				ApplicationName: "^payments",
+				Severity:        []string{"error", "critical"},
+			}, Sinks: []string{"hsdp", "siem"}},
+			{Name: "acme", Match: queue.RouteMatch{Custom: map[string]string{"tenant": "^acme$", "priority": "^[0-9]+$"}}, Sinks: []string{"acme"}},
+			{Name: "health", Match: queue.RouteMatch{Message: "GET /health"}},
+		},
+		Default: []string{"hsdp"},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"audit", "hsdp", "siem", "acme"}, router.Sinks())
+
+	for _, tc := range []struct {
+		resource logging.Resource
+		route    string
+		sinks    []string
+	}{
+		{logging.Resource{Category: "AuditLog"}, "audit", []string{"audit"}},
+		{logging.Resource{Category: "AuditLogs"}, queue.DefaultRoute, []string{"hsdp"}},
+		{logging.Resource{ApplicationName: "payments-api", Severity: "ERROR"}, "payments-errors", []string{"hsdp", "siem"}},
+		{logging.Resource{ApplicationName: "payments-api", Severity: "INFO"}, queue.DefaultRoute, []string{"hsdp"}},
+		{logging.Resource{Custom: []byte(`{"tenant":"acme","priority":3}`)}, "acme", []string{"acme"}},
+		{logging.Resource{Custom: []byte(`{"tenant":"acme"}`)}, queue.DefaultRoute, []string{"hsdp"}},
+		{logging.Resource{Custom: []byte(`not json`)}, queue.DefaultRoute, []string{"hsdp"}},
+		{logging.Resource{LogData: logging.LogData{Message: base64.StdEncoding.EncodeToString([]byte("GET /health 200"))}}, "health", nil},
+	} {
+		route, sinks := router.Route(tc.resource)
+		assert.Equal(t, tc.route, route)
+		assert.Equal(t, tc.sinks, sinks)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	assert.Equal(t, "hello world", queue.DecodeMessage(base64.StdEncoding.EncodeToString([]byte("hello world"))))
+	assert.Equal(t, "hello world", queue.DecodeMessage("hello world"))
+}
+
+// ackingQueue acknowledges the resources of a channel queue
+type ackingQueue struct {
+	queue.Queue
+	mu       sync.Mutex
+	acked    map[string]int
+	requeued map[string]int
+}
+
+func (a *ackingQueue) Ack(resources ...logging.Resource) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, resource := range resources {
+		a.acked[resource.ID]++
+	}
+	return nil
+}
+
+func (a *ackingQueue) Requeue(resources ...logging.Resource) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, resource := range resources {
+		a.requeued[resource.ID]++
+	}
+	return nil
+}
+
+func (a *ackingQueue) Acked() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return maps.Clone(a.acked)
+}
+
+func (a *ackingQueue) Requeued() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return maps.Clone(a.requeued)
+}
+
+type routeMetrics struct {
+	nilMetrics
+	mu     sync.Mutex
+	routed map[string]int
+}
+
+func (r *routeMetrics) IncRouted(route string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routed[route]++
+}
+
+func TestFanOutRouting(t *testing.T) {
+	primary := &countingStorer{}
+	audit := &countingStorer{}
+	siem := &countingStorer{}
+	router, _ := queue.NewRouter(queue.RoutingConfig{
+		Routes: []queue.Route{
+			{Name: "audit", Match: queue.RouteMatch{Severity: []string{"err"}}, Sinks: []string{"audit"}},
+			{Name: "both", Match: queue.RouteMatch{Severity: []string{"warning"}}, Sinks: []string{"hsdp", "audit", "siem"}},
+			{Name: "drop", Match: queue.RouteMatch{Severity: []string{"debug"}}},
+		},
+		Default: []string{"hsdp"},
+	})
+	m := &routeMetrics{routed: map[string]int{}}
+	fanOut, err := queue.NewFanOut([]queue.Sink{
+		newSink(t, "hsdp", primary, queue.WithMaxLinger(10*time.Millisecond)),
+		newSink(t, "audit", audit, queue.WithMaxLinger(10*time.Millisecond)),
+		bestEffortSink(t, "siem", siem, queue.WithMaxLinger(10*time.Millisecond)),
+	}, m, queue.WithRouter(router))
+	if !assert.Nil(t, err) {
+		return
+	}
+	channel, _ := queue.NewChannelQueue(queue.WithMetrics(&nilMetrics{}))
+	q := &ackingQueue{Queue: channel, acked: map[string]int{}, requeued: map[string]int{}}
+	done, _ := q.Start()
+	doneWorker := make(chan bool)
+	go fanOut.ResourceWorker(q, doneWorker, nil)
+	for _, severity := range []string{"info", "err", "warning", "warning", "debug"} {
+		assert.Nil(t, q.Push(messageWithSeverity(severity)))
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(q.Acked()) == 5
+	}, 2*time.Second, 5*time.Millisecond)
+	// Resources routed to two reliable sinks are acknowledged once
+	for _, count := range q.Acked() {
+		assert.Equal(t, 1, count)
+	}
+	assert.Equal(t, 3, primary.Stored())
+	assert.Equal(t, 3, audit.Stored())
+	assert.Equal(t, 2, siem.Stored())
+	m.mu.Lock()
+	assert.Equal(t, map[string]int{"default": 1, "audit": 1, "both": 2, "drop": 1}, m.routed)
+	m.mu.Unlock()
+	doneWorker <- true
+	done <- true
+}
+
+func TestFanOutRouterValidation(t *testing.T) {
+	router, _ := queue.NewRouter(queue.RoutingConfig{Default: []string{"missing"}})
+	_, err := queue.NewFanOut([]queue.Sink{newSink(t, "hsdp", &countingStorer{})}, &nilMetrics{}, queue.WithRouter(router))
+	assert.NotNil(t, err)
+	_, err = queue.NewFanOut([]queue.Sink{bestEffortSink(t, "hsdp", &countingStorer{})}, &nilMetrics{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,58 @@
+package queue
+
+import "strings"
+
+var severityRanks = map[string]int{
+	"trace":         0,
+	"debug":         1,
+	"info":          2,
+	"information":   2,
+	"informational": 2,
+	"notice":        3,
+	"warn":          4,
+	"warning":       4,
+	"err":           5,
+	"error":         5,
+	"crit":          6,
+	"critical":      6,
+	"fatal":         6,
+	"alert":         7,
+	"emerg":         8,
+	"emergency":     8,
+	"panic":         8,
+}
+
+// SeverityRank orders severities from trace (0) to emergency (8). Unknown
+// severities are treated as informational
+func SeverityRank(severity string) int {
+	if rank, ok := severityRanks[strings.ToLower(strings.TrimSpace(severity))]; ok {
+		return rank
+	}
+	return severityRanks["info"]
+}
+
+// Priority is a delivery lane. Lower values are delivered first
+type Priority int
+
+const (
+	// PriorityHigh carries err and more severe messages
+	PriorityHigh Priority = iota
+	// PriorityWarn carries warnings
+	PriorityWarn
+	// PriorityLow carries everything else
+	PriorityLow
+
+	// Priorities is the number of priority lanes
+	Priorities = 3
+)
+
+// SeverityPriority returns the lane of a message with the given severity
+func SeverityPriority(severity string) Priority {
+	switch rank := SeverityRank(severity); {
+	case rank >= severityRanks["err"]:
+		return PriorityHigh
+	case rank >= severityRanks["warn"]:
+		return PriorityWarn
+	}
+	return PriorityLow
+}
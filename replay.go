@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+	"github.com/philips-software/logproxy/shared"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type nopMetrics struct{}
+
+func (n nopMetrics) IncProcessed()                       {}
+func (n nopMetrics) IncEnhancedTransactionID()           {}
+func (n nopMetrics) IncEnhancedEncodedMessage()          {}
+func (n nopMetrics) IncPluginDropped()                   {}
+func (n nopMetrics) IncPluginModified()                  {}
+func (n nopMetrics) IncQueueOverflow(_ string)           {}
+func (n nopMetrics) IncParseFailed()                     {}
+func (n nopMetrics) ObserveBatch(_ int, _ time.Duration) {}
+func (n nopMetrics) SetBatchesInFlight(_ int)            {}
+func (n nopMetrics) IncPartialFailure(_ string, _ int)   {}
+func (n nopMetrics) IncSinkDropped(_, _ string)          {}
+func (n nopMetrics) IncRouted(_ string)                  {}
+
+var _ queue.Metrics = (*nopMetrics)(nil)
+
+// replayMain implements the `logproxy replay` subcommand which pushes
+// stored dead letters through the Deliverer again
+func replayMain(args []string) int {
+	logger := log.New()
+	logger.SetOutput(os.Stderr)
+	setupConfig()
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	source := flags.String("source", viper.GetString("deadletter"), "dead letter store to replay from (file, rabbitmq)")
+	file := flags.String("file", viper.GetString("deadletter_file"), "dead letter file when using the file source")
+	dryRun := flags.Bool("dry-run", false, "read and filter dead letters without delivering or removing them")
+	filter := flags.Bool("filter", false, "run plugin filters again before redelivery")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	viper.Set("deadletter_file", *file)
+
+	store, err := setupDeadLetterStore(*source)
+	if err != nil {
+		logger.Errorf("dead letter store error: %v", err)
+		return 8
+	}
+	if store == nil {
+		logger.Errorf("no dead letter source selected, use -source")
+		return 8
+	}
+
+	var pluginManager = setupPluginManager()
+	if !*filter {
+		pluginManager = nil
+	}
+	sinks, exitCode := replaySinks(logger, pluginManager, *dryRun)
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats, err := queue.ReplaySinks(ctx, store, sinks, queue.ReplayOptions{
+		DryRun: *dryRun,
+		Filter: *filter,
+		Progress: func(stats queue.ReplayStats) {
+			fmt.Fprintf(os.Stderr, "replay progress: %d/%d processed, %d replayed, %d dropped, %d failed, %d skipped\n",
+				stats.Processed, stats.Total, stats.Replayed, stats.Dropped, stats.Failed, stats.Skipped)
+		},
+	})
+	fmt.Fprintf(os.Stderr, "replay finished: %d/%d processed, %d replayed, %d dropped, %d failed, %d skipped (dry-run: %t)\n",
+		stats.Processed, stats.Total, stats.Replayed, stats.Dropped, stats.Failed, stats.Skipped, stats.DryRun)
+	if err != nil {
+		logger.Errorf("replay error: %v", err)
+		return 9
+	}
+	return 0
+}
+
+// replaySinks returns the configured delivery sinks and tenants, so dead
+// letters are replayed to the sink which rejected them. A dry run uses none
+// sinks with the same names
+func replaySinks(logger *log.Logger, manager *shared.PluginManager, dryRun bool) ([]queue.Sink, int) {
+	names := deliverySinks(logger, viper.GetString("delivery"))
+	if slices.Contains(names, "buffer") {
+		logger.Errorf("buffer delivery has no sinks to replay to")
+		return nil, 21
+	}
+	if !dryRun {
+		config, exitCode := setupLoggingConfig(logger, os.Getenv("DEBUG") == "true")
+		if exitCode != 0 {
+			return nil, exitCode
+		}
+		sinks, _, err := setupSinks(names, config, logger, manager, nopMetrics{})
+		if err != nil {
+			logger.Errorf("failed to setup delivery: %s", err)
+			return nil, 20
+		}
+		return sinks, 0
+	}
+	if path := viper.GetString("routes_file"); path != "" {
+		routing, err := queue.LoadRoutingConfig(path)
+		if err != nil {
+			logger.Errorf("failed to setup delivery: %s", err)
+			return nil, 20
+		}
+		for _, tenant := range routing.Tenants {
+			names = append(names, tenant.Name)
+		}
+	}
+	sinks := make([]queue.Sink, 0, len(names))
+	for i, name := range names {
+		sinkManager := manager
+		if i > 0 {
+			sinkManager = nil
+		}
+		deliverer, err := setupNoneDeliverer(logger, sinkManager, buildVersion, nopMetrics{})
+		if err != nil {
+			logger.Errorf("failed to setup Deliverer: %s", err)
+			return nil, 20
+		}
+		sinks = append(sinks, queue.Sink{Name: name, Deliverer: deliverer})
+	}
+	return sinks, 0
+}
@@ -49,6 +49,8 @@ type Plugin struct {
 	Path string   `json:"path,omitempty"`
 	Args []string `json:"args"`
 	App  Filter
+
+	client *plugin.Client
 }
 
 // Load loads the plugin specified by the Path and instantiates the
@@ -71,8 +73,10 @@ func (p *Plugin) Load() error {
 	// Request the client
 	rpcClient, err := pluginClient.Client()
 	if err != nil {
+		pluginClient.Kill()
 		return err
 	}
+	p.client = pluginClient
 
 	raw, err := rpcClient.Dispense("filter")
 	if err != nil {
@@ -83,6 +87,13 @@ func (p *Plugin) Load() error {
 	return nil
 }
 
+// Kill stops the plugin process. It is a no-op when the plugin isn't loaded.
+func (p *Plugin) Kill() {
+	if p.client != nil {
+		p.client.Kill()
+	}
+}
+
 func (p *Plugin) String() string {
 	path := p.Path
 
@@ -169,3 +180,10 @@ func (m *PluginManager) LoadAll() error {
 
 	return merr
 }
+
+// KillAll stops every loaded plugin.
+func (m *PluginManager) KillAll() {
+	for _, plugin := range m.Plugins() {
+		plugin.Kill()
+	}
+}
@@ -33,4 +33,5 @@ func TestPluginManager(t *testing.T) {
 	assert.NotNil(t, err)
 
 	assert.Equal(t, 1, len(pluginManager.Plugins()))
+	pluginManager.KillAll()
 }
@@ -0,0 +1,316 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+)
+
+var (
+	// ErrElasticsearchStatus is returned when the _bulk request fails as a whole
+	ErrElasticsearchStatus = errors.New("unexpected elasticsearch status")
+	// ErrElasticsearchItems is returned when documents failed transiently
+	ErrElasticsearchItems = errors.New("elasticsearch rejected documents temporarily")
+
+	indexPlaceholder = regexp.MustCompile(`\{([a-zA-Z]+)(?::([^}]*))?\}`)
+	invalidIndexChar = regexp.MustCompile(`[^a-z0-9._+-]`)
+)
+
+// Elasticsearch writes batches of resources to Elasticsearch or OpenSearch
+// with the _bulk API. Documents use the resource ID as _id, so resending a
+// batch doesn't duplicate documents. Documents which are rejected are handed
+// back as failed, the Deliverer dead letters them and resends the others
+type Elasticsearch struct {
+	url        string
+	index      []indexPart
+	client     *http.Client
+	username   string
+	password   string
+	apiKey     string
+	dataStream bool
+	decode     bool
+}
+
+var _ logging.Storer = &Elasticsearch{}
+
+// indexPart is a literal or a placeholder of an index name template
+type indexPart struct {
+	literal string
+	field   string
+	layout  string
+}
+
+// ElasticsearchOption configures an Elasticsearch sink
+type ElasticsearchOption func(e *Elasticsearch) error
+
+// WithElasticsearchBasicAuth authenticates with a username and password
+func WithElasticsearchBasicAuth(username, password string) ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		e.username = username
+		e.password = password
+		return nil
+	}
+}
+
+// WithElasticsearchAPIKey authenticates with a base64 encoded API key
+func WithElasticsearchAPIKey(apiKey string) ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		e.apiKey = apiKey
+		return nil
+	}
+}
+
+// WithElasticsearchTimeout limits the time a request may take, 10s by default
+func WithElasticsearchTimeout(timeout time.Duration) ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		e.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithElasticsearchHTTPClient sends the requests with client
+func WithElasticsearchHTTPClient(client *http.Client) ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		e.client = client
+		return nil
+	}
+}
+
+// WithDataStreams writes to data streams. The index template names the data
+// stream and documents are created instead of indexed, as data streams
+// require. A document which already exists counts as delivered
+func WithDataStreams() ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		e.dataStream = true
+		return nil
+	}
+}
+
+// WithElasticsearchDecodedMessages indexes the log message as text instead of base64
+func WithElasticsearchDecodedMessages() ElasticsearchOption {
+	return func(e *Elasticsearch) error {
+		e.decode = true
+		return nil
+	}
+}
+
+// NewElasticsearch returns an Elasticsearch sink which posts to the _bulk API
+// of rawURL. index is a template for the index name. It may contain the
+// placeholders {applicationName}, {serviceName}, {category}, {component},
+// {severity} and {date:layout}, which formats the log time with a Go time
+// layout. Index names are lowercased and characters Elasticsearch doesn't
+// allow are replaced by dashes
+func NewElasticsearch(rawURL, index string, opts ...ElasticsearchOption) (*Elasticsearch, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("elasticsearch url must be an absolute http(s) URL: %q", rawURL)
+	}
+	parts, err := parseIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	e := &Elasticsearch{
+		url:    strings.TrimSuffix(rawURL, "/") + "/_bulk",
+		index:  parts,
+		client: &http.Client{Timeout: defaultWebhookTimeout},
+	}
+	for _, o := range opts {
+		if err := o(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func parseIndex(index string) ([]indexPart, error) {
+	if index == "" {
+		return nil, errors.New("empty index name")
+	}
+	var parts []indexPart
+	last := 0
+	for _, match := range indexPlaceholder.FindAllStringSubmatchIndex(index, -1) {
+		if match[0] > last {
+			parts = append(parts, indexPart{literal: index[last:match[0]]})
+		}
+		part := indexPart{field: index[match[2]:match[3]]}
+		if match[4] >= 0 {
+			part.layout = index[match[4]:match[5]]
+		}
+		switch part.field {
+		case "applicationName", "serviceName", "category", "component", "severity":
+		case "date":
+			if part.layout == "" {
+				part.layout = "2006.01.02"
+			}
+		default:
+			return nil, fmt.Errorf("unknown index placeholder: {%s}", part.field)
+		}
+		parts = append(parts, part)
+		last = match[1]
+	}
+	if last < len(index) {
+		parts = append(parts, indexPart{literal: index[last:]})
+	}
+	return parts, nil
+}
+
+// Index returns the index name of resource
+func (e *Elasticsearch) Index(resource logging.Resource) string {
+	var name strings.Builder
+	for _, part := range e.index {
+		switch part.field {
+		case "":
+			name.WriteString(part.literal)
+		case "applicationName":
+			name.WriteString(resource.ApplicationName)
+		case "serviceName":
+			name.WriteString(resource.ServiceName)
+		case "category":
+			name.WriteString(resource.Category)
+		case "component":
+			name.WriteString(resource.Component)
+		case "severity":
+			name.WriteString(resource.Severity)
+		case "date":
+			logTime, err := time.Parse(time.RFC3339, resource.LogTime)
+			if err != nil {
+				logTime = time.Now()
+			}
+			name.WriteString(logTime.UTC().Format(part.layout))
+		}
+	}
+	return invalidIndexChar.ReplaceAllString(strings.ToLower(name.String()), "-")
+}
+
+type bulkAction struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id,omitempty"`
+}
+
+// document is the indexed form of a resource
+type document struct {
+	Timestamp string `json:"@timestamp"`
+	logging.Resource
+}
+
+type bulkItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+// StoreResources indexes the resources
+func (e *Elasticsearch) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	op := "index"
+	if e.dataStream {
+		op = "create"
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for i := 0; i < count; i++ {
+		resource := msgs[i]
+		if e.decode {
+			resource.LogData.Message = queue.DecodeMessage(resource.LogData.Message)
+		}
+		action := map[string]bulkAction{op: {Index: e.Index(resource), ID: resource.ID}}
+		if err := encoder.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(document{Timestamp: resource.LogTime, Resource: resource}); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if e.username != "" || e.password != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.apiKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	storeResp := &logging.StoreResponse{Response: resp}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return storeResp, fmt.Errorf("%w: %d", ErrElasticsearchStatus, resp.StatusCode)
+	}
+	var bulk bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&bulk); err != nil {
+		return storeResp, fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if !bulk.Errors {
+		return storeResp, nil
+	}
+	return e.itemErrors(storeResp, msgs[:count], bulk.Items)
+}
+
+// itemErrors reports the documents which were rejected. When documents only
+// failed temporarily the response is turned into a 429, so the Deliverer
+// retries the batch with backoff
+func (e *Elasticsearch) itemErrors(storeResp *logging.StoreResponse, msgs []logging.Resource, items []map[string]bulkItem) (*logging.StoreResponse, error) {
+	var transient int
+	for i, result := range items {
+		if i >= len(msgs) {
+			break
+		}
+		for _, item := range result {
+			switch {
+			case item.Status >= 200 && item.Status < 300:
+			case item.Status == http.StatusConflict && e.dataStream:
+				// Created by an earlier attempt
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				transient++
+			default:
+				failed := msgs[i]
+				failed.Error = fmt.Errorf("elasticsearch status %d", item.Status)
+				if item.Error != nil {
+					failed.Error = fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)
+				}
+				storeResp.Failed = append(storeResp.Failed, failed)
+			}
+		}
+	}
+	if len(storeResp.Failed) > 0 {
+		return storeResp, logging.ErrBatchErrors
+	}
+	if transient > 0 {
+		retry := *storeResp.Response
+		retry.StatusCode = http.StatusTooManyRequests
+		storeResp.Response = &retry
+		return storeResp, fmt.Errorf("%w: %d documents", ErrElasticsearchItems, transient)
+	}
+	return storeResp, nil
+}
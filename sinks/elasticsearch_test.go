@@ -0,0 +1,185 @@
+package sinks_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkServer answers _bulk requests with the status items returns per document
+func bulkServer(t *testing.T, items func(action map[string]map[string]string) (int, string)) (*httptest.Server, *[]string) {
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		var results []string
+		var hasErrors bool
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &action))
+			lines = append(lines, scanner.Text())
+			scanner.Scan()
+			lines = append(lines, scanner.Text())
+			status, errorType := items(action)
+			for op := range action {
+				result := fmt.Sprintf(`{"%s":{"_id":%q,"status":%d}}`, op, action[op]["_id"], status)
+				if errorType != "" {
+					hasErrors = true
+					result = fmt.Sprintf(`{"%s":{"_id":%q,"status":%d,"error":{"type":%q,"reason":"bad document"}}}`,
+						op, action[op]["_id"], status, errorType)
+				}
+				results = append(results, result)
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, hasErrors, strings.Join(results, ","))
+	}))
+	return server, &lines
+}
+
+func TestNewElasticsearch(t *testing.T) {
+	for _, rawURL := range []string{"", "ftp://example.com", "/relative", "http://%zz"} {
+		_, err := sinks.NewElasticsearch(rawURL, "logs")
+		assert.NotNil(t, err, rawURL)
+	}
+	for _, index := range []string{"", "logs-{unknown}"} {
+		_, err := sinks.NewElasticsearch("https://example.com", index)
+		assert.NotNil(t, err, index)
+	}
+	_, err := sinks.NewElasticsearch("https://example.com", "logs", sinks.WithElasticsearchTimeout(0))
+	assert.NotNil(t, err)
+}
+
+func TestElasticsearchIndex(t *testing.T) {
+	es, err := sinks.NewElasticsearch("https://example.com", "logs-{applicationName}-{severity}-{date:2006.01}-{date}")
+	if !assert.Nil(t, err) {
+		return
+	}
+	resource := logging.Resource{
+		ApplicationName: "My App/1",
+		Severity:        "INFO",
+		LogTime:         "2024-03-05T10:00:00Z",
+	}
+	assert.Equal(t, "logs-my-app-1-info-2024.03-2024.03.05", es.Index(resource))
+
+	resource.LogTime = "not a time"
+	// Without a log time the current date is used
+	assert.True(t, strings.HasPrefix(es.Index(resource), "logs-my-app-1-info-"+time.Now().UTC().Format("2006.01")))
+}
+
+func TestElasticsearch(t *testing.T) {
+	server, lines := bulkServer(t, func(_ map[string]map[string]string) (int, string) {
+		return http.StatusCreated, ""
+	})
+	defer server.Close()
+
+	es, err := sinks.NewElasticsearch(server.URL+"/", "logs-{applicationName}",
+		sinks.WithElasticsearchAPIKey("key"),
+		sinks.WithElasticsearchDecodedMessages())
+	if !assert.Nil(t, err) {
+		return
+	}
+	msgs := resources(3)
+	msgs[0].LogTime = "2024-03-05T10:00:00Z"
+	resp, err := es.StoreResources(msgs, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	if !assert.Len(t, *lines, 4) {
+		return
+	}
+	assert.JSONEq(t, `{"index":{"_index":"logs-app","_id":"a"}}`, (*lines)[0])
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte((*lines)[1]), &doc))
+	assert.Equal(t, "2024-03-05T10:00:00Z", doc["@timestamp"])
+	assert.Equal(t, "hello world", doc["logData"].(map[string]interface{})["message"])
+}
+
+func TestElasticsearchEmptyID(t *testing.T) {
+	server, lines := bulkServer(t, func(_ map[string]map[string]string) (int, string) {
+		return http.StatusCreated, ""
+	})
+	defer server.Close()
+
+	es, _ := sinks.NewElasticsearch(server.URL, "logs")
+	msgs := resources(1)
+	msgs[0].ID = ""
+	_, err := es.StoreResources(msgs, 1)
+	assert.Nil(t, err)
+	// Elasticsearch generates the ID when the action has none
+	if assert.Len(t, *lines, 2) {
+		assert.JSONEq(t, `{"index":{"_index":"logs"}}`, (*lines)[0])
+	}
+}
+
+func TestElasticsearchItemErrors(t *testing.T) {
+	server, _ := bulkServer(t, func(action map[string]map[string]string) (int, string) {
+		if action["index"]["_id"] == "b" {
+			return http.StatusBadRequest, "mapper_parsing_exception"
+		}
+		return http.StatusCreated, ""
+	})
+	defer server.Close()
+
+	es, _ := sinks.NewElasticsearch(server.URL, "logs")
+	resp, err := es.StoreResources(resources(3), 3)
+	assert.True(t, errors.Is(err, logging.ErrBatchErrors))
+	if assert.Len(t, resp.Failed, 1) {
+		assert.Equal(t, "b", resp.Failed[0].ID)
+		assert.Equal(t, "mapper_parsing_exception: bad document", resp.Failed[0].Error.Error())
+	}
+}
+
+func TestElasticsearchTransientItems(t *testing.T) {
+	server, _ := bulkServer(t, func(_ map[string]map[string]string) (int, string) {
+		return http.StatusTooManyRequests, "es_rejected_execution_exception"
+	})
+	defer server.Close()
+
+	es, _ := sinks.NewElasticsearch(server.URL, "logs")
+	resp, err := es.StoreResources(resources(2), 2)
+	assert.True(t, errors.Is(err, sinks.ErrElasticsearchItems))
+	// Reported as throttled so the whole batch is retried
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.Len(t, resp.Failed, 0)
+}
+
+func TestElasticsearchDataStreams(t *testing.T) {
+	server, lines := bulkServer(t, func(_ map[string]map[string]string) (int, string) {
+		return http.StatusConflict, "version_conflict_engine_exception"
+	})
+	defer server.Close()
+
+	es, _ := sinks.NewElasticsearch(server.URL, "logs-{applicationName}-default",
+		sinks.WithDataStreams(),
+		sinks.WithElasticsearchBasicAuth("user", "pass"))
+	// Documents which were created by an earlier attempt count as delivered
+	resp, err := es.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+	assert.Len(t, resp.Failed, 0)
+	if assert.Len(t, *lines, 2) {
+		assert.JSONEq(t, `{"create":{"_index":"logs-app-default","_id":"a"}}`, (*lines)[0])
+	}
+}
+
+func TestElasticsearchStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	es, _ := sinks.NewElasticsearch(server.URL, "logs")
+	resp, err := es.StoreResources(resources(1), 1)
+	assert.True(t, errors.Is(err, sinks.ErrElasticsearchStatus))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode())
+}
@@ -0,0 +1,300 @@
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+)
+
+const rotateTimeFormat = "20060102T150405.000000000"
+
+// File writes delivered resources as newline delimited JSON to a file or
+// to stdout. Files are rotated by size and age, rotated files can be
+// compressed with gzip
+type File struct {
+	path       string
+	decode     bool
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu       sync.Mutex
+	out      io.Writer
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+var _ logging.Storer = &File{}
+
+// FileOption configures a File sink
+type FileOption func(f *File) error
+
+// WithDecodedMessages writes the log message as text instead of base64
+func WithDecodedMessages() FileOption {
+	return func(f *File) error {
+		f.decode = true
+		return nil
+	}
+}
+
+// WithMaxSize rotates the file before it grows beyond bytes
+func WithMaxSize(bytes int64) FileOption {
+	return func(f *File) error {
+		if bytes < 0 {
+			return fmt.Errorf("invalid maximum file size: %d", bytes)
+		}
+		f.maxSize = bytes
+		return nil
+	}
+}
+
+// WithMaxAge rotates the file once it is older than age
+func WithMaxAge(age time.Duration) FileOption {
+	return func(f *File) error {
+		if age < 0 {
+			return fmt.Errorf("invalid maximum file age: %v", age)
+		}
+		f.maxAge = age
+		return nil
+	}
+}
+
+// WithMaxBackups removes the oldest rotated files when there are more than
+// backups of them. Zero keeps all rotated files
+func WithMaxBackups(backups int) FileOption {
+	return func(f *File) error {
+		if backups < 0 {
+			return fmt.Errorf("invalid number of backups: %d", backups)
+		}
+		f.maxBackups = backups
+		return nil
+	}
+}
+
+// WithFileWriter writes to w instead of the standard output when the path
+// is stdout
+func WithFileWriter(w io.Writer) FileOption {
+	return func(f *File) error {
+		if w == nil {
+			return errors.New("missing file writer")
+		}
+		f.out = w
+		return nil
+	}
+}
+
+// WithCompression compresses rotated files with gzip
+func WithCompression() FileOption {
+	return func(f *File) error {
+		f.compress = true
+		return nil
+	}
+}
+
+// WritesToStdout reports whether a File sink for path writes to stdout
+func WritesToStdout(path string) bool {
+	switch path {
+	case "", "-", "stdout":
+		return true
+	}
+	return false
+}
+
+// NewFile returns a File sink writing to path. An empty path or "-" writes
+// to stdout or the writer of WithFileWriter, "stderr" writes to stderr.
+// Those are never rotated
+func NewFile(path string, opts ...FileOption) (*File, error) {
+	f := &File{path: path}
+	for _, o := range opts {
+		if err := o(f); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case WritesToStdout(path):
+		if f.out == nil {
+			f.out = os.Stdout
+		}
+	case path == "stderr":
+		f.out = os.Stderr
+	default:
+		if err := f.open(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.out = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// StoreResources appends the resources to the file. A failed rotation is
+// reported but doesn't fail the batch as long as a file is open, a file which
+// could not be opened again is reopened by the next batch
+func (f *File) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := 0; i < count; i++ {
+		resource := msgs[i]
+		if f.decode {
+			resource.LogData.Message = queue.DecodeMessage(resource.LogData.Message)
+		}
+		if err := encoder.Encode(resource); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.rotationDue(int64(buf.Len())) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "error rotating %s: %v\n", f.path, err)
+		}
+	}
+	if f.out == nil {
+		if err := f.open(); err != nil {
+			return nil, fmt.Errorf("opening %s: %w", f.path, err)
+		}
+	}
+	n, err := f.out.Write(buf.Bytes())
+	f.size += int64(n)
+	if err != nil {
+		return nil, err
+	}
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func (f *File) rotationDue(size int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+size > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.openedAt) >= f.maxAge
+}
+
+// rotate moves the current file aside and opens a new one. When the file
+// can't be moved it is opened again and written to beyond its limits
+func (f *File) rotate() error {
+	err := f.file.Close()
+	f.file, f.out = nil, nil
+	if err != nil {
+		return err
+	}
+	rotated := f.path + "." + time.Now().UTC().Format(rotateTimeFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return errors.Join(err, f.open())
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.compress {
+		if err := compressFile(rotated); err != nil {
+			return err
+		}
+	}
+	return f.removeBackups()
+}
+
+// Rotated returns the rotated files, oldest first
+func (f *File) Rotated() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, f.path+"."), ".gz")
+		if _, err := time.Parse(rotateTimeFormat, stamp); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+func (f *File) removeBackups() error {
+	if f.maxBackups == 0 {
+		return nil
+	}
+	rotated, err := f.Rotated()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for len(rotated) > f.maxBackups {
+		errs = append(errs, os.Remove(rotated[0]))
+		rotated = rotated[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// compressFile replaces path with a gzip compressed path.gz
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file, f.out = nil, nil
+	return err
+}
@@ -0,0 +1,184 @@
+package sinks_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func resources(count int) []logging.Resource {
+	msgs := make([]logging.Resource, count)
+	for i := range msgs {
+		msgs[i] = logging.Resource{
+			ID:              string(rune('a' + i)),
+			ApplicationName: "app",
+			LogData:         logging.LogData{Message: base64.StdEncoding.EncodeToString([]byte("hello world"))},
+		}
+	}
+	return msgs
+}
+
+func readLines(t *testing.T, path string) []logging.Resource {
+	file, err := os.Open(path)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var reader = bufio.NewScanner(file)
+	if filepath.Ext(path) == ".gz" {
+		zr, err := gzip.NewReader(file)
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		reader = bufio.NewScanner(zr)
+	}
+	var lines []logging.Resource
+	for reader.Scan() {
+		var resource logging.Resource
+		assert.Nil(t, json.Unmarshal(reader.Bytes(), &resource))
+		lines = append(lines, resource)
+	}
+	return lines
+}
+
+func TestFileOptions(t *testing.T) {
+	for _, opt := range []sinks.FileOption{
+		sinks.WithMaxSize(-1),
+		sinks.WithMaxAge(-time.Second),
+		sinks.WithMaxBackups(-1),
+		sinks.WithFileWriter(nil),
+	} {
+		_, err := sinks.NewFile("-", opt)
+		assert.NotNil(t, err)
+	}
+	_, err := sinks.NewFile(filepath.Join(t.TempDir(), "missing", "logs.ndjson"))
+	assert.NotNil(t, err)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	file, err := sinks.NewFile(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	msgs := resources(3)
+	resp, err := file.StoreResources(msgs, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode())
+	assert.Nil(t, file.Close())
+
+	// Appends to an existing file
+	file, _ = sinks.NewFile(path, sinks.WithDecodedMessages())
+	_, err = file.StoreResources(msgs[2:], 1)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	lines := readLines(t, path)
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "a", lines[0].ID)
+		assert.Equal(t, msgs[0].LogData.Message, lines[0].LogData.Message)
+		assert.Equal(t, "c", lines[2].ID)
+		assert.Equal(t, "hello world", lines[2].LogData.Message)
+	}
+	// The batch of the caller is left alone
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("hello world")), msgs[2].LogData.Message)
+}
+
+func TestFileWriter(t *testing.T) {
+	var buf bytes.Buffer
+	file, err := sinks.NewFile("-", sinks.WithFileWriter(&buf))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = file.StoreResources(resources(2), 2)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if assert.Len(t, lines, 2) {
+		var resource logging.Resource
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &resource))
+		assert.Equal(t, "b", resource.ID)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	file, err := sinks.NewFile(path, sinks.WithMaxSize(300), sinks.WithCompression(), sinks.WithMaxBackups(2))
+	if !assert.Nil(t, err) {
+		return
+	}
+	msgs := resources(1)
+	for i := 0; i < 8; i++ {
+		_, err := file.StoreResources(msgs, 1)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, file.Close())
+
+	rotated, err := file.Rotated()
+	assert.Nil(t, err)
+	if assert.Len(t, rotated, 2) {
+		assert.Equal(t, ".gz", filepath.Ext(rotated[0]))
+		assert.NotEmpty(t, readLines(t, rotated[1]))
+	}
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.LessOrEqual(t, info.Size(), int64(300))
+	}
+}
+
+func TestFileRotationByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	file, err := sinks.NewFile(path, sinks.WithMaxAge(20*time.Millisecond))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, _ = file.StoreResources(resources(1), 1)
+	_, _ = file.StoreResources(resources(1), 1)
+	time.Sleep(30 * time.Millisecond)
+	_, _ = file.StoreResources(resources(1), 1)
+	assert.Nil(t, file.Close())
+
+	rotated, _ := file.Rotated()
+	if assert.Len(t, rotated, 1) {
+		assert.Len(t, readLines(t, rotated[0]), 2)
+	}
+	assert.Len(t, readLines(t, path), 1)
+}
+
+func TestFileRotationFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	assert.Nil(t, os.Mkdir(dir, 0700))
+	path := filepath.Join(dir, "logs.ndjson")
+	file, err := sinks.NewFile(path, sinks.WithMaxSize(100))
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = file.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+
+	// Neither rotating nor opening the file again works
+	assert.Nil(t, os.RemoveAll(dir))
+	_, err = file.StoreResources(resources(1), 1)
+	assert.NotNil(t, err)
+
+	// The file is reopened once its directory is back
+	assert.Nil(t, os.Mkdir(dir, 0700))
+	_, err = file.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	assert.Len(t, readLines(t, path), 1)
+}
@@ -0,0 +1,263 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+)
+
+const (
+	lokiPushPath = "/loki/api/v1/push"
+
+	// lokiUnknown is the value of labels whose field is empty, Loki drops
+	// labels without a value
+	lokiUnknown = "unknown"
+)
+
+var (
+	// ErrLokiStatus is returned when Loki answers with a status other than 2xx
+	ErrLokiStatus = errors.New("unexpected loki status")
+
+	lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// lokiFields are the resource fields which can be used as stream labels
+	lokiFields = map[string]struct {
+		label string
+		value func(r logging.Resource) string
+	}{
+		"applicationName": {"application_name", func(r logging.Resource) string { return r.ApplicationName }},
+		"serverName":      {"server_name", func(r logging.Resource) string { return r.ServerName }},
+		"severity":        {"severity", func(r logging.Resource) string { return r.Severity }},
+	}
+)
+
+// Loki pushes batches of resources to Grafana Loki. Resources are grouped in
+// streams by their labels and the decoded log message is the log line
+type Loki struct {
+	url      string
+	client   *http.Client
+	fields   []string
+	static   map[string]string
+	tenant   string
+	username string
+	password string
+}
+
+var _ logging.Storer = &Loki{}
+
+// LokiOption configures a Loki sink
+type LokiOption func(l *Loki) error
+
+// WithLokiLabels sets the fields which become stream labels, out of
+// applicationName, serverName and severity. All three are used by default
+func WithLokiLabels(fields ...string) LokiOption {
+	return func(l *Loki) error {
+		for _, field := range fields {
+			if _, ok := lokiFields[field]; !ok {
+				return fmt.Errorf("unsupported label field: %s", field)
+			}
+		}
+		l.fields = fields
+		return nil
+	}
+}
+
+// WithLokiStaticLabel adds a label with a fixed value to every stream
+func WithLokiStaticLabel(name, value string) LokiOption {
+	return func(l *Loki) error {
+		if !lokiLabelName.MatchString(name) {
+			return fmt.Errorf("invalid label name: %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("empty value for label %s", name)
+		}
+		l.static[name] = value
+		return nil
+	}
+}
+
+// WithLokiTenant pushes to a tenant of a multi-tenant Loki
+func WithLokiTenant(tenant string) LokiOption {
+	return func(l *Loki) error {
+		l.tenant = tenant
+		return nil
+	}
+}
+
+// WithLokiBasicAuth authenticates with a username and password
+func WithLokiBasicAuth(username, password string) LokiOption {
+	return func(l *Loki) error {
+		l.username = username
+		l.password = password
+		return nil
+	}
+}
+
+// WithLokiTimeout limits the time a request may take, 10s by default
+func WithLokiTimeout(timeout time.Duration) LokiOption {
+	return func(l *Loki) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		l.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithLokiHTTPClient sends the requests with client
+func WithLokiHTTPClient(client *http.Client) LokiOption {
+	return func(l *Loki) error {
+		l.client = client
+		return nil
+	}
+}
+
+// NewLoki returns a Loki sink. rawURL is the base URL of Loki, the push API
+// path is added when the URL has no path
+func NewLoki(rawURL string, opts ...LokiOption) (*Loki, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("loki url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("loki url must be an absolute http(s) URL: %q", rawURL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+	l := &Loki{
+		url:    u.String(),
+		client: &http.Client{Timeout: defaultWebhookTimeout},
+		fields: []string{"applicationName", "serverName", "severity"},
+		static: make(map[string]string),
+	}
+	for _, o := range opts {
+		if err := o(l); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Labels returns the stream labels of resource
+func (l *Loki) Labels(resource logging.Resource) map[string]string {
+	labels := make(map[string]string, len(l.fields)+len(l.static))
+	for name, value := range l.static {
+		labels[name] = value
+	}
+	for _, field := range l.fields {
+		value := lokiFields[field].value(resource)
+		if value == "" {
+			value = lokiUnknown
+		}
+		labels[lokiFields[field].label] = value
+	}
+	return labels
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPush struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+// StoreResources pushes the resources
+func (l *Loki) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	var push lokiPush
+	streams := make(map[string]*lokiStream)
+	entries := make(map[*lokiStream][]lokiEntry)
+	for i := 0; i < count; i++ {
+		labels := l.Labels(msgs[i])
+		key := streamKey(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			push.Streams = append(push.Streams, stream)
+		}
+		logTime, err := time.Parse(time.RFC3339, msgs[i].LogTime)
+		if err != nil {
+			logTime = time.Now()
+		}
+		entries[stream] = append(entries[stream], lokiEntry{
+			time: logTime,
+			line: queue.DecodeMessage(msgs[i].LogData.Message),
+		})
+	}
+	// Older Loki versions reject entries which are out of order
+	for _, stream := range push.Streams {
+		streamEntries := entries[stream]
+		sort.SliceStable(streamEntries, func(i, j int) bool {
+			return streamEntries[i].time.Before(streamEntries[j].time)
+		})
+		for _, entry := range streamEntries {
+			stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.time.UnixNano(), 10), entry.line})
+		}
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	if l.username != "" || l.password != "" {
+		req.SetBasicAuth(l.username, l.password)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	storeResp := &logging.StoreResponse{Response: resp}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return storeResp, fmt.Errorf("%w: %d", ErrLokiStatus, resp.StatusCode)
+	}
+	return storeResp, nil
+}
+
+// streamKey identifies a label set
+func streamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte(0)
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+	return key.String()
+}
@@ -0,0 +1,121 @@
+package sinks_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func TestNewLoki(t *testing.T) {
+	for _, rawURL := range []string{"", "ftp://example.com", "/relative", "http://%zz"} {
+		_, err := sinks.NewLoki(rawURL)
+		assert.NotNil(t, err, rawURL)
+	}
+	for _, opt := range []sinks.LokiOption{
+		sinks.WithLokiLabels("applicationName", "custom"),
+		sinks.WithLokiStaticLabel("1job", "logproxy"),
+		sinks.WithLokiStaticLabel("job", ""),
+		sinks.WithLokiTimeout(0),
+	} {
+		_, err := sinks.NewLoki("http://localhost:3100", opt)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestLokiLabels(t *testing.T) {
+	loki, _ := sinks.NewLoki("http://localhost:3100", sinks.WithLokiStaticLabel("job", "logproxy"))
+	resource := logging.Resource{ApplicationName: "app", Severity: "INFO"}
+	assert.Equal(t, map[string]string{
+		"job":              "logproxy",
+		"application_name": "app",
+		"server_name":      "unknown",
+		"severity":         "INFO",
+	}, loki.Labels(resource))
+
+	loki, _ = sinks.NewLoki("http://localhost:3100", sinks.WithLokiLabels("severity"))
+	assert.Equal(t, map[string]string{"severity": "INFO"}, loki.Labels(resource))
+}
+
+func TestLoki(t *testing.T) {
+	var push struct {
+		Streams []lokiStream `json:"streams"`
+	}
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&push))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	loki, err := sinks.NewLoki(server.URL,
+		sinks.WithLokiLabels("applicationName", "severity"),
+		sinks.WithLokiTenant("dev"),
+		sinks.WithLokiBasicAuth("user", "pass"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	msgs := resources(3)
+	msgs[0].Severity = "ERROR"
+	msgs[0].LogTime = "2024-03-05T10:00:02.000Z"
+	msgs[1].Severity = "INFO"
+	msgs[1].LogTime = "2024-03-05T10:00:01.000Z"
+	msgs[2].Severity = "INFO"
+	msgs[2].LogTime = "2024-03-05T10:00:00.000Z"
+	resp, err := loki.StoreResources(msgs, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	assert.Equal(t, "dev", header.Get("X-Scope-OrgID"))
+	username, password, _ := (&http.Request{Header: header}).BasicAuth()
+	assert.Equal(t, "user:pass", username+":"+password)
+
+	if !assert.Len(t, push.Streams, 2) {
+		return
+	}
+	assert.Equal(t, map[string]string{"application_name": "app", "severity": "ERROR"}, push.Streams[0].Stream)
+	assert.Equal(t, [][2]string{{"1709632802000000000", "hello world"}}, push.Streams[0].Values)
+	// Entries of a stream are in time order
+	assert.Equal(t, [][2]string{
+		{"1709632800000000000", "hello world"},
+		{"1709632801000000000", "hello world"},
+	}, push.Streams[1].Values)
+}
+
+func TestLokiPushPath(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	loki, _ := sinks.NewLoki(server.URL + "/gateway/push")
+	_, err := loki.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "/gateway/push", path)
+}
+
+func TestLokiErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	loki, _ := sinks.NewLoki(server.URL)
+	resp, err := loki.StoreResources(resources(1), 1)
+	assert.True(t, errors.Is(err, sinks.ErrLokiStatus))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
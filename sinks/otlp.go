@@ -0,0 +1,418 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpLogsPath  = "/v1/logs"
+	otlpScopeName = "github.com/philips-software/logproxy"
+)
+
+// ErrOTLPStatus is returned when the collector doesn't accept an export
+var ErrOTLPStatus = errors.New("unexpected otlp status")
+
+// otlpSeverities maps HSDP and syslog severity names to OTLP severity numbers
+var otlpSeverities = map[string]logs.SeverityNumber{
+	"trace":         logs.SeverityNumber_SEVERITY_NUMBER_TRACE,
+	"debug":         logs.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+	"info":          logs.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"informational": logs.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"notice":        logs.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	"warn":          logs.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"warning":       logs.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"err":           logs.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"error":         logs.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"crit":          logs.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"critical":      logs.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"fatal":         logs.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"alert":         logs.SeverityNumber_SEVERITY_NUMBER_FATAL2,
+	"emerg":         logs.SeverityNumber_SEVERITY_NUMBER_FATAL4,
+	"emergency":     logs.SeverityNumber_SEVERITY_NUMBER_FATAL4,
+}
+
+// otlpRetryable are the gRPC codes the OTLP specification allows to retry
+var otlpRetryable = map[codes.Code]bool{
+	codes.Canceled:          true,
+	codes.DeadlineExceeded:  true,
+	codes.Aborted:           true,
+	codes.OutOfRange:        true,
+	codes.Unavailable:       true,
+	codes.DataLoss:          true,
+	codes.ResourceExhausted: true,
+}
+
+// OTLP exports resources as OpenTelemetry logs to a collector over gRPC or
+// HTTP. The application, its instance and version and the server name are
+// resource attributes, the trace and span IDs are set on the log records and
+// the other fields and the top level fields of Custom are log attributes
+type OTLP struct {
+	protocol  string
+	endpoint  string
+	header    http.Header
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	client    *http.Client
+	conn      *grpc.ClientConn
+	logs      collogs.LogsServiceClient
+	metrics   queue.Metrics
+}
+
+var _ logging.Storer = &OTLP{}
+
+// OTLPOption configures an OTLP sink
+type OTLPOption func(o *OTLP) error
+
+// WithOTLPHeader adds a header to every export, e.g. for authentication
+func WithOTLPHeader(key, value string) OTLPOption {
+	return func(o *OTLP) error {
+		if key == "" {
+			return errors.New("empty header name")
+		}
+		o.header.Add(key, value)
+		return nil
+	}
+}
+
+// WithOTLPTimeout limits the time an export may take, 10s by default
+func WithOTLPTimeout(timeout time.Duration) OTLPOption {
+	return func(o *OTLP) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithOTLPTLS connects with TLS. gRPC connections are insecure without it,
+// HTTP uses TLS for https endpoints
+func WithOTLPTLS(config *tls.Config) OTLPOption {
+	return func(o *OTLP) error {
+		o.tlsConfig = config
+		return nil
+	}
+}
+
+// WithOTLPMetrics counts the log records the collector rejects as partial
+// failures
+func WithOTLPMetrics(metrics queue.Metrics) OTLPOption {
+	return func(o *OTLP) error {
+		if metrics == nil {
+			return errors.New("missing metrics")
+		}
+		o.metrics = metrics
+		return nil
+	}
+}
+
+// NewOTLP returns an OTLP sink. For the grpc protocol endpoint is host:port,
+// e.g. localhost:4317. For http it is the URL of the collector, e.g.
+// http://localhost:4318, the logs path is added when the URL has no path
+func NewOTLP(protocol, endpoint string, opts ...OTLPOption) (*OTLP, error) {
+	o := &OTLP{
+		protocol: protocol,
+		header:   make(http.Header),
+		timeout:  defaultWebhookTimeout,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	switch protocol {
+	case "grpc":
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, fmt.Errorf("otlp endpoint: %w", err)
+		}
+		creds := insecure.NewCredentials()
+		if o.tlsConfig != nil {
+			creds = credentials.NewTLS(o.tlsConfig)
+		}
+		conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("otlp connection: %w", err)
+		}
+		o.conn = conn
+		o.logs = collogs.NewLogsServiceClient(conn)
+	case "http":
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("otlp endpoint: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("otlp endpoint must be an absolute http(s) URL: %q", endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpLogsPath
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = o.tlsConfig
+		o.client = &http.Client{Timeout: o.timeout, Transport: transport}
+		endpoint = u.String()
+	default:
+		return nil, fmt.Errorf("unsupported otlp protocol: %q", protocol)
+	}
+	o.endpoint = endpoint
+	return o, nil
+}
+
+// Close closes the gRPC connection
+func (o *OTLP) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	return o.conn.Close()
+}
+
+// Request returns the export request of resources. Resources which share
+// their resource attributes are grouped
+func (o *OTLP) Request(resources []logging.Resource) *collogs.ExportLogsServiceRequest {
+	request := &collogs.ExportLogsServiceRequest{}
+	groups := make(map[string]*logs.ScopeLogs)
+	observed := uint64(time.Now().UnixNano())
+	for _, r := range resources {
+		key := strings.Join([]string{r.ApplicationName, r.ApplicationInstance, r.ApplicationVersion, r.ServerName}, "\x00")
+		scope, ok := groups[key]
+		if !ok {
+			scope = &logs.ScopeLogs{Scope: &common.InstrumentationScope{Name: otlpScopeName}}
+			groups[key] = scope
+			request.ResourceLogs = append(request.ResourceLogs, &logs.ResourceLogs{
+				Resource: &resource.Resource{Attributes: attributes(
+					"service.name", r.ApplicationName,
+					"service.instance.id", r.ApplicationInstance,
+					"service.version", r.ApplicationVersion,
+					"host.name", r.ServerName,
+				)},
+				ScopeLogs: []*logs.ScopeLogs{scope},
+			})
+		}
+		scope.LogRecords = append(scope.LogRecords, logRecord(r, observed))
+	}
+	return request
+}
+
+func logRecord(r logging.Resource, observed uint64) *logs.LogRecord {
+	record := &logs.LogRecord{
+		ObservedTimeUnixNano: observed,
+		SeverityText:         r.Severity,
+		SeverityNumber:       otlpSeverities[strings.ToLower(r.Severity)],
+		Body:                 stringValue(queue.DecodeMessage(r.LogData.Message)),
+		Attributes: attributes(
+			"log.record.uid", r.ID,
+			"hsdp.event_id", r.EventID,
+			"hsdp.transaction_id", r.TransactionID,
+			"hsdp.service_name", r.ServiceName,
+			"hsdp.category", r.Category,
+			"hsdp.component", r.Component,
+			"hsdp.originating_user", r.OriginatingUser,
+		),
+	}
+	if logTime, err := time.Parse(time.RFC3339, r.LogTime); err == nil {
+		record.TimeUnixNano = uint64(logTime.UnixNano())
+	}
+	// IDs which aren't W3C trace context IDs are kept as attributes
+	if traceID, err := hex.DecodeString(r.TraceID); err == nil && len(traceID) == 16 {
+		record.TraceId = traceID
+	} else {
+		record.Attributes = append(record.Attributes, attributes("hsdp.trace_id", r.TraceID)...)
+	}
+	if spanID, err := hex.DecodeString(r.SpanID); err == nil && len(spanID) == 8 {
+		record.SpanId = spanID
+	} else {
+		record.Attributes = append(record.Attributes, attributes("hsdp.span_id", r.SpanID)...)
+	}
+
+	var custom map[string]interface{}
+	if len(r.Custom) > 0 && json.Unmarshal(r.Custom, &custom) == nil {
+		seen := make(map[string]bool, len(record.Attributes))
+		for _, attribute := range record.Attributes {
+			seen[attribute.Key] = true
+		}
+		for _, key := range sortedKeys(custom) {
+			if !seen[key] {
+				record.Attributes = append(record.Attributes, &common.KeyValue{Key: key, Value: anyValue(custom[key])})
+			}
+		}
+	}
+	return record
+}
+
+// attributes returns the non-empty values of key value pairs
+func attributes(pairs ...string) []*common.KeyValue {
+	var kvs []*common.KeyValue
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			kvs = append(kvs, &common.KeyValue{Key: pairs[i], Value: stringValue(pairs[i+1])})
+		}
+	}
+	return kvs
+}
+
+func stringValue(s string) *common.AnyValue {
+	return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: s}}
+}
+
+// anyValue converts a decoded JSON value
+func anyValue(value interface{}) *common.AnyValue {
+	switch v := value.(type) {
+	case string:
+		return stringValue(v)
+	case bool:
+		return &common.AnyValue{Value: &common.AnyValue_BoolValue{BoolValue: v}}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(v)}}
+		}
+		return &common.AnyValue{Value: &common.AnyValue_DoubleValue{DoubleValue: v}}
+	case []interface{}:
+		values := make([]*common.AnyValue, len(v))
+		for i := range v {
+			values[i] = anyValue(v[i])
+		}
+		return &common.AnyValue{Value: &common.AnyValue_ArrayValue{ArrayValue: &common.ArrayValue{Values: values}}}
+	case map[string]interface{}:
+		kvs := make([]*common.KeyValue, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			kvs = append(kvs, &common.KeyValue{Key: key, Value: anyValue(v[key])})
+		}
+		return &common.AnyValue{Value: &common.AnyValue_KvlistValue{KvlistValue: &common.KeyValueList{Values: kvs}}}
+	}
+	// null
+	return &common.AnyValue{}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StoreResources exports the resources. gRPC status codes are reported as
+// the HTTP status the OTLP specification maps them to, so the Deliverer
+// retries and rejects exports the same way for both protocols
+func (o *OTLP) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	request := o.Request(msgs[:count])
+	var partial *collogs.ExportLogsPartialSuccess
+	var storeResp *logging.StoreResponse
+	var err error
+	if o.protocol == "grpc" {
+		partial, storeResp, err = o.exportGRPC(request)
+	} else {
+		partial, storeResp, err = o.exportHTTP(request)
+	}
+	if err != nil {
+		return storeResp, err
+	}
+	// Partially rejected exports must not be retried and the collector
+	// doesn't tell which records it rejected
+	if rejected := partial.GetRejectedLogRecords(); rejected > 0 {
+		fmt.Fprintf(os.Stderr, "otlp collector rejected %d log records: %s\n", rejected, partial.GetErrorMessage())
+		if o.metrics != nil {
+			o.metrics.IncPartialFailure("rejected", int(rejected))
+		}
+	}
+	return storeResp, nil
+}
+
+func (o *OTLP) exportGRPC(request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsPartialSuccess, *logging.StoreResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	md := metadata.MD{}
+	for key, values := range o.header {
+		md.Append(key, values...)
+	}
+	resp, err := o.logs.Export(metadata.NewOutgoingContext(ctx, md), request)
+	if err == nil {
+		return resp.GetPartialSuccess(), &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusOK}}, nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, nil, err
+	}
+	httpResp := &http.Response{StatusCode: http.StatusBadRequest, Header: make(http.Header)}
+	switch {
+	case st.Code() == codes.Unauthenticated:
+		httpResp.StatusCode = http.StatusUnauthorized
+	case st.Code() == codes.PermissionDenied:
+		httpResp.StatusCode = http.StatusForbidden
+	case otlpRetryable[st.Code()]:
+		httpResp.StatusCode = http.StatusServiceUnavailable
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+				delay := info.GetRetryDelay().AsDuration()
+				httpResp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			}
+		}
+	}
+	return nil, &logging.StoreResponse{Response: httpResp}, fmt.Errorf("%w: %s: %s", ErrOTLPStatus, st.Code(), st.Message())
+}
+
+func (o *OTLP) exportHTTP(request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsPartialSuccess, *logging.StoreResponse, error) {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range o.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	storeResp := &logging.StoreResponse{Response: resp}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, storeResp, fmt.Errorf("%w: %d", ErrOTLPStatus, resp.StatusCode)
+	}
+	if err != nil {
+		return nil, storeResp, err
+	}
+	var exportResp collogs.ExportLogsServiceResponse
+	if err := proto.Unmarshal(data, &exportResp); err != nil {
+		return nil, storeResp, fmt.Errorf("decoding export response: %w", err)
+	}
+	return exportResp.GetPartialSuccess(), storeResp, nil
+}
@@ -0,0 +1,264 @@
+package sinks_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/queue"
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/stretchr/testify/assert"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// partialMetrics counts partial failures by outcome
+type partialMetrics struct {
+	queue.Metrics
+	partial map[string]int
+}
+
+func (m *partialMetrics) IncPartialFailure(outcome string, resources int) {
+	m.partial[outcome] += resources
+}
+
+// logsService is a fake collector which keeps the requests it receives
+type logsService struct {
+	collogs.UnimplementedLogsServiceServer
+	requests chan *collogs.ExportLogsServiceRequest
+	metadata chan metadata.MD
+	err      error
+}
+
+func (s *logsService) Export(ctx context.Context, req *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.metadata <- md
+	s.requests <- req
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+func grpcCollector(t *testing.T, err error) (*logsService, string, func()) {
+	listener, lerr := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, lerr) {
+		t.FailNow()
+	}
+	service := &logsService{
+		requests: make(chan *collogs.ExportLogsServiceRequest, 10),
+		metadata: make(chan metadata.MD, 10),
+		err:      err,
+	}
+	server := grpc.NewServer()
+	collogs.RegisterLogsServiceServer(server, service)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	return service, listener.Addr().String(), server.Stop
+}
+
+func attributeMap(kvs []*common.KeyValue) map[string]*common.AnyValue {
+	m := make(map[string]*common.AnyValue, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestNewOTLP(t *testing.T) {
+	for _, endpoint := range []string{"", "localhost", "http://localhost:4317"} {
+		_, err := sinks.NewOTLP("grpc", endpoint)
+		assert.NotNil(t, err, endpoint)
+	}
+	for _, endpoint := range []string{"", "localhost:4318", "ftp://localhost", "http://%zz"} {
+		_, err := sinks.NewOTLP("http", endpoint)
+		assert.NotNil(t, err, endpoint)
+	}
+	_, err := sinks.NewOTLP("udp", "localhost:4317")
+	assert.NotNil(t, err)
+	for _, opt := range []sinks.OTLPOption{
+		sinks.WithOTLPHeader("", "value"),
+		sinks.WithOTLPTimeout(0),
+		sinks.WithOTLPMetrics(nil),
+	} {
+		_, err := sinks.NewOTLP("grpc", "localhost:4317", opt)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	o, _ := sinks.NewOTLP("grpc", "localhost:4317")
+	msgs := resources(3)
+	msgs[0].ServerName = "cell"
+	msgs[0].ApplicationVersion = "1.0"
+	msgs[0].Severity = "ERROR"
+	msgs[0].LogTime = "2024-03-05T10:00:00.123Z"
+	msgs[0].EventID = "1"
+	msgs[0].Component = "api"
+	msgs[0].TraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	msgs[0].SpanID = "00f067aa0ba902b7"
+	msgs[0].Custom = json.RawMessage(`{"user":"joe","count":3,"ratio":0.5,"ok":true,"tags":["a"],"nested":{"a":null},"hsdp.component":"other"}`)
+	msgs[1].ServerName = "cell"
+	msgs[1].ApplicationVersion = "1.0"
+	msgs[1].TraceID = "not-a-trace"
+	msgs[2].ApplicationName = "other"
+
+	request := o.Request(msgs)
+	if !assert.Len(t, request.ResourceLogs, 2) {
+		return
+	}
+	assert.Equal(t, map[string]*common.AnyValue{
+		"service.name":    {Value: &common.AnyValue_StringValue{StringValue: "app"}},
+		"service.version": {Value: &common.AnyValue_StringValue{StringValue: "1.0"}},
+		"host.name":       {Value: &common.AnyValue_StringValue{StringValue: "cell"}},
+	}, attributeMap(request.ResourceLogs[0].Resource.Attributes))
+	assert.Equal(t, "github.com/philips-software/logproxy", request.ResourceLogs[0].ScopeLogs[0].Scope.Name)
+	records := request.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if !assert.Len(t, records, 2) {
+		return
+	}
+
+	record := records[0]
+	assert.Equal(t, uint64(time.Date(2024, 3, 5, 10, 0, 0, 123000000, time.UTC).UnixNano()), record.TimeUnixNano)
+	assert.NotZero(t, record.ObservedTimeUnixNano)
+	assert.Equal(t, "ERROR", record.SeverityText)
+	assert.Equal(t, logs.SeverityNumber_SEVERITY_NUMBER_ERROR, record.SeverityNumber)
+	assert.Equal(t, "hello world", record.Body.GetStringValue())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(record.TraceId))
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(record.SpanId))
+	attributes := attributeMap(record.Attributes)
+	assert.Equal(t, "a", attributes["log.record.uid"].GetStringValue())
+	assert.Equal(t, "1", attributes["hsdp.event_id"].GetStringValue())
+	// Custom fields don't override the resource fields
+	assert.Equal(t, "api", attributes["hsdp.component"].GetStringValue())
+	assert.Equal(t, "joe", attributes["user"].GetStringValue())
+	assert.Equal(t, int64(3), attributes["count"].GetIntValue())
+	assert.Equal(t, 0.5, attributes["ratio"].GetDoubleValue())
+	assert.True(t, attributes["ok"].GetBoolValue())
+	assert.Equal(t, "a", attributes["tags"].GetArrayValue().Values[0].GetStringValue())
+	assert.Equal(t, "a", attributes["nested"].GetKvlistValue().Values[0].Key)
+	assert.NotContains(t, attributes, "hsdp.trace_id")
+
+	record = records[1]
+	assert.Equal(t, logs.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, record.SeverityNumber)
+	assert.Empty(t, record.TraceId)
+	attributes = attributeMap(record.Attributes)
+	assert.Equal(t, "not-a-trace", attributes["hsdp.trace_id"].GetStringValue())
+	assert.NotContains(t, attributes, "hsdp.span_id")
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	service, address, stop := grpcCollector(t, nil)
+	defer stop()
+
+	o, err := sinks.NewOTLP("grpc", address, sinks.WithOTLPHeader("Authorization", "Bearer token"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = o.Close()
+	}()
+	resp, err := o.StoreResources(resources(3), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, []string{"Bearer token"}, (<-service.metadata).Get("authorization"))
+	request := <-service.requests
+	assert.Len(t, request.ResourceLogs[0].ScopeLogs[0].LogRecords, 2)
+}
+
+func TestOTLPGRPCErrors(t *testing.T) {
+	retry, _ := status.New(codes.Unavailable, "overloaded").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(1500 * time.Millisecond)})
+	for _, tc := range []struct {
+		err        error
+		statusCode int
+		retryAfter string
+	}{
+		{retry.Err(), http.StatusServiceUnavailable, "2"},
+		{status.Error(codes.ResourceExhausted, "slow down"), http.StatusServiceUnavailable, ""},
+		{status.Error(codes.InvalidArgument, "bad record"), http.StatusBadRequest, ""},
+		{status.Error(codes.Unauthenticated, "no token"), http.StatusUnauthorized, ""},
+		{status.Error(codes.PermissionDenied, "read only token"), http.StatusForbidden, ""},
+	} {
+		_, address, stop := grpcCollector(t, tc.err)
+		o, _ := sinks.NewOTLP("grpc", address)
+		resp, err := o.StoreResources(resources(1), 1)
+		assert.True(t, errors.Is(err, sinks.ErrOTLPStatus), tc.err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, tc.statusCode, resp.StatusCode(), tc.err)
+			assert.Equal(t, tc.retryAfter, resp.Response.Header.Get("Retry-After"), tc.err)
+		}
+		_ = o.Close()
+		stop()
+	}
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	var path, contentType, authorization string
+	var request collogs.ExportLogsServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType, authorization = r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		_ = proto.Unmarshal(body, &request)
+		data, _ := proto.Marshal(&collogs.ExportLogsServiceResponse{
+			PartialSuccess: &collogs.ExportLogsPartialSuccess{RejectedLogRecords: 1, ErrorMessage: "too old"},
+		})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	m := &partialMetrics{partial: map[string]int{}}
+	o, err := sinks.NewOTLP("http", server.URL,
+		sinks.WithOTLPHeader("Authorization", "Bearer token"),
+		sinks.WithOTLPMetrics(m))
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Partially rejected exports aren't retried
+	resp, err := o.StoreResources(resources(2), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "/v1/logs", path)
+	assert.Equal(t, "application/x-protobuf", contentType)
+	assert.Equal(t, "Bearer token", authorization)
+	assert.Len(t, request.ResourceLogs[0].ScopeLogs[0].LogRecords, 2)
+	assert.Equal(t, map[string]int{"rejected": 1}, m.partial)
+}
+
+func TestOTLPHTTPErrors(t *testing.T) {
+	statusCode := http.StatusTooManyRequests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}))
+	o, _ := sinks.NewOTLP("http", server.URL+"/custom/logs")
+	resp, err := o.StoreResources(resources(1), 1)
+	assert.True(t, errors.Is(err, sinks.ErrOTLPStatus))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+
+	statusCode = http.StatusBadRequest
+	resp, err = o.StoreResources(resources(1), 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	server.Close()
+
+	resp, err = o.StoreResources(resources(1), 1)
+	assert.NotNil(t, err)
+	assert.Nil(t, resp)
+}
@@ -0,0 +1,390 @@
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	s3TimeFormat    = "20060102T150405Z"
+	s3ObjectFormat  = "20060102T150405.000000000Z"
+)
+
+var (
+	// ErrS3Status is returned when the object storage answers with a status other than 2xx
+	ErrS3Status = errors.New("unexpected s3 status")
+
+	invalidPartitionChar = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+)
+
+// S3Credentials are the credentials requests are signed with
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3 archives resources as gzip compressed NDJSON objects in S3 compatible
+// object storage. Every batch is written as one object per log date and
+// application, next to a manifest which describes it:
+//
+//	<prefix>date=2024-03-05/application=app/20240305T100000.000000000Z-<uuid>.ndjson.gz
+//	<prefix>date=2024-03-05/application=app/20240305T100000.000000000Z-<uuid>.manifest.json
+//
+// The manifest is written after its object, an object without one is from
+// a batch which failed part way and was written again
+type S3 struct {
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials S3Credentials
+	virtualHost bool
+	client      *http.Client
+}
+
+var _ logging.Storer = &S3{}
+
+// S3Manifest describes an archived object
+type S3Manifest struct {
+	Object           string    `json:"object"`
+	Records          int       `json:"records"`
+	Bytes            int       `json:"bytes"`
+	UncompressedSize int       `json:"uncompressedBytes"`
+	SHA256           string    `json:"sha256"`
+	FirstLogTime     string    `json:"firstLogTime,omitempty"`
+	LastLogTime      string    `json:"lastLogTime,omitempty"`
+	Created          time.Time `json:"created"`
+}
+
+// S3Option configures an S3 sink
+type S3Option func(s *S3) error
+
+// WithS3Credentials signs requests with credentials, requests are anonymous without them
+func WithS3Credentials(credentials S3Credentials) S3Option {
+	return func(s *S3) error {
+		if (credentials.AccessKeyID == "") != (credentials.SecretAccessKey == "") {
+			return errors.New("access key id and secret access key must be set together")
+		}
+		s.credentials = credentials
+		return nil
+	}
+}
+
+// WithS3Region sets the region requests are signed for, us-east-1 by default
+func WithS3Region(region string) S3Option {
+	return func(s *S3) error {
+		if region == "" {
+			return errors.New("empty region")
+		}
+		s.region = region
+		return nil
+	}
+}
+
+// WithS3Prefix puts the objects under prefix
+func WithS3Prefix(prefix string) S3Option {
+	return func(s *S3) error {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		s.prefix = prefix
+		return nil
+	}
+}
+
+// WithVirtualHostedStyle addresses the bucket as a subdomain of the endpoint
+// instead of as the first element of the path
+func WithVirtualHostedStyle() S3Option {
+	return func(s *S3) error {
+		s.virtualHost = true
+		return nil
+	}
+}
+
+// WithS3Timeout limits the time a request may take, 10s by default
+func WithS3Timeout(timeout time.Duration) S3Option {
+	return func(s *S3) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		s.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithS3HTTPClient sends the requests with client
+func WithS3HTTPClient(client *http.Client) S3Option {
+	return func(s *S3) error {
+		s.client = client
+		return nil
+	}
+}
+
+// NewS3 returns an S3 sink which archives to bucket at endpoint, e.g.
+// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO
+func NewS3(endpoint, bucket string, opts ...S3Option) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint must be an absolute http(s) URL: %q", endpoint)
+	}
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket: %q", bucket)
+	}
+	s := &S3{
+		endpoint: u,
+		bucket:   bucket,
+		region:   defaultS3Region,
+		client:   &http.Client{Timeout: defaultWebhookTimeout},
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Partition returns the key prefix of the objects resource is archived in
+func (s *S3) Partition(resource logging.Resource) string {
+	logTime, err := time.Parse(time.RFC3339, resource.LogTime)
+	if err != nil {
+		logTime = time.Now()
+	}
+	application := invalidPartitionChar.ReplaceAllString(resource.ApplicationName, "_")
+	if application == "" {
+		application = "_"
+	}
+	return s.prefix + "date=" + logTime.UTC().Format("2006-01-02") + "/application=" + application + "/"
+}
+
+// StoreResources archives the resources. A batch which fails is retried as a
+// whole, so objects which were written before the failure are written twice
+func (s *S3) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	var partitions []string
+	batches := make(map[string][]logging.Resource)
+	for i := 0; i < count; i++ {
+		partition := s.Partition(msgs[i])
+		if _, ok := batches[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		batches[partition] = append(batches[partition], msgs[i])
+	}
+	for _, partition := range partitions {
+		if err := s.archive(partition, batches[partition]); err != nil {
+			return nil, err
+		}
+	}
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func (s *S3) archive(partition string, resources []logging.Resource) error {
+	var uncompressed countingWriter
+	var object bytes.Buffer
+	zw := gzip.NewWriter(&object)
+	encoder := json.NewEncoder(io.MultiWriter(zw, &uncompressed))
+	logTimes := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		if err := encoder.Encode(resource); err != nil {
+			return err
+		}
+		if resource.LogTime != "" {
+			logTimes = append(logTimes, resource.LogTime)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	created := time.Now().UTC()
+	name := partition + created.Format(s3ObjectFormat) + "-" + uuid.NewString()
+	sum := sha256.Sum256(object.Bytes())
+	manifest := S3Manifest{
+		Object:           name + ".ndjson.gz",
+		Records:          len(resources),
+		Bytes:            object.Len(),
+		UncompressedSize: int(uncompressed),
+		SHA256:           hex.EncodeToString(sum[:]),
+		Created:          created,
+	}
+	if len(logTimes) > 0 {
+		sort.Strings(logTimes)
+		manifest.FirstLogTime = logTimes[0]
+		manifest.LastLogTime = logTimes[len(logTimes)-1]
+	}
+	manifestBody, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := s.put(manifest.Object, "application/gzip", object.Bytes()); err != nil {
+		return err
+	}
+	return s.put(name+".manifest.json", "application/json", manifestBody)
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// put uploads an object
+func (s *S3) put(key, contentType string, body []byte) error {
+	u := *s.endpoint
+	path := "/" + s.bucket + "/" + key
+	if s.virtualHost {
+		u.Host = s.bucket + "." + u.Host
+		path = "/" + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = awsEscapePath(u.Path)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	sum := sha256.Sum256(body)
+	SignV4(req, hex.EncodeToString(sum[:]), s.credentials, s.region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		return nil
+	}
+	var s3Err s3Error
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&s3Err)
+	if s3Err.Code != "" {
+		return fmt.Errorf("put %s: %w: %d %s: %s", key, ErrS3Status, resp.StatusCode, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("put %s: %w: %d", key, ErrS3Status, resp.StatusCode)
+}
+
+// SignV4 signs req with AWS Signature Version 4. All headers set on req are
+// signed. payloadHash is the hex encoded SHA-256 of the body. Requests
+// without credentials are left unsigned
+func SignV4(req *http.Request, payloadHash string, credentials S3Credentials, region, service string, now time.Time) {
+	if credentials.AccessKeyID == "" {
+		return
+	}
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	day := now.Format("20060102")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), day)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+credentials.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscapePath escapes every segment of path the way AWS expects
+func awsEscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsEscape percent encodes everything but the unreserved characters of RFC 3986
+func awsEscape(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			escaped.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&escaped, "%%%02X", b)
+	}
+	return escaped.String()
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,338 @@
+package sinks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+)
+
+const (
+	// DocumentationEnterpriseID is the private enterprise number reserved for
+	// documentation by RFC 5612, used in structured data IDs by default
+	DocumentationEnterpriseID = 32473
+
+	defaultSyslogFacility = 1 // user-level messages
+	syslogNil             = "-"
+	syslogTimeFormat      = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// ErrSyslogNetwork is returned for networks other than tcp, tls and udp
+var ErrSyslogNetwork = errors.New("unsupported syslog network")
+
+// syslogSeverities maps HSDP and syslog severity names to syslog severity codes
+var syslogSeverities = map[string]int{
+	"emergency": 0, "emerg": 0, "panic": 0,
+	"alert":    1,
+	"critical": 2, "crit": 2, "fatal": 2,
+	"error": 3, "err": 3,
+	"warning": 4, "warn": 4,
+	"notice":        5,
+	"informational": 6, "info": 6,
+	"debug": 7, "trace": 7,
+}
+
+// Syslog forwards resources as RFC 5424 messages to a collector over TCP,
+// TLS or UDP. The trace fields, the resource fields which don't fit the
+// syslog header and the top level fields of Custom are sent as structured
+// data. Stream connections are kept open and redialed after a failure
+type Syslog struct {
+	network      string
+	address      string
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+	facility     int
+	enterpriseID int
+	octetCount   bool
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+var _ logging.Storer = &Syslog{}
+
+// SyslogOption configures a Syslog sink
+type SyslogOption func(s *Syslog) error
+
+// WithSyslogTLS sets the TLS configuration of the tls network
+func WithSyslogTLS(config *tls.Config) SyslogOption {
+	return func(s *Syslog) error {
+		s.tlsConfig = config
+		return nil
+	}
+}
+
+// WithSyslogTimeout limits the time connecting and writing a batch may take,
+// 10s by default
+func WithSyslogTimeout(timeout time.Duration) SyslogOption {
+	return func(s *Syslog) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		s.timeout = timeout
+		return nil
+	}
+}
+
+// WithSyslogFacility sets the facility of the messages, user-level (1) by default
+func WithSyslogFacility(facility int) SyslogOption {
+	return func(s *Syslog) error {
+		if facility < 0 || facility > 23 {
+			return fmt.Errorf("invalid facility: %d", facility)
+		}
+		s.facility = facility
+		return nil
+	}
+}
+
+// WithSyslogEnterpriseID sets the private enterprise number of the structured
+// data IDs, e.g. trace@32473
+func WithSyslogEnterpriseID(id int) SyslogOption {
+	return func(s *Syslog) error {
+		if id <= 0 {
+			return fmt.Errorf("invalid enterprise id: %d", id)
+		}
+		s.enterpriseID = id
+		return nil
+	}
+}
+
+// WithNewlineFraming separates messages on stream connections with a newline
+// instead of prefixing them with their length as RFC 6587 octet counting.
+// Newlines within messages are escaped as \n
+func WithNewlineFraming() SyslogOption {
+	return func(s *Syslog) error {
+		s.octetCount = false
+		return nil
+	}
+}
+
+// NewSyslog returns a Syslog sink which sends to address over network, which
+// is tcp, tls or udp
+func NewSyslog(network, address string, opts ...SyslogOption) (*Syslog, error) {
+	switch network {
+	case "tcp", "tls", "udp":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrSyslogNetwork, network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("syslog address: %w", err)
+	}
+	s := &Syslog{
+		network:      network,
+		address:      address,
+		timeout:      defaultWebhookTimeout,
+		facility:     defaultSyslogFacility,
+		enterpriseID: DocumentationEnterpriseID,
+		octetCount:   true,
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// StoreResources sends the resources. A batch which fails part way is sent
+// again, so the collector may receive some messages twice
+func (s *Syslog) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	frames := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		message := s.Format(msgs[i])
+		switch {
+		case s.network == "udp":
+			frames[i] = message
+		case s.octetCount:
+			frames[i] = append([]byte(strconv.Itoa(len(message))+" "), message...)
+		default:
+			// A newline would end the message early
+			frames[i] = append(bytes.ReplaceAll(message, []byte("\n"), []byte(`\n`)), '\n')
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	var err error
+	if s.network == "udp" {
+		for _, frame := range frames {
+			if _, err = s.conn.Write(frame); err != nil {
+				break
+			}
+		}
+	} else {
+		_, err = s.conn.Write(bytes.Join(frames, nil))
+	}
+	if err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	return &logging.StoreResponse{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	if s.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.address)
+}
+
+// Close closes the connection to the collector
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Format returns resource as an RFC 5424 message. ServerName is the host
+// name, ApplicationName the app name, ApplicationInstance the process ID and
+// Category the message ID
+func (s *Syslog) Format(resource logging.Resource) []byte {
+	severity, ok := syslogSeverities[strings.ToLower(resource.Severity)]
+	if !ok {
+		severity = syslogSeverities["info"]
+	}
+	timestamp := syslogNil
+	if logTime, err := time.Parse(time.RFC3339, resource.LogTime); err == nil {
+		timestamp = logTime.Format(syslogTimeFormat)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s %s ",
+		s.facility*8+severity,
+		timestamp,
+		headerField(resource.ServerName, 255),
+		headerField(resource.ApplicationName, 48),
+		headerField(resource.ApplicationInstance, 128),
+		headerField(resource.Category, 32))
+
+	elements := 0
+	element := func(id string, params [][2]string) {
+		var written bool
+		for _, param := range params {
+			if param[1] == "" {
+				continue
+			}
+			if !written {
+				buf.WriteString("[" + id + "@" + strconv.Itoa(s.enterpriseID))
+				written = true
+			}
+			buf.WriteString(" " + sdName(param[0]) + `="` + sdValue(param[1]) + `"`)
+		}
+		if written {
+			buf.WriteByte(']')
+			elements++
+		}
+	}
+	element("resource", [][2]string{
+		{"id", resource.ID},
+		{"eventId", resource.EventID},
+		{"serviceName", resource.ServiceName},
+		{"component", resource.Component},
+		{"applicationVersion", resource.ApplicationVersion},
+		{"originatingUser", resource.OriginatingUser},
+	})
+	element("trace", [][2]string{
+		{"traceId", resource.TraceID},
+		{"spanId", resource.SpanID},
+		{"transactionId", resource.TransactionID},
+	})
+	element("custom", customParams(resource.Custom))
+	if elements == 0 {
+		buf.WriteString(syslogNil)
+	}
+
+	if message := queue.DecodeMessage(resource.LogData.Message); message != "" {
+		buf.WriteString(" " + message)
+	}
+	return buf.Bytes()
+}
+
+// customParams returns the top level fields of custom, values which aren't
+// strings are JSON encoded. Custom which isn't an object is sent as json
+func customParams(custom json.RawMessage) [][2]string {
+	if len(custom) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(custom, &fields); err != nil {
+		return [][2]string{{"json", string(custom)}}
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([][2]string, 0, len(names))
+	for _, name := range names {
+		var value string
+		if err := json.Unmarshal(fields[name], &value); err != nil {
+			value = string(fields[name])
+		}
+		params = append(params, [2]string{name, value})
+	}
+	return params
+}
+
+// headerField returns value as a syslog header field of printable ASCII
+// without spaces, cut to max characters
+func headerField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > max {
+		field = field[:max]
+	}
+	if field == "" {
+		return syslogNil
+	}
+	return field
+}
+
+// sdName returns name as a structured data parameter name
+func sdName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// sdValue escapes the characters RFC 5424 requires to be escaped in values
+func sdValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
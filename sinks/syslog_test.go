@@ -0,0 +1,235 @@
+package sinks_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/influxdata/go-syslog/v2/rfc5424"
+	"github.com/stretchr/testify/assert"
+)
+
+// collector accepts one TCP connection and returns the octet counted frames
+func collector(t *testing.T) (net.Listener, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	frames := make(chan string, 100)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			frame := make([]byte, n)
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				return
+			}
+			frames <- string(frame)
+		}
+	}()
+	return listener, frames
+}
+
+func parseSyslog(t *testing.T, message string) *rfc5424.SyslogMessage {
+	msg, err := rfc5424.NewParser().Parse([]byte(message))
+	if !assert.Nil(t, err, message) {
+		t.FailNow()
+	}
+	return msg.(*rfc5424.SyslogMessage)
+}
+
+func TestNewSyslog(t *testing.T) {
+	_, err := sinks.NewSyslog("unix", "127.0.0.1:514")
+	assert.True(t, errors.Is(err, sinks.ErrSyslogNetwork))
+	_, err = sinks.NewSyslog("tcp", "localhost")
+	assert.NotNil(t, err)
+	for _, opt := range []sinks.SyslogOption{
+		sinks.WithSyslogFacility(24),
+		sinks.WithSyslogEnterpriseID(0),
+		sinks.WithSyslogTimeout(0),
+	} {
+		_, err := sinks.NewSyslog("tcp", "127.0.0.1:514", opt)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	s, _ := sinks.NewSyslog("tcp", "127.0.0.1:514", sinks.WithSyslogFacility(16))
+	resource := resources(1)[0]
+	resource.ServerName = "cell 1"
+	resource.ApplicationInstance = "0"
+	resource.Category = "TRACELOG"
+	resource.Severity = "ERROR"
+	resource.LogTime = "2024-03-05T10:00:00.123Z"
+	resource.EventID = "1"
+	resource.TraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	resource.SpanID = "00f067aa0ba902b7"
+	resource.Custom = json.RawMessage(`{"user":"jo\"e]","count":3,"nested":{"a":1}}`)
+
+	msg := parseSyslog(t, string(s.Format(resource)))
+	// local0.err
+	assert.Equal(t, uint8(131), *msg.Priority())
+	assert.Equal(t, "2024-03-05T10:00:00.123Z", msg.Timestamp().Format("2006-01-02T15:04:05.000Z07:00"))
+	assert.Equal(t, "cell_1", *msg.Hostname())
+	assert.Equal(t, "app", *msg.Appname())
+	assert.Equal(t, "0", *msg.ProcID())
+	assert.Equal(t, "TRACELOG", *msg.MsgID())
+	assert.Equal(t, "hello world", *msg.Message())
+	assert.Equal(t, map[string]map[string]string{
+		"resource@32473": {"id": "a", "eventId": "1"},
+		"trace@32473":    {"traceId": "4bf92f3577b34da6a3ce929d0e0e4736", "spanId": "00f067aa0ba902b7"},
+		"custom@32473":   {"user": `jo"e]`, "count": "3", "nested": `{"a":1}`},
+	}, *msg.StructuredData())
+}
+
+func TestSyslogFormatMinimal(t *testing.T) {
+	s, _ := sinks.NewSyslog("udp", "127.0.0.1:514", sinks.WithSyslogEnterpriseID(1))
+	resource := logging.Resource{Severity: "unknown", LogData: logging.LogData{Message: "plain"}}
+	assert.Equal(t, "<14>1 - - - - - - plain", string(s.Format(resource)))
+	// fatal ranks with critical, like the priority lanes
+	resource.Severity = "FATAL"
+	assert.Equal(t, "<10>1 - - - - - - plain", string(s.Format(resource)))
+	resource.Custom = json.RawMessage(`[1,2]`)
+	assert.Contains(t, string(s.Format(resource)), `[custom@1 json="[1,2\]"]`)
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, frames := collector(t)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	s, err := sinks.NewSyslog("tcp", listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	resp, err := s.StoreResources(resources(3), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode())
+	for _, id := range []string{"a", "b", "c"} {
+		msg := parseSyslog(t, <-frames)
+		assert.Equal(t, id, (*msg.StructuredData())["resource@32473"]["id"])
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	s, _ := sinks.NewSyslog("udp", conn.LocalAddr().String())
+	_, err = s.StoreResources(resources(2), 2)
+	assert.Nil(t, err)
+	buf := make([]byte, 2048)
+	for _, id := range []string{"a", "b"} {
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		msg := parseSyslog(t, string(buf[:n]))
+		assert.Equal(t, id, (*msg.StructuredData())["resource@32473"]["id"])
+	}
+}
+
+func TestSyslogNewlineFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	lines := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	s, _ := sinks.NewSyslog("tcp", listener.Addr().String(), sinks.WithNewlineFraming())
+	defer func() {
+		_ = s.Close()
+	}()
+	msgs := resources(2)
+	msgs[0].LogData.Message = base64.StdEncoding.EncodeToString([]byte("line one\nline two"))
+	_, err = s.StoreResources(msgs, 2)
+	assert.Nil(t, err)
+	// Multi-line messages stay a single record
+	assert.True(t, strings.HasSuffix(<-lines, ` line one\nline two`+"\n"))
+	msg := parseSyslog(t, strings.TrimSuffix(<-lines, "\n"))
+	assert.Equal(t, "b", (*msg.StructuredData())["resource@32473"]["id"])
+}
+
+func TestSyslogRedials(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	s, _ := sinks.NewSyslog("tcp", address, sinks.WithNewlineFraming())
+	// No collector listening, there is no response to retry on
+	resp, err := s.StoreResources(resources(1), 1)
+	assert.NotNil(t, err)
+	assert.Nil(t, resp)
+
+	listener, err = net.Listen("tcp", address)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+		_ = conn.Close()
+	}()
+	_, err = s.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(<-lines, " hello world\n"))
+	_ = s.Close()
+}
@@ -0,0 +1,157 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/philips-software/logproxy/queue"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// ErrWebhookStatus is returned when the webhook answers with a status other than 2xx
+var ErrWebhookStatus = errors.New("unexpected webhook status")
+
+// Webhook POSTs batches of resources as a JSON array to a URL. The response
+// is handed back to the Deliverer, which retries on 429 and 5xx and splits
+// batches which are rejected with another 4xx
+type Webhook struct {
+	url      string
+	client   *http.Client
+	header   http.Header
+	username string
+	password string
+	token    string
+	decode   bool
+}
+
+var _ logging.Storer = &Webhook{}
+
+// WebhookOption configures a Webhook sink
+type WebhookOption func(w *Webhook) error
+
+// WithHeader adds a header to every request
+func WithHeader(key, value string) WebhookOption {
+	return func(w *Webhook) error {
+		if key == "" {
+			return errors.New("empty header name")
+		}
+		w.header.Add(key, value)
+		return nil
+	}
+}
+
+// WithBasicAuth authenticates with a username and password
+func WithBasicAuth(username, password string) WebhookOption {
+	return func(w *Webhook) error {
+		w.username = username
+		w.password = password
+		return nil
+	}
+}
+
+// WithBearerToken authenticates with a bearer token
+func WithBearerToken(token string) WebhookOption {
+	return func(w *Webhook) error {
+		w.token = token
+		return nil
+	}
+}
+
+// WithTimeout limits the time a request may take, 10s by default
+func WithTimeout(timeout time.Duration) WebhookOption {
+	return func(w *Webhook) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %v", timeout)
+		}
+		w.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithHTTPClient sends the requests with client
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(w *Webhook) error {
+		w.client = client
+		return nil
+	}
+}
+
+// WithWebhookDecodedMessages sends the log message as text instead of base64
+func WithWebhookDecodedMessages() WebhookOption {
+	return func(w *Webhook) error {
+		w.decode = true
+		return nil
+	}
+}
+
+// NewWebhook returns a Webhook sink which POSTs to rawURL
+func NewWebhook(rawURL string, opts ...WebhookOption) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("webhook url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook url must be an absolute http(s) URL: %q", rawURL)
+	}
+	w := &Webhook{
+		url:    rawURL,
+		client: &http.Client{Timeout: defaultWebhookTimeout},
+		header: make(http.Header),
+	}
+	for _, o := range opts {
+		if err := o(w); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// StoreResources POSTs the resources
+func (w *Webhook) StoreResources(msgs []logging.Resource, count int) (*logging.StoreResponse, error) {
+	batch := make([]logging.Resource, count)
+	for i := 0; i < count; i++ {
+		batch[i] = msgs[i]
+		if w.decode {
+			batch[i].LogData.Message = queue.DecodeMessage(batch[i].LogData.Message)
+		}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range w.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.username != "" || w.password != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	storeResp := &logging.StoreResponse{Response: resp}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return storeResp, fmt.Errorf("%w: %d", ErrWebhookStatus, resp.StatusCode)
+	}
+	return storeResp, nil
+}
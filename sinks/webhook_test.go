@@ -0,0 +1,95 @@
+package sinks_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/philips-software/logproxy/sinks"
+
+	"github.com/dip-software/go-dip-api/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWebhook(t *testing.T) {
+	for _, rawURL := range []string{"", "ftp://example.com", "/relative", "http://%zz"} {
+		_, err := sinks.NewWebhook(rawURL)
+		assert.NotNil(t, err, rawURL)
+	}
+	_, err := sinks.NewWebhook("https://example.com", sinks.WithTimeout(0))
+	assert.NotNil(t, err)
+	_, err = sinks.NewWebhook("https://example.com", sinks.WithHeader("", "x"))
+	assert.NotNil(t, err)
+}
+
+func TestWebhook(t *testing.T) {
+	var received []logging.Resource
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	webhook, err := sinks.NewWebhook(server.URL,
+		sinks.WithHeader("X-Source", "logproxy"),
+		sinks.WithBearerToken("secret"),
+		sinks.WithWebhookDecodedMessages(),
+		sinks.WithTimeout(time.Second))
+	if !assert.Nil(t, err) {
+		return
+	}
+	resp, err := webhook.StoreResources(resources(3), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+	if assert.Len(t, received, 2) {
+		assert.Equal(t, "a", received[0].ID)
+		assert.Equal(t, "hello world", received[1].LogData.Message)
+	}
+	assert.Equal(t, "logproxy", header.Get("X-Source"))
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+}
+
+func TestWebhookBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	webhook, _ := sinks.NewWebhook(server.URL, sinks.WithBasicAuth("user", "pass"))
+	_, err := webhook.StoreResources(resources(1), 1)
+	assert.Nil(t, err)
+
+	webhook, _ = sinks.NewWebhook(server.URL, sinks.WithBasicAuth("user", "wrong"))
+	resp, err := webhook.StoreResources(resources(1), 1)
+	assert.True(t, errors.Is(err, sinks.ErrWebhookStatus))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
+
+func TestWebhookErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	webhook, _ := sinks.NewWebhook(server.URL)
+	resp, err := webhook.StoreResources(resources(1), 1)
+	assert.True(t, errors.Is(err, sinks.ErrWebhookStatus))
+	assert.Equal(t, "3", resp.Response.Header.Get("Retry-After"))
+	server.Close()
+
+	// Connection errors don't come with a response
+	resp, err = webhook.StoreResources(resources(1), 1)
+	assert.NotNil(t, err)
+	assert.Nil(t, resp)
+}